@@ -0,0 +1,143 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+
+	"github.com/Doridian/foxDNS/handler/resolver"
+	"github.com/miekg/dns"
+)
+
+type adminFlushResult struct {
+	Removed int `json:"removed"`
+}
+
+func writeAdminJSON(wr http.ResponseWriter, status int, v any) {
+	wr.Header().Set("Content-Type", "application/json")
+	wr.WriteHeader(status)
+	err := json.NewEncoder(wr).Encode(v)
+	if err != nil {
+		log.Printf("Error writing admin API response: %v", err)
+	}
+}
+
+func writeAdminError(wr http.ResponseWriter, status int, msg string) {
+	writeAdminJSON(wr, status, map[string]string{"error": msg})
+}
+
+func getNamedResolver(wr http.ResponseWriter, req *http.Request) *resolver.Generator {
+	loadersLock.Lock()
+	resolv := namedResolvers[req.PathValue("resolver")]
+	loadersLock.Unlock()
+
+	if resolv == nil {
+		writeAdminError(wr, http.StatusNotFound, "unknown resolver")
+	}
+	return resolv
+}
+
+// getNameQuery parses the name and subtree query parameters shared by the cache endpoints
+func getNameQuery(wr http.ResponseWriter, req *http.Request, required bool) (string, bool, bool) {
+	query := req.URL.Query()
+
+	name := query.Get("name")
+	if name == "" {
+		if required {
+			writeAdminError(wr, http.StatusBadRequest, "name is required")
+			return "", false, false
+		}
+		return "", false, true
+	}
+	name = dns.Fqdn(name)
+	if _, ok := dns.IsDomainName(name); !ok {
+		writeAdminError(wr, http.StatusBadRequest, "invalid name")
+		return "", false, false
+	}
+
+	subtree := false
+	if subtreeStr := query.Get("subtree"); subtreeStr != "" {
+		var err error
+		subtree, err = strconv.ParseBool(subtreeStr)
+		if err != nil {
+			writeAdminError(wr, http.StatusBadRequest, "invalid subtree")
+			return "", false, false
+		}
+	}
+
+	return name, subtree, true
+}
+
+func handleAdminListResolvers(wr http.ResponseWriter, _ *http.Request) {
+	loadersLock.Lock()
+	names := make([]string, 0, len(namedResolvers))
+	for name := range namedResolvers {
+		names = append(names, name)
+	}
+	loadersLock.Unlock()
+
+	slices.Sort(names)
+	writeAdminJSON(wr, http.StatusOK, names)
+}
+
+func handleAdminCache(records bool) http.HandlerFunc {
+	return func(wr http.ResponseWriter, req *http.Request) {
+		resolv := getNamedResolver(wr, req)
+		if resolv == nil {
+			return
+		}
+
+		name, subtree, ok := getNameQuery(wr, req, true)
+		if !ok {
+			return
+		}
+
+		writeAdminJSON(wr, http.StatusOK, resolv.CacheEntries(name, subtree, records))
+	}
+}
+
+func handleAdminFlush(wr http.ResponseWriter, req *http.Request) {
+	resolv := getNamedResolver(wr, req)
+	if resolv == nil {
+		return
+	}
+
+	name, subtree, ok := getNameQuery(wr, req, false)
+	if !ok {
+		return
+	}
+
+	if name == "" {
+		removed := resolv.CacheLen()
+		resolv.FlushCache()
+		log.Printf("Admin API flushed entire cache of resolver %s", req.PathValue("resolver"))
+		writeAdminJSON(wr, http.StatusOK, &adminFlushResult{Removed: removed})
+		return
+	}
+
+	removed := resolv.FlushName(name, subtree)
+	log.Printf("Admin API flushed %s (subtree=%v) from cache of resolver %s", name, subtree, req.PathValue("resolver"))
+	writeAdminJSON(wr, http.StatusOK, &adminFlushResult{Removed: removed})
+}
+
+// newAdminHandler serves the admin API, all requests need to carry "Authorization: Bearer <token>"
+func newAdminHandler(token string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /resolvers", handleAdminListResolvers)
+	mux.HandleFunc("GET /resolvers/{resolver}/cache", handleAdminCache(false))
+	mux.HandleFunc("GET /resolvers/{resolver}/cache/dump", handleAdminCache(true))
+	mux.HandleFunc("POST /resolvers/{resolver}/flush", handleAdminFlush)
+
+	expectedAuth := []byte("Bearer " + token)
+	return http.HandlerFunc(func(wr http.ResponseWriter, req *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(req.Header.Get("Authorization")), expectedAuth) != 1 {
+			wr.Header().Set("WWW-Authenticate", "Bearer")
+			writeAdminError(wr, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+		mux.ServeHTTP(wr, req)
+	})
+}
@@ -4,8 +4,12 @@ import (
 	"os"
 	"time"
 
+	"github.com/Doridian/foxDNS/dnstap"
+	"github.com/Doridian/foxDNS/handler"
 	"github.com/Doridian/foxDNS/handler/localizer"
 	"github.com/Doridian/foxDNS/handler/static"
+	"github.com/Doridian/foxDNS/querylog"
+	"github.com/Doridian/foxDNS/server"
 	"gopkg.in/yaml.v3"
 )
 
@@ -14,14 +18,36 @@ type Config struct {
 	Templates interface{} `yaml:"templates"`
 
 	Global struct {
-		Listen            []string `yaml:"listen"`
-		PrometheusListen  string   `yaml:"prometheus-listen"`
-		UDPSize           int      `yaml:"udp-size"`
-		MaxRecursionDepth int      `yaml:"max-recursion-depth"`
-		RequireCookie     bool     `yaml:"require-cookie"`
+		Listen            []string                `yaml:"listen"`
+		TLS               *server.TLSConfig       `yaml:"tls"`
+		DoH               *server.DoHConfig       `yaml:"doh"`
+		RateLimit         *server.RateLimitConfig `yaml:"rate-limit"`
+		RRL               *handler.RRLConfig      `yaml:"rrl"`
+		Dnstap            *dnstap.Config          `yaml:"dnstap"`
+		QueryLog          *querylog.Config        `yaml:"query-log"`
+		PrometheusListen  string                  `yaml:"prometheus-listen"`
+		AdminListen       string                  `yaml:"admin-listen"`
+		AdminToken        string                  `yaml:"admin-token"`
+		UDPSize           int                     `yaml:"udp-size"`
+		MaxRecursionDepth int                     `yaml:"max-recursion-depth"`
+		RequireCookie     bool                    `yaml:"require-cookie"`
 	} `yaml:"global"`
 
+	ViewConfig `yaml:",inline"`
+
+	Views []struct {
+		Name      string   `yaml:"name"`
+		Clients   []string `yaml:"clients"`
+		Listeners []string `yaml:"listeners"`
+
+		ViewConfig `yaml:",inline"`
+	} `yaml:"views"`
+}
+
+// ViewConfig holds everything that answers queries, once for the default view and once for every view
+type ViewConfig struct {
 	Resolvers []struct {
+		Name        string   `yaml:"name"`
 		Zones       []string `yaml:"zones"`
 		NameServers []struct {
 			Addr               string        `yaml:"addr"`
@@ -29,10 +55,35 @@ type Config struct {
 			ServerName         string        `yaml:"server-name"`
 			RequireCookie      bool          `yaml:"require-cookie"`
 			MaxParallelQueries int           `yaml:"max-parallel-queries"`
+			Pipeline           bool          `yaml:"pipeline"`
+			MaxConnections     int           `yaml:"max-connections"`
 			Timeout            time.Duration `yaml:"timeout"`
 		} `yaml:"nameservers"`
 		NameServerStrategy string `yaml:"nameserver-strategy"`
 
+		QNameCaseRandomisation bool `yaml:"qname-case-randomisation"`
+
+		ClientSubnet struct {
+			Enabled     bool   `yaml:"enabled"`
+			IPv4Prefix  uint8  `yaml:"ipv4-prefix"`
+			IPv6Prefix  uint8  `yaml:"ipv6-prefix"`
+			StripClient bool   `yaml:"strip-client"`
+			Override    string `yaml:"override"`
+		} `yaml:"client-subnet"`
+
+		RaceCount  int           `yaml:"race-count"`
+		HedgeDelay time.Duration `yaml:"hedge-delay"`
+
+		Iterative         bool          `yaml:"iterative"`
+		RootHints         []string      `yaml:"root-hints"`
+		QNameMinimisation *bool         `yaml:"qname-minimisation"`
+		IterativeTimeout  time.Duration `yaml:"iterative-timeout"`
+
+		DNSSECValidation bool     `yaml:"dnssec-validation"`
+		TrustAnchors     []string `yaml:"trust-anchors"`
+		NXDomainCut      *bool    `yaml:"nxdomain-cut"`
+		AggressiveNSEC   *bool    `yaml:"aggressive-nsec"`
+
 		MaxIdleTime time.Duration `yaml:"max-idle-time"`
 		Attempts    int           `yaml:"attempts"`
 		RetryWait   time.Duration `yaml:"retry-wait"`
@@ -44,18 +95,25 @@ type Config struct {
 		CacheNoReplyTime          time.Duration `yaml:"cache-no-reply-time"`
 		CacheStaleEntryKeepPeriod time.Duration `yaml:"cache-stale-entry-keep-period"`
 		CacheReturnStalePeriod    time.Duration `yaml:"cache-return-stale-period"`
+		CacheMaxStalePeriod       time.Duration `yaml:"cache-max-stale-period"`
+		StaleAnswerClientTimeout  time.Duration `yaml:"stale-answer-client-timeout"`
+		CachePersistFile          string        `yaml:"cache-persist-file"`
+		CachePersistInterval      time.Duration `yaml:"cache-persist-interval"`
 
 		OpportunisticCacheMinHits    int           `yaml:"opportunistic-cache-min-hits"`
 		OpportunisticCacheMaxTimeLef time.Duration `yaml:"opportunistic-cache-max-time-left"`
 
 		RecordMinTTL time.Duration `yaml:"record-min-ttl"`
 		RecordMaxTTL time.Duration `yaml:"record-max-ttl"`
+
+		ACL ACLConfig `yaml:"acl"`
 	} `yaml:"resolvers"`
 
 	StaticZones []struct {
 		Zone   string               `yaml:"zone"`
 		Files  []string             `yaml:"files"`
 		DNSSEC *static.DNSSECConfig `yaml:"dnssec"`
+		ACL    ACLConfig            `yaml:"acl"`
 
 		Localizers struct {
 			Rewrites []localizer.LocalizerRewrite `yaml:"rewrites"`
@@ -77,20 +135,31 @@ type Config struct {
 	} `yaml:"ad-lists"`
 }
 
-func LoadConfig(file string) *Config {
+// ACLConfig lists clients as CIDRs, IPs or IP:port
+type ACLConfig struct {
+	Allow              []string `yaml:"allow"`
+	Deny               []string `yaml:"deny"`
+	AllowRecursion     []string `yaml:"allow-recursion"`
+	LocalOnlyRecursion bool     `yaml:"local-only-recursion"`
+}
+
+func LoadConfig(file string) (*Config, error) {
 	config := new(Config)
 
 	fh, err := os.Open(file)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
+	defer func() {
+		_ = fh.Close()
+	}()
 
 	dec := yaml.NewDecoder(fh)
 	dec.KnownFields(true)
 	err = dec.Decode(config)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
-	return config
+	return config, nil
 }
@@ -1,45 +1,165 @@
 package main
 
 import (
+	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
 
+	"github.com/Doridian/foxDNS/dnstap"
 	"github.com/Doridian/foxDNS/handler"
 	"github.com/Doridian/foxDNS/handler/blackhole"
 	"github.com/Doridian/foxDNS/handler/localizer"
 	"github.com/Doridian/foxDNS/handler/resolver"
 	"github.com/Doridian/foxDNS/handler/static"
+	"github.com/Doridian/foxDNS/querylog"
 	"github.com/Doridian/foxDNS/server"
 	"github.com/Doridian/foxDNS/util"
 	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 var loaders = make([]handler.Loadable, 0)
+var loadersLock sync.Mutex
+var resolvers = make(map[string]*resolver.Generator)
+var namedResolvers = make(map[string]*resolver.Generator)
+var dnstapOutput *dnstap.Output
 var configFile string
 var srv *server.Server
 var enableFSNotify = os.Getenv("ENABLE_FSNOTIFY") != ""
 
-func reloadConfig() {
-	for _, gen := range loaders {
-		err := gen.Stop()
+var (
+	configReloads = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "foxdns_config_reloads_total",
+		Help: "The total number of config reloads",
+	}, []string{"result"})
+
+	configLastReloadSuccessful = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "foxdns_config_last_reload_successful",
+		Help: "Whether the last config reload succeeded (1) or failed (0)",
+	})
+
+	configLastReloadSuccessTimestamp = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "foxdns_config_last_reload_success_timestamp_seconds",
+		Help: "Timestamp of the last successful config reload",
+	})
+)
+
+type handlerTree struct {
+	mux       *handler.ViewMux
+	loaders   []handler.Loadable
+	resolvers map[string]*resolver.Generator
+	// Resolvers by their configured name, for the admin API
+	namedResolvers map[string]*resolver.Generator
+	queryLogger    *querylog.Logger
+	// Old resolvers by the new resolver taking over their cache once the tree is swapped in
+	cacheMigrations map[*resolver.Generator]*resolver.Generator
+}
+
+// buildHandlerTree creates all generators for config without starting them.
+// Resolvers matching one in oldResolvers will take over its cache.
+func buildHandlerTree(config *Config, oldResolvers map[string]*resolver.Generator) (*handlerTree, error) {
+	tree := &handlerTree{
+		loaders:   make([]handler.Loadable, 0),
+		resolvers: make(map[string]*resolver.Generator),
+
+		namedResolvers:  make(map[string]*resolver.Generator),
+		cacheMigrations: make(map[*resolver.Generator]*resolver.Generator),
+	}
+
+	if config.Global.QueryLog != nil {
+		var err error
+		tree.queryLogger, err = querylog.New(config.Global.QueryLog)
 		if err != nil {
-			log.Panicf("Error stopping generator: %v", err)
+			return nil, fmt.Errorf("error loading query log configuration: %w", err)
 		}
+		tree.loaders = append(tree.loaders, tree.queryLogger)
+	}
+
+	defaultMux, err := buildView(tree, "", &config.ViewConfig, oldResolvers)
+	if err != nil {
+		return nil, err
 	}
+	tree.mux = handler.NewViewMux(defaultMux)
 
-	config := LoadConfig(configFile)
+	viewNames := make(map[string]bool)
+	for _, viewConf := range config.Views {
+		if viewConf.Name == "" || viewConf.Name == handler.DefaultViewName {
+			return nil, fmt.Errorf("invalid view name: %q", viewConf.Name)
+		}
+		if viewNames[viewConf.Name] {
+			return nil, fmt.Errorf("duplicate view name: %s", viewConf.Name)
+		}
+		viewNames[viewConf.Name] = true
 
-	if config.Global.UDPSize > 0 {
-		util.UDPSize = uint16(config.Global.UDPSize)
+		clients, err := parseAddrMatchers(viewConf.Clients)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing clients of view %s: %w", viewConf.Name, err)
+		}
+		listeners, err := parseAddrMatchers(viewConf.Listeners)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing listeners of view %s: %w", viewConf.Name, err)
+		}
+
+		mux, err := buildView(tree, viewConf.Name, &viewConf.ViewConfig, oldResolvers)
+		if err != nil {
+			return nil, fmt.Errorf("error building view %s: %w", viewConf.Name, err)
+		}
+		tree.mux.AddView(viewConf.Name, clients, listeners, mux)
+
+		log.Printf("View %s enabled for clients %v on listeners %v", viewConf.Name, viewConf.Clients, viewConf.Listeners)
 	}
-	if config.Global.MaxRecursionDepth > 0 {
-		util.MaxRecursionDepth = config.Global.MaxRecursionDepth
+
+	return tree, nil
+}
+
+func parseAddrMatchers(strs []string) ([]*handler.AddrMatcher, error) {
+	matchers := make([]*handler.AddrMatcher, 0, len(strs))
+	for _, str := range strs {
+		matcher, err := handler.ParseAddrMatcher(str)
+		if err != nil {
+			return nil, err
+		}
+		matchers = append(matchers, matcher)
 	}
-	util.RequireCookie = config.Global.RequireCookie
+	return matchers, nil
+}
 
-	loaders = make([]handler.Loadable, 0)
+// buildACL returns nil if conf does not restrict anything
+func buildACL(conf *ACLConfig) (*handler.ACL, error) {
+	if len(conf.Allow) == 0 && len(conf.Deny) == 0 && len(conf.AllowRecursion) == 0 && !conf.LocalOnlyRecursion {
+		return nil, nil
+	}
+
+	var err error
+	acl := &handler.ACL{
+		LocalOnlyRecursion: conf.LocalOnlyRecursion,
+	}
+	acl.Allow, err = parseAddrMatchers(conf.Allow)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing ACL allow: %w", err)
+	}
+	acl.Deny, err = parseAddrMatchers(conf.Deny)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing ACL deny: %w", err)
+	}
+	acl.AllowRecursion, err = parseAddrMatchers(conf.AllowRecursion)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing ACL allow-recursion: %w", err)
+	}
+	return acl, nil
+}
+
+// buildView creates the generators of one view, adding them to tree.
+// viewName is empty for the default view.
+func buildView(tree *handlerTree, viewName string, config *ViewConfig, oldResolvers map[string]*resolver.Generator) (*dns.ServeMux, error) {
 	mux := dns.NewServeMux()
 
 	for _, resolvConf := range config.Resolvers {
@@ -51,14 +171,70 @@ func reloadConfig() {
 				ServerName:         ns.ServerName,
 				RequireCookie:      ns.RequireCookie,
 				MaxParallelQueries: ns.MaxParallelQueries,
+				Pipeline:           ns.Pipeline,
+				MaxConnections:     ns.MaxConnections,
 				Timeout:            ns.Timeout,
 			}
 		}
 
 		resolv := resolver.New(nameServers)
-		loaders = append(loaders, resolv)
 
 		resolv.LogFailures = resolvConf.LogFailures
+		resolv.QNameCaseRandomisation = resolvConf.QNameCaseRandomisation
+
+		resolv.ClientSubnet = resolvConf.ClientSubnet.Enabled
+		resolv.ClientSubnetStripClient = resolvConf.ClientSubnet.StripClient
+		if resolvConf.ClientSubnet.IPv4Prefix > 0 {
+			resolv.ClientSubnetPrefixV4 = resolvConf.ClientSubnet.IPv4Prefix
+		}
+		if resolvConf.ClientSubnet.IPv6Prefix > 0 {
+			resolv.ClientSubnetPrefixV6 = resolvConf.ClientSubnet.IPv6Prefix
+		}
+		if resolvConf.ClientSubnet.Override != "" {
+			_, override, err := net.ParseCIDR(resolvConf.ClientSubnet.Override)
+			if err != nil {
+				return nil, fmt.Errorf("error parsing client subnet override: %w", err)
+			}
+			resolv.ClientSubnetOverride = override
+		}
+		resolv.Iterative = resolvConf.Iterative
+
+		if len(resolvConf.RootHints) > 0 {
+			resolv.RootHints = resolvConf.RootHints
+		}
+
+		if resolvConf.QNameMinimisation != nil {
+			resolv.QNameMinimisation = *resolvConf.QNameMinimisation
+		}
+
+		if resolvConf.IterativeTimeout > 0 {
+			resolv.IterativeTimeout = resolvConf.IterativeTimeout
+		}
+
+		resolv.DNSSECValidation = resolvConf.DNSSECValidation
+
+		if len(resolvConf.TrustAnchors) > 0 {
+			err := resolv.SetTrustAnchors(resolvConf.TrustAnchors)
+			if err != nil {
+				return nil, fmt.Errorf("error parsing trust anchors: %w", err)
+			}
+		}
+
+		if resolvConf.NXDomainCut != nil {
+			resolv.NXDomainCut = *resolvConf.NXDomainCut
+		}
+
+		if resolvConf.AggressiveNSEC != nil {
+			resolv.AggressiveNSEC = *resolvConf.AggressiveNSEC
+		}
+
+		if resolvConf.RaceCount > 0 {
+			resolv.RaceCount = resolvConf.RaceCount
+		}
+
+		if resolvConf.HedgeDelay > 0 {
+			resolv.HedgeDelay = resolvConf.HedgeDelay
+		}
 
 		if resolvConf.MaxIdleTime > 0 {
 			resolv.MaxIdleTime = resolvConf.MaxIdleTime
@@ -96,6 +272,17 @@ func reloadConfig() {
 			resolv.CacheReturnStalePeriod = resolvConf.CacheReturnStalePeriod
 		}
 
+		if resolvConf.CacheMaxStalePeriod > 0 {
+			resolv.CacheMaxStalePeriod = resolvConf.CacheMaxStalePeriod
+		}
+
+		if resolvConf.StaleAnswerClientTimeout > 0 {
+			resolv.StaleAnswerClientTimeout = resolvConf.StaleAnswerClientTimeout
+		}
+
+		resolv.CachePersistFile = resolvConf.CachePersistFile
+		resolv.CachePersistInterval = resolvConf.CachePersistInterval
+
 		if resolvConf.RecordMinTTL > 0 {
 			resolv.RecordMinTTL = uint32(resolvConf.RecordMinTTL.Seconds())
 		}
@@ -120,13 +307,41 @@ func reloadConfig() {
 				resolv.ServerStrategy = resolver.StrategyRandom
 			case "failover":
 				resolv.ServerStrategy = resolver.StrategyFailover
+			case "fastest":
+				resolv.ServerStrategy = resolver.StrategyFastest
 			default:
-				log.Panicf("Unknown nameserver strategy: %s", resolvConf.NameServerStrategy)
+				return nil, fmt.Errorf("unknown nameserver strategy: %s", resolvConf.NameServerStrategy)
 			}
 		}
 
-		loaders = append(loaders, resolv)
+		// Resolvers serving the same zones from the same upstreams keep their cache across reloads
+		zones := slices.Clone(resolvConf.Zones)
+		slices.Sort(zones)
+		resolverKey := fmt.Sprintf("%s|%s|%s", viewName, strings.Join(zones, ","), resolv.CacheIdentity())
+		if oldResolv := oldResolvers[resolverKey]; oldResolv != nil {
+			tree.cacheMigrations[resolv] = oldResolv
+		}
+		tree.resolvers[resolverKey] = resolv
+
+		resolverName := resolvConf.Name
+		if resolverName == "" {
+			resolverName = strings.Join(resolvConf.Zones, ",")
+		}
+		if viewName != "" {
+			resolverName = viewName + ":" + resolverName
+		}
+		if tree.namedResolvers[resolverName] != nil {
+			return nil, fmt.Errorf("duplicate resolver name: %s", resolverName)
+		}
+		tree.namedResolvers[resolverName] = resolv
+
+		tree.loaders = append(tree.loaders, resolv)
 		hdl := handler.New(resolv, false)
+		var err error
+		hdl.ACL, err = buildACL(&resolvConf.ACL)
+		if err != nil {
+			return nil, fmt.Errorf("error in resolver %s: %w", resolverName, err)
+		}
 		for _, zone := range resolvConf.Zones {
 			mux.Handle(zone, hdl)
 		}
@@ -136,12 +351,15 @@ func reloadConfig() {
 
 	if len(config.StaticZones) > 0 {
 		for _, statConf := range config.StaticZones {
-			stat := static.New(enableFSNotify, mux, statConf.DNSSEC)
+			stat, err := static.New(enableFSNotify, mux, statConf.DNSSEC)
+			if err != nil {
+				return nil, fmt.Errorf("error loading DNSSEC keys for static zone %s: %w", statConf.Zone, err)
+			}
 
 			for _, file := range statConf.Files {
 				err := stat.LoadZoneFile(file, statConf.Zone, 3600, false)
 				if err != nil {
-					log.Panicf("Error loading static zone file %s: %v", file, err)
+					return nil, fmt.Errorf("error loading static zone file %s: %w", file, err)
 				}
 			}
 
@@ -159,7 +377,7 @@ func reloadConfig() {
 					}
 					err := loc.AddRewrites(rewrites)
 					if err != nil {
-						log.Panicf("Error adding localizer rewrites: %v", err)
+						return nil, fmt.Errorf("error adding localizer rewrites: %w", err)
 					}
 
 					v4v6s := statConf.Localizers.V4V6s
@@ -168,15 +386,15 @@ func reloadConfig() {
 					}
 					err = loc.AddV4V6s(v4v6s)
 					if err != nil {
-						log.Panicf("Error adding localizer v4v6s: %v", err)
+						return nil, fmt.Errorf("error adding localizer v4v6s: %w", err)
 					}
 
-					loaders = append(loaders, loc)
+					tree.loaders = append(tree.loaders, loc)
 
 					for _, ip := range locConfig.Subnets {
 						err := loc.AddRecord(locConfig.Host, ip)
 						if err != nil {
-							log.Panicf("Error adding localizer record %s -> %s: %v", locConfig.Host, ip, err)
+							return nil, fmt.Errorf("error adding localizer record %s -> %s: %w", locConfig.Host, ip, err)
 						}
 					}
 
@@ -186,8 +404,13 @@ func reloadConfig() {
 				log.Printf("Localizer enabled for %d hosts in %s zone", len(statConf.Localizers.Hosts), statConf.Zone)
 			}
 
-			loaders = append(loaders, stat)
-			mux.Handle(statConf.Zone, handler.New(stat, true))
+			tree.loaders = append(tree.loaders, stat)
+			hdl := handler.New(stat, true)
+			hdl.ACL, err = buildACL(&statConf.ACL)
+			if err != nil {
+				return nil, fmt.Errorf("error in static zone %s: %w", statConf.Zone, err)
+			}
+			mux.Handle(statConf.Zone, hdl)
 		}
 
 		log.Printf("Static zones enabled for %d zones", len(config.StaticZones))
@@ -195,17 +418,146 @@ func reloadConfig() {
 
 	if len(config.AdLists.BlockLists) > 0 {
 		adlistGen := blackhole.NewAdlist(config.AdLists.BlockLists, config.AdLists.AllowLists, mux, config.AdLists.RefreshInterval)
-		loaders = append(loaders, adlistGen)
+		tree.loaders = append(tree.loaders, adlistGen)
+	}
+
+	return mux, nil
+}
+
+func stopLoaders(toStop []handler.Loadable) {
+	for _, gen := range toStop {
+		err := gen.Stop()
+		if err != nil {
+			log.Printf("Error stopping generator: %v", err)
+		}
 	}
+}
+
+// stopAll stops the active loaders and dnstap output once the server shut down,
+// giving them a chance to persist their state and flush buffered frames
+func stopAll() {
+	loadersLock.Lock()
+	defer loadersLock.Unlock()
+
+	stopLoaders(loaders)
+	loaders = make([]handler.Loadable, 0)
+
+	if dnstapOutput != nil {
+		dnstap.SetOutput(nil)
+		dnstapOutput.Stop()
+		dnstapOutput = nil
+	}
+}
+
+// reloadConfig builds and starts a complete new handler tree before swapping it in.
+// If anything fails, the previous tree keeps serving.
+func reloadConfig() error {
+	err := doReloadConfig()
+	configReloads.WithLabelValues(reloadResult(err)).Inc()
+	if err != nil {
+		configLastReloadSuccessful.Set(0)
+		return err
+	}
+	configLastReloadSuccessful.Set(1)
+	configLastReloadSuccessTimestamp.SetToCurrentTime()
+	return nil
+}
 
-	srv.SetHandler(mux)
+func reloadResult(err error) string {
+	if err != nil {
+		return "error"
+	}
+	return "success"
+}
+
+func doReloadConfig() error {
+	config, err := LoadConfig(configFile)
+	if err != nil {
+		return fmt.Errorf("error loading config: %w", err)
+	}
 
-	for _, gen := range loaders {
+	loadersLock.Lock()
+	defer loadersLock.Unlock()
+
+	tree, err := buildHandlerTree(config, resolvers)
+	if err != nil {
+		return err
+	}
+
+	for i, gen := range tree.loaders {
 		err := gen.Start()
 		if err != nil {
-			log.Panicf("Error starting generator: %v", err)
+			stopLoaders(tree.loaders[:i+1])
+			return fmt.Errorf("error starting generator: %w", err)
 		}
 	}
+
+	tlsConfig, err := server.LoadTLSConfig(config.Global.TLS)
+	if err != nil {
+		stopLoaders(tree.loaders)
+		return fmt.Errorf("error loading TLS configuration: %w", err)
+	}
+
+	rateLimiter, err := server.NewRateLimiter(config.Global.RateLimit)
+	if err != nil {
+		stopLoaders(tree.loaders)
+		return fmt.Errorf("error loading rate limit configuration: %w", err)
+	}
+
+	rrl, err := handler.NewResponseRateLimiter(config.Global.RRL)
+	if err != nil {
+		stopLoaders(tree.loaders)
+		return fmt.Errorf("error loading RRL configuration: %w", err)
+	}
+
+	// Outputs are only replaced if their config changed, to not cut a running stream
+	newDnstapOutput := dnstapOutput
+	if config.Global.Dnstap == nil {
+		newDnstapOutput = nil
+	} else if dnstapOutput == nil || !reflect.DeepEqual(dnstapOutput.Config(), config.Global.Dnstap) {
+		newDnstapOutput, err = dnstap.NewOutput(config.Global.Dnstap)
+		if err != nil {
+			stopLoaders(tree.loaders)
+			return fmt.Errorf("error loading dnstap configuration: %w", err)
+		}
+		newDnstapOutput.Start()
+	}
+
+	if config.Global.UDPSize > 0 {
+		util.UDPSize = uint16(config.Global.UDPSize)
+	}
+	if config.Global.MaxRecursionDepth > 0 {
+		util.MaxRecursionDepth = config.Global.MaxRecursionDepth
+	}
+	util.RequireCookie = config.Global.RequireCookie
+
+	// Only now, so the old resolvers cached everything they resolved until they are replaced
+	for resolv, oldResolv := range tree.cacheMigrations {
+		resolv.TakeCacheFrom(oldResolv)
+	}
+	if len(tree.cacheMigrations) > 0 {
+		log.Printf("Migrated cache of %d resolvers", len(tree.cacheMigrations))
+	}
+
+	srv.ApplyTLSConfig(tlsConfig)
+	srv.SetRateLimiter(rateLimiter)
+	srv.SetHandler(tree.mux)
+	handler.SetResponseRateLimiter(rrl)
+	querylog.SetLogger(tree.queryLogger)
+
+	dnstap.SetOutput(newDnstapOutput)
+	if dnstapOutput != nil && dnstapOutput != newDnstapOutput {
+		go dnstapOutput.Stop()
+	}
+	dnstapOutput = newDnstapOutput
+
+	oldLoaders := loaders
+	loaders = tree.loaders
+	resolvers = tree.resolvers
+	namedResolvers = tree.namedResolvers
+	stopLoaders(oldLoaders)
+
+	return nil
 }
 
 func main() {
@@ -216,7 +568,10 @@ func main() {
 
 	log.Printf("foxDNS version %s", util.Version)
 
-	config := LoadConfig(configFile)
+	config, err := LoadConfig(configFile)
+	if err != nil {
+		log.Panicf("Error loading config: %v", err)
+	}
 
 	if config.Global.PrometheusListen != "" {
 		http.Handle("/metrics", promhttp.Handler())
@@ -228,8 +583,31 @@ func main() {
 		}()
 	}
 
+	if config.Global.AdminListen != "" {
+		if config.Global.AdminToken == "" {
+			log.Panicf("admin-token is required to enable the admin API")
+		}
+		go func() {
+			err := http.ListenAndServe(config.Global.AdminListen, newAdminHandler(config.Global.AdminToken))
+			if err != nil {
+				log.Panicf("Error starting admin listener: %v", err)
+			}
+		}()
+	}
+
 	srv = server.NewServer(config.Global.Listen, true)
-	reloadConfig()
+	srv.SetDoHConfig(config.Global.DoH)
+	inherited, err := server.SystemdListeners()
+	if err != nil {
+		log.Panicf("Error using socket activation: %v", err)
+	}
+	srv.SetInheritedListeners(inherited)
+	err = reloadConfig()
+	if err != nil {
+		log.Panicf("Error applying config: %v", err)
+	}
 	handleSignals(srv)
 	srv.Serve()
+	stopAll()
+	log.Printf("Shutdown complete")
 }
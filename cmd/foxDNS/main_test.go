@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Doridian/foxDNS/dnstap"
+	"github.com/Doridian/foxDNS/handler/resolver"
+	"github.com/Doridian/foxDNS/server"
+	"github.com/Doridian/foxDNS/util"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testZoneFile = `example.com. 3600 IN SOA ns.example.com. hostmaster.example.com. 1 3600 600 86400 60
+www.example.com. 300 IN A 192.0.2.1
+`
+
+// setupReloadTest points the global config at a static zone and returns the config path
+func setupReloadTest(t *testing.T) string {
+	dir := t.TempDir()
+	zonePath := filepath.Join(dir, "example.com.zone")
+	require.NoError(t, os.WriteFile(zonePath, []byte(testZoneFile), 0600))
+
+	configFile = filepath.Join(dir, "config.yml")
+	writeTestConfig(t, `
+static-zones:
+  - zone: example.com.
+    files:
+      - `+zonePath+`
+`)
+
+	srv = server.NewServer(nil, false)
+	t.Cleanup(func() {
+		stopAll()
+		resolvers = make(map[string]*resolver.Generator)
+		namedResolvers = make(map[string]*resolver.Generator)
+		srv = nil
+	})
+	return zonePath
+}
+
+func writeTestConfig(t *testing.T, config string) {
+	require.NoError(t, os.WriteFile(configFile, []byte(config), 0600))
+}
+
+func TestReloadStaticZone(t *testing.T) {
+	zonePath := setupReloadTest(t)
+
+	require.NoError(t, reloadConfig())
+	firstLoaders := loaders
+	require.NoError(t, reloadConfig())
+	assert.Len(t, loaders, 1)
+	assert.NotSame(t, firstLoaders[0], loaders[0])
+
+	// A missing certificate fails after the new loaders started, which must be stopped again
+	writeTestConfig(t, `
+global:
+  tls:
+    cert: /nonexistent/cert.pem
+    key: /nonexistent/key.pem
+static-zones:
+  - zone: example.com.
+    files:
+      - `+zonePath+`
+`)
+	secondLoaders := loaders
+	require.Error(t, reloadConfig())
+	assert.Equal(t, secondLoaders, loaders)
+}
+
+func TestStopAllPersistsResolverCache(t *testing.T) {
+	setupReloadTest(t)
+	persistFile := filepath.Join(t.TempDir(), "cache.gob")
+	writeTestConfig(t, `
+resolvers:
+  - zones: [.]
+    nameservers:
+      - addr: 127.0.0.1:1
+    cache-persist-file: `+persistFile+`
+`)
+
+	require.NoError(t, reloadConfig())
+	assert.NoFileExists(t, persistFile)
+
+	stopAll()
+	assert.FileExists(t, persistFile)
+	assert.Empty(t, loaders)
+}
+
+func TestStopAllFlushesDnstap(t *testing.T) {
+	setupReloadTest(t)
+	dnstapFile := filepath.Join(t.TempDir(), "dnstap.fstrm")
+	writeTestConfig(t, `
+global:
+  dnstap:
+    file: `+dnstapFile+`
+`)
+
+	require.NoError(t, reloadConfig())
+	assert.True(t, dnstap.ClientEnabled())
+	dnstap.Log(&dnstap.Message{
+		Type:         dnstap.MessageClientQuery,
+		Protocol:     dnstap.ProtocolUDP,
+		QueryTime:    time.Now(),
+		QueryMessage: []byte("query"),
+	})
+
+	stopAll()
+	assert.False(t, dnstap.ClientEnabled())
+	assert.Nil(t, dnstapOutput)
+
+	// The stream was finished with a stop control frame
+	data, err := os.ReadFile(dnstapFile)
+	require.NoError(t, err)
+	assert.Contains(t, string(data), "query")
+	assert.True(t, bytes.HasSuffix(data, []byte{0, 0, 0, 0, 0, 0, 0, 4, 0, 0, 0, 3}))
+}
+
+func TestReloadMigratesResolverCache(t *testing.T) {
+	setupReloadTest(t)
+
+	packetConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	upstream := &dns.Server{
+		PacketConn: packetConn,
+		Handler: dns.HandlerFunc(func(wr dns.ResponseWriter, msg *dns.Msg) {
+			reply := &dns.Msg{}
+			reply.SetReply(msg)
+			reply.Answer = []dns.RR{util.FillHeader(&dns.A{A: net.IPv4(192, 0, 2, 1)}, msg.Question[0].Name, dns.TypeA, 300)}
+			_ = wr.WriteMsg(reply)
+		}),
+	}
+	go func() {
+		_ = upstream.ActivateAndServe()
+	}()
+	defer func() {
+		_ = upstream.Shutdown()
+	}()
+
+	resolverConfig := `
+resolvers:
+  - name: upstream
+    zones: [.]
+    nameservers:
+      - addr: ` + packetConn.LocalAddr().String() + `
+`
+	writeTestConfig(t, resolverConfig)
+	require.NoError(t, reloadConfig())
+
+	_, _, _, _, rcode, _, _ := namedResolvers["upstream"].HandleQuestion([]dns.Question{{
+		Name:   "example.com.",
+		Qtype:  dns.TypeA,
+		Qclass: dns.ClassINET,
+	}}, true, false, false, nil)
+	require.Equal(t, dns.RcodeSuccess, rcode)
+	oldResolver := namedResolvers["upstream"]
+	require.Equal(t, 1, oldResolver.CacheLen())
+
+	// Failed reloads leave the cache with the resolver that keeps serving
+	writeTestConfig(t, `
+global:
+  tls:
+    cert: /nonexistent/cert.pem
+    key: /nonexistent/key.pem
+`+resolverConfig)
+	require.Error(t, reloadConfig())
+	assert.Same(t, oldResolver, namedResolvers["upstream"])
+
+	writeTestConfig(t, resolverConfig)
+	require.NoError(t, reloadConfig())
+	assert.NotSame(t, oldResolver, namedResolvers["upstream"])
+	assert.Equal(t, 1, namedResolvers["upstream"].CacheLen())
+}
@@ -29,6 +29,9 @@ func handleReload() {
 	for {
 		<-sigs
 		log.Printf("Got reload signal, reloading...")
-		reloadConfig()
+		err := reloadConfig()
+		if err != nil {
+			log.Printf("Error reloading config, keeping previous config: %v", err)
+		}
 	}
 }
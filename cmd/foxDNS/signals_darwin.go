@@ -13,11 +13,13 @@ func handleRefresh() {
 	for {
 		<-sigs
 		log.Printf("Got refreshing signal, refreshing...")
+		loadersLock.Lock()
 		for _, l := range loaders {
 			err := l.Refresh()
 			if err != nil {
 				log.Printf("Error refreshing loader: %v", err)
 			}
 		}
+		loadersLock.Unlock()
 	}
 }
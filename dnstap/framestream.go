@@ -0,0 +1,142 @@
+package dnstap
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Frame Streams, see https://farsightsec.github.io/fstrm/
+const (
+	contentType = "protobuf:dnstap.Dnstap"
+
+	controlAccept = 0x01
+	controlStart  = 0x02
+	controlStop   = 0x03
+	controlReady  = 0x04
+	controlFinish = 0x05
+
+	controlFieldContentType = 0x01
+
+	maxControlFrameLength = 512
+)
+
+var ErrUnexpectedControlFrame = errors.New("unexpected frame streams control frame")
+
+func writeControlFrame(w io.Writer, controlType uint32) error {
+	var frame []byte
+	frame = binary.BigEndian.AppendUint32(frame, 0)
+	frame = binary.BigEndian.AppendUint32(frame, 0)
+	frame = binary.BigEndian.AppendUint32(frame, controlType)
+	if controlType != controlStop && controlType != controlFinish {
+		frame = binary.BigEndian.AppendUint32(frame, controlFieldContentType)
+		frame = binary.BigEndian.AppendUint32(frame, uint32(len(contentType)))
+		frame = append(frame, contentType...)
+	}
+	binary.BigEndian.PutUint32(frame[4:], uint32(len(frame)-8))
+
+	_, err := w.Write(frame)
+	return err
+}
+
+func readControlFrame(r io.Reader) (uint32, error) {
+	var header [12]byte
+	_, err := io.ReadFull(r, header[:])
+	if err != nil {
+		return 0, err
+	}
+	if binary.BigEndian.Uint32(header[0:]) != 0 {
+		return 0, ErrUnexpectedControlFrame
+	}
+
+	length := binary.BigEndian.Uint32(header[4:])
+	if length < 4 || length > maxControlFrameLength {
+		return 0, fmt.Errorf("invalid frame streams control frame length %d", length)
+	}
+	// Content types are not checked, a collector accepting us at all takes dnstap
+	_, err = io.CopyN(io.Discard, r, int64(length-4))
+	if err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint32(header[8:]), nil
+}
+
+func expectControlFrame(r io.Reader, controlType uint32) error {
+	actualType, err := readControlFrame(r)
+	if err != nil {
+		return err
+	}
+	if actualType != controlType {
+		return ErrUnexpectedControlFrame
+	}
+	return nil
+}
+
+// frameWriter writes a Frame Streams data stream.
+// Bidirectional streams (sockets) do the READY/ACCEPT and STOP/FINISH handshakes, files don't.
+type frameWriter struct {
+	conn          io.ReadWriteCloser
+	buf           *bufio.Writer
+	bidirectional bool
+}
+
+func newFrameWriter(conn io.ReadWriteCloser, bidirectional bool) (*frameWriter, error) {
+	w := &frameWriter{
+		conn:          conn,
+		buf:           bufio.NewWriter(conn),
+		bidirectional: bidirectional,
+	}
+
+	if bidirectional {
+		err := writeControlFrame(conn, controlReady)
+		if err != nil {
+			return nil, err
+		}
+		err = expectControlFrame(conn, controlAccept)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err := writeControlFrame(w.buf, controlStart)
+	if err != nil {
+		return nil, err
+	}
+	return w, w.buf.Flush()
+}
+
+func (w *frameWriter) writeFrame(data []byte) error {
+	err := binary.Write(w.buf, binary.BigEndian, uint32(len(data)))
+	if err != nil {
+		return err
+	}
+	_, err = w.buf.Write(data)
+	return err
+}
+
+func (w *frameWriter) flush() error {
+	return w.buf.Flush()
+}
+
+// close ends the stream cleanly, the underlying connection is closed in any case
+func (w *frameWriter) close() error {
+	defer func() {
+		_ = w.conn.Close()
+	}()
+
+	err := writeControlFrame(w.buf, controlStop)
+	if err != nil {
+		return err
+	}
+	err = w.buf.Flush()
+	if err != nil {
+		return err
+	}
+
+	if w.bidirectional {
+		return expectControlFrame(w.conn, controlFinish)
+	}
+	return nil
+}
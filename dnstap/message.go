@@ -0,0 +1,179 @@
+package dnstap
+
+import (
+	"net"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// MessageType is dnstap.Message.Type from dnstap.proto
+type MessageType uint64
+
+const (
+	MessageAuthQuery         MessageType = 1
+	MessageAuthResponse      MessageType = 2
+	MessageResolverQuery     MessageType = 3
+	MessageResolverResponse  MessageType = 4
+	MessageClientQuery       MessageType = 5
+	MessageClientResponse    MessageType = 6
+	MessageForwarderQuery    MessageType = 7
+	MessageForwarderResponse MessageType = 8
+)
+
+// SocketProtocol is dnstap.SocketProtocol from dnstap.proto
+type SocketProtocol uint64
+
+const (
+	ProtocolUDP SocketProtocol = 1
+	ProtocolTCP SocketProtocol = 2
+	ProtocolDoT SocketProtocol = 3
+	ProtocolDoH SocketProtocol = 4
+)
+
+const (
+	socketFamilyINET  = 1
+	socketFamilyINET6 = 2
+
+	dnstapTypeMessage = 1
+)
+
+// Field numbers from dnstap.proto
+const (
+	fieldDnstapIdentity = 1
+	fieldDnstapVersion  = 2
+	fieldDnstapMessage  = 14
+	fieldDnstapType     = 15
+
+	fieldMessageType             = 1
+	fieldMessageSocketFamily     = 2
+	fieldMessageSocketProtocol   = 3
+	fieldMessageQueryAddress     = 4
+	fieldMessageResponseAddress  = 5
+	fieldMessageQueryPort        = 6
+	fieldMessageResponsePort     = 7
+	fieldMessageQueryTimeSec     = 8
+	fieldMessageQueryTimeNsec    = 9
+	fieldMessageQueryMessage     = 10
+	fieldMessageResponseTimeSec  = 12
+	fieldMessageResponseTimeNsec = 13
+	fieldMessageResponseMessage  = 14
+)
+
+// Message is a single dnstap event, queries leave the response fields empty and vice versa
+type Message struct {
+	Type     MessageType
+	Protocol SocketProtocol
+
+	// The address the query was sent from and the address it was sent to
+	QueryAddr    net.Addr
+	ResponseAddr net.Addr
+
+	QueryTime    time.Time
+	QueryMessage []byte
+
+	ResponseTime    time.Time
+	ResponseMessage []byte
+}
+
+func splitAddr(addr net.Addr) (net.IP, int) {
+	switch convAddr := addr.(type) {
+	case *net.UDPAddr:
+		return convAddr.IP, convAddr.Port
+	case *net.TCPAddr:
+		return convAddr.IP, convAddr.Port
+	case *net.IPAddr:
+		return convAddr.IP, 0
+	default:
+		return nil, 0
+	}
+}
+
+func appendTime(b []byte, secField protowire.Number, nsecField protowire.Number, t time.Time) []byte {
+	if t.IsZero() {
+		return b
+	}
+	b = protowire.AppendTag(b, secField, protowire.VarintType)
+	b = protowire.AppendVarint(b, uint64(t.Unix()))
+	b = protowire.AppendTag(b, nsecField, protowire.Fixed32Type)
+	return protowire.AppendFixed32(b, uint32(t.Nanosecond()))
+}
+
+func appendAddr(b []byte, addrField protowire.Number, portField protowire.Number, ip net.IP, port int) []byte {
+	if ip == nil {
+		return b
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	b = protowire.AppendTag(b, addrField, protowire.BytesType)
+	b = protowire.AppendBytes(b, ip)
+	if port > 0 {
+		b = protowire.AppendTag(b, portField, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(port))
+	}
+	return b
+}
+
+func (m *Message) marshal() []byte {
+	b := make([]byte, 0, 64+len(m.QueryMessage)+len(m.ResponseMessage))
+
+	b = protowire.AppendTag(b, fieldMessageType, protowire.VarintType)
+	b = protowire.AppendVarint(b, uint64(m.Type))
+
+	queryIP, queryPort := splitAddr(m.QueryAddr)
+	responseIP, responsePort := splitAddr(m.ResponseAddr)
+	familyIP := queryIP
+	if familyIP == nil {
+		familyIP = responseIP
+	}
+	if familyIP != nil {
+		family := uint64(socketFamilyINET6)
+		if familyIP.To4() != nil {
+			family = socketFamilyINET
+		}
+		b = protowire.AppendTag(b, fieldMessageSocketFamily, protowire.VarintType)
+		b = protowire.AppendVarint(b, family)
+	}
+
+	if m.Protocol != 0 {
+		b = protowire.AppendTag(b, fieldMessageSocketProtocol, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(m.Protocol))
+	}
+
+	b = appendAddr(b, fieldMessageQueryAddress, fieldMessageQueryPort, queryIP, queryPort)
+	b = appendAddr(b, fieldMessageResponseAddress, fieldMessageResponsePort, responseIP, responsePort)
+
+	b = appendTime(b, fieldMessageQueryTimeSec, fieldMessageQueryTimeNsec, m.QueryTime)
+	if m.QueryMessage != nil {
+		b = protowire.AppendTag(b, fieldMessageQueryMessage, protowire.BytesType)
+		b = protowire.AppendBytes(b, m.QueryMessage)
+	}
+
+	b = appendTime(b, fieldMessageResponseTimeSec, fieldMessageResponseTimeNsec, m.ResponseTime)
+	if m.ResponseMessage != nil {
+		b = protowire.AppendTag(b, fieldMessageResponseMessage, protowire.BytesType)
+		b = protowire.AppendBytes(b, m.ResponseMessage)
+	}
+
+	return b
+}
+
+// marshalFrame wraps m into a dnstap.Dnstap protobuf
+func marshalFrame(identity []byte, version []byte, m *Message) []byte {
+	msg := m.marshal()
+	b := make([]byte, 0, 16+len(identity)+len(version)+len(msg))
+
+	if len(identity) > 0 {
+		b = protowire.AppendTag(b, fieldDnstapIdentity, protowire.BytesType)
+		b = protowire.AppendBytes(b, identity)
+	}
+	if len(version) > 0 {
+		b = protowire.AppendTag(b, fieldDnstapVersion, protowire.BytesType)
+		b = protowire.AppendBytes(b, version)
+	}
+	b = protowire.AppendTag(b, fieldDnstapMessage, protowire.BytesType)
+	b = protowire.AppendBytes(b, msg)
+	b = protowire.AppendTag(b, fieldDnstapType, protowire.VarintType)
+	return protowire.AppendVarint(b, dnstapTypeMessage)
+}
@@ -0,0 +1,251 @@
+package dnstap
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Doridian/foxDNS/util"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	framesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "foxdns_dnstap_frames_total",
+		Help: "The total number of dnstap frames, by whether they were sent or dropped",
+	}, []string{"result"})
+)
+
+const (
+	defaultBufferSize = 10000
+	reconnectDelay    = 5 * time.Second
+	writeTimeout      = 5 * time.Second
+)
+
+var ErrNoOutput = errors.New("dnstap needs exactly one of unix, tcp or file")
+
+type Config struct {
+	Unix string `yaml:"unix"`
+	TCP  string `yaml:"tcp"`
+	File string `yaml:"file"`
+
+	// Sent as the dnstap identity, defaults to the hostname
+	Identity string `yaml:"identity"`
+	// Frames to buffer while the collector is slow or unreachable, further frames are dropped
+	BufferSize int `yaml:"buffer-size"`
+
+	// Which messages to log, both default to true
+	Client   *bool `yaml:"client"`
+	Upstream *bool `yaml:"upstream"`
+}
+
+// Output sends dnstap frames to a collector without ever blocking the caller
+type Output struct {
+	config   Config
+	identity []byte
+	version  []byte
+	client   bool
+	upstream bool
+
+	frames   chan []byte
+	stop     chan struct{}
+	done     chan struct{}
+	stopOnce sync.Once
+	// Whether the file output was opened before, only accessed by run
+	reopened bool
+}
+
+var activeOutput atomic.Pointer[Output]
+
+func NewOutput(config *Config) (*Output, error) {
+	outputs := 0
+	for _, target := range []string{config.Unix, config.TCP, config.File} {
+		if target != "" {
+			outputs++
+		}
+	}
+	if outputs != 1 {
+		return nil, ErrNoOutput
+	}
+
+	identity := config.Identity
+	if identity == "" {
+		identity, _ = os.Hostname()
+	}
+
+	bufferSize := config.BufferSize
+	if bufferSize <= 0 {
+		bufferSize = defaultBufferSize
+	}
+
+	return &Output{
+		config:   *config,
+		identity: []byte(identity),
+		version:  []byte("foxDNS " + util.Version),
+		client:   config.Client == nil || *config.Client,
+		upstream: config.Upstream == nil || *config.Upstream,
+		frames:   make(chan []byte, bufferSize),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}, nil
+}
+
+// Config returns the configuration the output was created with
+func (o *Output) Config() *Config {
+	return &o.config
+}
+
+func (o *Output) Start() {
+	go o.run()
+}
+
+// Stop flushes buffered frames as long as the collector keeps up and closes the stream
+func (o *Output) Stop() {
+	o.stopOnce.Do(func() {
+		close(o.stop)
+	})
+	<-o.done
+}
+
+// SetOutput makes o receive all dnstap messages, nil disables dnstap.
+// Returns the previous output, which is not stopped.
+func SetOutput(o *Output) *Output {
+	return activeOutput.Swap(o)
+}
+
+// ClientEnabled checks whether client queries and responses are logged, to skip packing messages otherwise
+func ClientEnabled() bool {
+	o := activeOutput.Load()
+	return o != nil && o.client
+}
+
+// UpstreamEnabled checks whether upstream queries and responses are logged
+func UpstreamEnabled() bool {
+	o := activeOutput.Load()
+	return o != nil && o.upstream
+}
+
+// Log queues m for sending, or drops it if the buffer is full
+func Log(m *Message) {
+	o := activeOutput.Load()
+	if o == nil {
+		return
+	}
+
+	select {
+	case o.frames <- marshalFrame(o.identity, o.version, m):
+	default:
+		framesTotal.WithLabelValues("dropped").Inc()
+	}
+}
+
+func (o *Output) open() (*frameWriter, error) {
+	if o.config.File != "" {
+		// Reopening after a write error must not wipe what was written before
+		flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+		if o.reopened {
+			flags = os.O_WRONLY | os.O_CREATE | os.O_APPEND
+		}
+		fh, err := os.OpenFile(o.config.File, flags, 0o640)
+		if err != nil {
+			return nil, err
+		}
+		o.reopened = true
+		return newFrameWriter(fh, false)
+	}
+
+	network, addr := "unix", o.config.Unix
+	if o.config.TCP != "" {
+		network, addr = "tcp", o.config.TCP
+	}
+	conn, err := net.DialTimeout(network, addr, writeTimeout)
+	if err != nil {
+		return nil, err
+	}
+	_ = conn.SetDeadline(time.Now().Add(writeTimeout))
+	fw, err := newFrameWriter(conn, true)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return fw, nil
+}
+
+func (o *Output) run() {
+	defer close(o.done)
+
+	for {
+		fw, err := o.open()
+		if err == nil {
+			err = o.writeFrames(fw)
+			if err == nil {
+				return
+			}
+			_ = fw.conn.Close()
+		}
+		log.Printf("Error writing dnstap output: %v", err)
+
+		select {
+		case <-o.stop:
+			return
+		case <-time.After(reconnectDelay):
+		}
+	}
+}
+
+func (o *Output) setDeadline(fw *frameWriter) {
+	if conn, ok := fw.conn.(net.Conn); ok {
+		_ = conn.SetDeadline(time.Now().Add(writeTimeout))
+	}
+}
+
+// writeFrames returns nil once stopped
+func (o *Output) writeFrames(fw *frameWriter) error {
+	for {
+		select {
+		case frame := <-o.frames:
+			o.setDeadline(fw)
+			err := fw.writeFrame(frame)
+			if err != nil {
+				return err
+			}
+			framesTotal.WithLabelValues("sent").Inc()
+
+			if len(o.frames) == 0 {
+				err = fw.flush()
+				if err != nil {
+					return err
+				}
+			}
+		case <-o.stop:
+			return o.drain(fw)
+		}
+	}
+}
+
+func (o *Output) drain(fw *frameWriter) error {
+	o.setDeadline(fw)
+	for {
+		select {
+		case frame := <-o.frames:
+			err := fw.writeFrame(frame)
+			if err != nil {
+				_ = fw.conn.Close()
+				return nil
+			}
+			framesTotal.WithLabelValues("sent").Inc()
+		default:
+			err := fw.close()
+			if err != nil && !errors.Is(err, io.EOF) {
+				log.Printf("Error closing dnstap output: %v", err)
+			}
+			return nil
+		}
+	}
+}
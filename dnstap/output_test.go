@@ -0,0 +1,192 @@
+package dnstap_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Doridian/foxDNS/dnstap"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+const (
+	controlAccept = 0x01
+	controlStart  = 0x02
+	controlStop   = 0x03
+	controlReady  = 0x04
+	controlFinish = 0x05
+)
+
+// readFrame returns the control type for control frames, or the data of data frames
+func readFrame(t *testing.T, r io.Reader) (uint32, []byte) {
+	var length uint32
+	require.NoError(t, binary.Read(r, binary.BigEndian, &length))
+	if length > 0 {
+		data := make([]byte, length)
+		_, err := io.ReadFull(r, data)
+		require.NoError(t, err)
+		return 0, data
+	}
+
+	require.NoError(t, binary.Read(r, binary.BigEndian, &length))
+	control := make([]byte, length)
+	_, err := io.ReadFull(r, control)
+	require.NoError(t, err)
+	return binary.BigEndian.Uint32(control), nil
+}
+
+func writeControl(t *testing.T, w io.Writer, controlType uint32) {
+	frame := binary.BigEndian.AppendUint32(nil, 0)
+	frame = binary.BigEndian.AppendUint32(frame, 4)
+	frame = binary.BigEndian.AppendUint32(frame, controlType)
+	_, err := w.Write(frame)
+	require.NoError(t, err)
+}
+
+// parseFields returns the last value of every field, varints as uint64 and everything else as []byte
+func parseFields(t *testing.T, data []byte) map[protowire.Number]any {
+	fields := make(map[protowire.Number]any)
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		require.Greater(t, n, 0)
+		data = data[n:]
+
+		switch typ {
+		case protowire.VarintType:
+			v, n := protowire.ConsumeVarint(data)
+			require.Greater(t, n, 0)
+			fields[num] = v
+			data = data[n:]
+		case protowire.Fixed32Type:
+			_, n := protowire.ConsumeFixed32(data)
+			require.Greater(t, n, 0)
+			data = data[n:]
+		case protowire.BytesType:
+			v, n := protowire.ConsumeBytes(data)
+			require.Greater(t, n, 0)
+			fields[num] = v
+			data = data[n:]
+		default:
+			t.Fatalf("unexpected wire type %d", typ)
+		}
+	}
+	return fields
+}
+
+func testMessage() *dnstap.Message {
+	return &dnstap.Message{
+		Type:         dnstap.MessageClientQuery,
+		Protocol:     dnstap.ProtocolUDP,
+		QueryAddr:    &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 5053},
+		ResponseAddr: &net.UDPAddr{IP: net.IPv4(192, 0, 2, 53), Port: 53},
+		QueryTime:    time.Now(),
+		QueryMessage: []byte("query"),
+	}
+}
+
+func assertTestMessage(t *testing.T, frame []byte) {
+	outer := parseFields(t, frame)
+	assert.Equal(t, []byte("test"), outer[1])
+	assert.Equal(t, uint64(1), outer[15])
+
+	msg := parseFields(t, outer[14].([]byte))
+	assert.Equal(t, uint64(dnstap.MessageClientQuery), msg[1])
+	assert.Equal(t, uint64(1), msg[2])
+	assert.Equal(t, uint64(dnstap.ProtocolUDP), msg[3])
+	assert.Equal(t, []byte{192, 0, 2, 1}, msg[4])
+	assert.Equal(t, []byte{192, 0, 2, 53}, msg[5])
+	assert.Equal(t, uint64(5053), msg[6])
+	assert.Equal(t, uint64(53), msg[7])
+	assert.Equal(t, []byte("query"), msg[10])
+}
+
+func TestUnixSocketOutput(t *testing.T) {
+	socketPath := filepath.Join(t.TempDir(), "dnstap.sock")
+	listener, err := net.Listen("unix", socketPath)
+	require.NoError(t, err)
+	defer func() {
+		_ = listener.Close()
+	}()
+
+	output, err := dnstap.NewOutput(&dnstap.Config{
+		Unix:     socketPath,
+		Identity: "test",
+	})
+	require.NoError(t, err)
+	dnstap.SetOutput(output)
+	defer dnstap.SetOutput(nil)
+	output.Start()
+
+	conn, err := listener.Accept()
+	require.NoError(t, err)
+	defer func() {
+		_ = conn.Close()
+	}()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	controlType, _ := readFrame(t, conn)
+	assert.Equal(t, uint32(controlReady), controlType)
+	writeControl(t, conn, controlAccept)
+	controlType, _ = readFrame(t, conn)
+	assert.Equal(t, uint32(controlStart), controlType)
+
+	assert.True(t, dnstap.ClientEnabled())
+	assert.True(t, dnstap.UpstreamEnabled())
+	dnstap.Log(testMessage())
+
+	controlType, frame := readFrame(t, conn)
+	assert.Equal(t, uint32(0), controlType)
+	assertTestMessage(t, frame)
+
+	go output.Stop()
+	controlType, _ = readFrame(t, conn)
+	assert.Equal(t, uint32(controlStop), controlType)
+	writeControl(t, conn, controlFinish)
+}
+
+func TestFileOutput(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "dnstap.fstrm")
+	upstream := false
+	output, err := dnstap.NewOutput(&dnstap.Config{
+		File:     file,
+		Identity: "test",
+		Upstream: &upstream,
+	})
+	require.NoError(t, err)
+	dnstap.SetOutput(output)
+	defer dnstap.SetOutput(nil)
+	output.Start()
+
+	assert.False(t, dnstap.UpstreamEnabled())
+	dnstap.Log(testMessage())
+	dnstap.Log(testMessage())
+	output.Stop()
+
+	data, err := os.ReadFile(file)
+	require.NoError(t, err)
+	r := bytes.NewReader(data)
+
+	controlType, _ := readFrame(t, r)
+	assert.Equal(t, uint32(controlStart), controlType)
+	for range 2 {
+		_, frame := readFrame(t, r)
+		assertTestMessage(t, frame)
+	}
+	controlType, _ = readFrame(t, r)
+	assert.Equal(t, uint32(controlStop), controlType)
+	assert.Equal(t, 0, r.Len())
+}
+
+func TestNewOutputNeedsOneTarget(t *testing.T) {
+	_, err := dnstap.NewOutput(&dnstap.Config{})
+	assert.ErrorIs(t, err, dnstap.ErrNoOutput)
+	_, err = dnstap.NewOutput(&dnstap.Config{Unix: "/tmp/a", File: "/tmp/b"})
+	assert.ErrorIs(t, err, dnstap.ErrNoOutput)
+}
@@ -0,0 +1,38 @@
+package handler
+
+import (
+	"net"
+
+	"github.com/Doridian/foxDNS/util"
+)
+
+// ACL decides which clients may query a handler and which may use it recursively
+type ACL struct {
+	// Clients allowed to query, empty allows everyone
+	Allow []*AddrMatcher
+	// Clients denied even if they are in Allow
+	Deny []*AddrMatcher
+	// Clients allowed to recurse, empty allows everyone that may query
+	AllowRecursion []*AddrMatcher
+	// Only allow recursion for loopback, link-local and private clients
+	LocalOnlyRecursion bool
+}
+
+// AllowsQuery checks whether the client at addr may query at all
+func (a *ACL) AllowsQuery(addr net.Addr) bool {
+	if matchesAny(a.Deny, addr) {
+		return false
+	}
+	return len(a.Allow) == 0 || matchesAny(a.Allow, addr)
+}
+
+// AllowsRecursion checks whether the client at addr may have queries resolved beyond the local data
+func (a *ACL) AllowsRecursion(addr net.Addr) bool {
+	if !a.AllowsQuery(addr) {
+		return false
+	}
+	if a.LocalOnlyRecursion && !util.IPIsPrivateOrLocal(util.ExtractIP(addr)) {
+		return false
+	}
+	return len(a.AllowRecursion) == 0 || matchesAny(a.AllowRecursion, addr)
+}
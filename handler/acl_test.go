@@ -0,0 +1,133 @@
+package handler_test
+
+import (
+	"net"
+	"testing"
+
+	"github.com/Doridian/foxDNS/handler"
+	"github.com/Doridian/foxDNS/util"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type recurseGenerator struct {
+	lastRecurse bool
+	queries     int
+}
+
+func (g *recurseGenerator) HandleQuestion(questions []dns.Question, recurse bool, _ bool, _ bool, _ util.Addressable) ([]dns.RR, []dns.RR, []dns.RR, []dns.EDNS0, int, bool, string) {
+	g.lastRecurse = recurse
+	g.queries++
+	answer := []dns.RR{util.FillHeader(&dns.A{A: net.IPv4(192, 0, 2, 1)}, questions[0].Name, dns.TypeA, 60)}
+	return answer, nil, nil, nil, dns.RcodeSuccess, false, ""
+}
+
+func (g *recurseGenerator) GetName() string {
+	return "recurse"
+}
+
+func (g *recurseGenerator) Refresh() error {
+	return nil
+}
+
+func (g *recurseGenerator) Start() error {
+	return nil
+}
+
+func (g *recurseGenerator) Stop() error {
+	return nil
+}
+
+func queryACL(hdl *handler.Handler, client net.IP) *dns.Msg {
+	util.RequireCookie = false
+
+	msg := &dns.Msg{}
+	msg.SetQuestion("example.com.", dns.TypeA)
+	msg.SetEdns0(1232, false)
+
+	wr := &handler.TestResponseWriter{
+		RemoteAddrVal: &net.UDPAddr{IP: client, Port: 5053},
+		LocalAddrVal:  &net.UDPAddr{IP: net.IPv4(192, 0, 2, 53), Port: 53},
+	}
+	hdl.ServeDNS(wr, msg)
+	return wr.LastMsg
+}
+
+func assertProhibited(t *testing.T, reply *dns.Msg) {
+	require.NotNil(t, reply)
+	assert.Equal(t, dns.RcodeRefused, reply.Rcode)
+	assert.Empty(t, reply.Answer)
+
+	require.NotNil(t, reply.IsEdns0())
+	found := false
+	for _, opt := range reply.IsEdns0().Option {
+		if ede, ok := opt.(*dns.EDNS0_EDE); ok {
+			assert.Equal(t, dns.ExtendedErrorCodeProhibited, ede.InfoCode)
+			found = true
+		}
+	}
+	assert.True(t, found)
+}
+
+func TestACLAllowDeny(t *testing.T) {
+	gen := &recurseGenerator{}
+	hdl := handler.New(gen, false)
+	hdl.ACL = &handler.ACL{
+		Allow: mustParseAddrMatchers(t, "10.0.0.0/8"),
+		Deny:  mustParseAddrMatchers(t, "10.99.0.0/16"),
+	}
+
+	reply := queryACL(hdl, net.IPv4(10, 1, 2, 3))
+	require.NotNil(t, reply)
+	assert.Equal(t, dns.RcodeSuccess, reply.Rcode)
+	assert.Len(t, reply.Answer, 1)
+
+	assertProhibited(t, queryACL(hdl, net.IPv4(10, 99, 2, 3)))
+	assertProhibited(t, queryACL(hdl, net.IPv4(192, 0, 2, 99)))
+	assert.Equal(t, 1, gen.queries)
+}
+
+func TestACLLocalOnlyRecursion(t *testing.T) {
+	acl := &handler.ACL{
+		LocalOnlyRecursion: true,
+	}
+
+	// Resolvers refuse clients that may not recurse
+	gen := &recurseGenerator{}
+	hdl := handler.New(gen, false)
+	hdl.ACL = acl
+
+	reply := queryACL(hdl, net.IPv4(192, 168, 1, 2))
+	require.NotNil(t, reply)
+	assert.Equal(t, dns.RcodeSuccess, reply.Rcode)
+	assert.True(t, gen.lastRecurse)
+
+	assertProhibited(t, queryACL(hdl, net.IPv4(198, 51, 100, 1)))
+	assert.Equal(t, 1, gen.queries)
+
+	// Authoritative zones still answer, but without recursion
+	gen = &recurseGenerator{}
+	hdl = handler.New(gen, true)
+	hdl.ACL = acl
+
+	reply = queryACL(hdl, net.IPv4(198, 51, 100, 1))
+	require.NotNil(t, reply)
+	assert.Equal(t, dns.RcodeSuccess, reply.Rcode)
+	assert.Len(t, reply.Answer, 1)
+	assert.False(t, gen.lastRecurse)
+
+	reply = queryACL(hdl, net.IPv4(127, 0, 0, 1))
+	require.NotNil(t, reply)
+	assert.True(t, gen.lastRecurse)
+}
+
+func TestACLAllowRecursion(t *testing.T) {
+	acl := &handler.ACL{
+		AllowRecursion: mustParseAddrMatchers(t, "2001:db8:1::/48"),
+	}
+
+	assert.True(t, acl.AllowsQuery(&net.UDPAddr{IP: net.ParseIP("2001:db8:2::1")}))
+	assert.False(t, acl.AllowsRecursion(&net.UDPAddr{IP: net.ParseIP("2001:db8:2::1")}))
+	assert.True(t, acl.AllowsRecursion(&net.UDPAddr{IP: net.ParseIP("2001:db8:1::1")}))
+}
@@ -18,11 +18,21 @@ var (
 		Help:    "The time it took to process a DNS query",
 		Buckets: []float64{0.001, 0.005, 0.01, 0.05, 0.1, 0.5},
 	}, []string{"handler"})
+
+	responsesTruncated = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "foxdns_responses_truncated_total",
+		Help: "The total number of DNS responses truncated to fit the client buffer size",
+	}, []string{"handler"})
+
+	queriesProhibited = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "foxdns_queries_prohibited_total",
+		Help: "The total number of DNS queries refused by an ACL",
+	}, []string{"handler", "reason"})
 )
 
 type Generator interface {
 	GetName() string
-	HandleQuestion(questions []dns.Question, recurse bool, dnssec bool, wr util.Addressable) (answer []dns.RR, ns []dns.RR, edns0Opts []dns.EDNS0, rcode int, handlerName string)
+	HandleQuestion(questions []dns.Question, recurse bool, dnssec bool, checkingDisabled bool, wr util.Addressable) (answer []dns.RR, ns []dns.RR, extra []dns.RR, edns0Opts []dns.EDNS0, rcode int, authenticatedData bool, handlerName string)
 
 	Loadable
 }
@@ -38,8 +38,8 @@ func New(reason string) *Generator {
 	}
 }
 
-func (r *Generator) HandleQuestion(_ []dns.Question, _ bool, _ bool, _ util.Addressable) ([]dns.RR, []dns.RR, []dns.EDNS0, int, string) {
-	return nil, r.soa, r.edns0, dns.RcodeNameError, ""
+func (r *Generator) HandleQuestion(_ []dns.Question, _ bool, _ bool, _ bool, _ util.Addressable) ([]dns.RR, []dns.RR, []dns.RR, []dns.EDNS0, int, bool, string) {
+	return nil, r.soa, nil, r.edns0, dns.RcodeNameError, false, ""
 }
 
 func (r *Generator) GetName() string {
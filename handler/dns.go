@@ -3,10 +3,46 @@ package handler
 import (
 	"time"
 
+	"github.com/Doridian/foxDNS/querylog"
 	"github.com/Doridian/foxDNS/util"
 	"github.com/miekg/dns"
 )
 
+func maxUDPReplySize(msg *dns.Msg) int {
+	queryEdns0 := msg.IsEdns0()
+	if queryEdns0 == nil {
+		return dns.MinMsgSize
+	}
+
+	size := int(queryEdns0.UDPSize())
+	if size > int(util.UDPSize) {
+		size = int(util.UDPSize)
+	}
+	if size < dns.MinMsgSize {
+		size = dns.MinMsgSize
+	}
+	return size
+}
+
+func (h *Handler) truncateReply(msg *dns.Msg, reply *dns.Msg, wr util.Addressable, handlerName string) {
+	if !util.IsUDPQuery(wr) {
+		return
+	}
+
+	// Truncate disables compression if the reply fits without it, we always want it
+	compress := reply.Compress
+	reply.Truncate(maxUDPReplySize(msg))
+	reply.Compress = compress || reply.Compress
+	if !reply.Truncated {
+		return
+	}
+
+	if handlerName == "" {
+		handlerName = h.child.GetName()
+	}
+	responsesTruncated.WithLabelValues(handlerName).Inc()
+}
+
 func (h *Handler) ServeDNS(wr dns.ResponseWriter, msg *dns.Msg) {
 	startTime := time.Now()
 
@@ -19,15 +55,42 @@ func (h *Handler) ServeDNS(wr dns.ResponseWriter, msg *dns.Msg) {
 	}
 	reply.SetRcode(msg, dns.RcodeSuccess)
 
+	var handlerName string
+
 	ok, edns0Options := util.ApplyEDNS0ReplyEarly(msg, reply, wr)
 	if !ok {
 		_ = wr.WriteMsg(reply)
 		return
 	}
 
+	queryData := packDnstapQuery(wr, msg)
+
+	var queryLogger *querylog.Logger
+	var queryLogWr *queryLogWriter
+	if !util.IsLocalQuery(wr) {
+		queryLogger = querylog.Sampled()
+	}
+
 	defer func() {
+		if h.authoritative && !applyRRL(wr, msg, reply) {
+			if queryData != nil {
+				h.logDnstap(wr, queryData, startTime, nil)
+			}
+			if queryLogger != nil {
+				h.logQuery(queryLogger, wr, msg, nil, handlerName, queryLogWr, startTime)
+			}
+			return
+		}
 		util.ApplyEDNS0Reply(msg, reply, edns0Options, wr)
+		h.truncateReply(msg, reply, wr, handlerName)
 		_ = wr.WriteMsg(reply)
+
+		if queryData != nil {
+			h.logDnstap(wr, queryData, startTime, reply)
+		}
+		if queryLogger != nil {
+			h.logQuery(queryLogger, wr, msg, reply, handlerName, queryLogWr, startTime)
+		}
 	}()
 
 	if len(msg.Question) == 0 {
@@ -49,17 +112,55 @@ func (h *Handler) ServeDNS(wr dns.ResponseWriter, msg *dns.Msg) {
 		return
 	}
 
-	var handlerName string
 	q.Name = dns.CanonicalName(q.Name)
 	recurse := msg.RecursionDesired && queryDepth < util.MaxRecursionDepth
+
+	if h.ACL != nil {
+		prohibitReason := ""
+		if !h.ACL.AllowsQuery(wr.RemoteAddr()) {
+			prohibitReason = "query"
+		} else if !h.ACL.AllowsRecursion(wr.RemoteAddr()) {
+			// Authoritative data is still served, just without following it elsewhere.
+			// Resolvers only have data from elsewhere, so not even their cache is served.
+			if !h.authoritative {
+				prohibitReason = "recursion"
+			}
+			recurse = false
+		}
+
+		if prohibitReason != "" {
+			queriesProhibited.WithLabelValues(h.child.GetName(), prohibitReason).Inc()
+			reply.Rcode = dns.RcodeRefused
+			edns0Options = append(edns0Options, &dns.EDNS0_EDE{
+				InfoCode: dns.ExtendedErrorCodeProhibited,
+			})
+			return
+		}
+	}
 	dnssec := msg.IsEdns0() != nil && msg.IsEdns0().Do()
 
+	var childWr util.Addressable = wr
+	if clientSubnet := util.FindClientSubnet(msg); clientSubnet != nil {
+		childWr = &util.ClientSubnetWriter{
+			ResponseWriter: wr,
+			Subnet:         clientSubnet,
+		}
+	}
+	if queryLogger != nil {
+		queryLogWr = &queryLogWriter{Addressable: childWr}
+		childWr = queryLogWr
+	}
+
 	var childEdns0 []dns.EDNS0
-	reply.Answer, reply.Ns, childEdns0, reply.Rcode, handlerName = h.child.HandleQuestion(msg.Question, recurse, dnssec, wr)
+	var authenticatedData bool
+	reply.Answer, reply.Ns, reply.Extra, childEdns0, reply.Rcode, authenticatedData, handlerName = h.child.HandleQuestion(msg.Question, recurse, dnssec, msg.CheckingDisabled, childWr)
 	if childEdns0 != nil {
 		edns0Options = append(edns0Options, childEdns0...)
 	}
 
+	// RFC 6840 section 5.7: only set AD if the client indicated it understands it
+	reply.AuthenticatedData = authenticatedData && (dnssec || msg.AuthenticatedData)
+
 	duration := time.Since(startTime)
 
 	rcode := dns.RcodeToString[reply.Rcode]
@@ -0,0 +1,87 @@
+package handler_test
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/Doridian/foxDNS/handler"
+	"github.com/Doridian/foxDNS/util"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+type largeGenerator struct{}
+
+func (g *largeGenerator) HandleQuestion(questions []dns.Question, _ bool, _ bool, _ bool, _ util.Addressable) ([]dns.RR, []dns.RR, []dns.RR, []dns.EDNS0, int, bool, string) {
+	answer := make([]dns.RR, 0, 20)
+	for i := 0; i < 20; i++ {
+		rr := &dns.TXT{
+			Txt: []string{fmt.Sprintf("%d-%s", i, strings.Repeat("x", 100))},
+		}
+		answer = append(answer, util.FillHeader(rr, questions[0].Name, dns.TypeTXT, 60))
+	}
+	return answer, nil, nil, nil, dns.RcodeSuccess, false, ""
+}
+
+func (g *largeGenerator) GetName() string {
+	return "large"
+}
+
+func (g *largeGenerator) Refresh() error {
+	return nil
+}
+
+func (g *largeGenerator) Start() error {
+	return nil
+}
+
+func (g *largeGenerator) Stop() error {
+	return nil
+}
+
+func queryLarge(network string, udpSize uint16) *dns.Msg {
+	util.RequireCookie = false
+	hdl := handler.New(&largeGenerator{}, true)
+
+	msg := &dns.Msg{}
+	msg.SetQuestion("example.com.", dns.TypeTXT)
+	if udpSize > 0 {
+		msg.SetEdns0(udpSize, false)
+	}
+
+	wr := &handler.TestResponseWriter{}
+	if network == "udp" {
+		wr.LocalAddrVal = &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53}
+		wr.RemoteAddrVal = &net.UDPAddr{IP: net.IPv4(127, 0, 0, 2), Port: 5053}
+	}
+
+	hdl.ServeDNS(wr, msg)
+	return wr.LastMsg
+}
+
+func TestTruncatesUDPWithoutEDNS0(t *testing.T) {
+	reply := queryLarge("udp", 0)
+	assert.True(t, reply.Truncated)
+	assert.LessOrEqual(t, reply.Len(), dns.MinMsgSize)
+}
+
+func TestTruncatesUDPToClientSize(t *testing.T) {
+	reply := queryLarge("udp", 1200)
+	assert.True(t, reply.Truncated)
+	assert.LessOrEqual(t, reply.Len(), 1200)
+	assert.NotNil(t, reply.IsEdns0())
+}
+
+func TestTruncatesUDPToServerSize(t *testing.T) {
+	reply := queryLarge("udp", 4096)
+	assert.True(t, reply.Truncated)
+	assert.LessOrEqual(t, reply.Len(), int(util.UDPSize))
+}
+
+func TestDoesNotTruncateTCP(t *testing.T) {
+	reply := queryLarge("tcp", 0)
+	assert.False(t, reply.Truncated)
+	assert.Len(t, reply.Answer, 20)
+}
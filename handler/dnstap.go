@@ -0,0 +1,63 @@
+package handler
+
+import (
+	"time"
+
+	"github.com/Doridian/foxDNS/dnstap"
+	"github.com/Doridian/foxDNS/util"
+	"github.com/miekg/dns"
+)
+
+func dnstapProtocol(wr util.Addressable) dnstap.SocketProtocol {
+	if util.IsUDPQuery(wr) {
+		return dnstap.ProtocolUDP
+	}
+	return dnstap.ProtocolTCP
+}
+
+// packDnstapQuery returns nil if client queries are not logged
+func packDnstapQuery(wr util.Addressable, msg *dns.Msg) []byte {
+	if !dnstap.ClientEnabled() || util.IsLocalQuery(wr) {
+		return nil
+	}
+	queryData, err := msg.Pack()
+	if err != nil {
+		return nil
+	}
+	return queryData
+}
+
+// logDnstap logs a client query and, unless it was dropped, its reply
+func (h *Handler) logDnstap(wr util.Addressable, queryData []byte, queryTime time.Time, reply *dns.Msg) {
+	queryType := dnstap.MessageClientQuery
+	if h.authoritative {
+		queryType = dnstap.MessageAuthQuery
+	}
+
+	dnstap.Log(&dnstap.Message{
+		Type:         queryType,
+		Protocol:     dnstapProtocol(wr),
+		QueryAddr:    wr.RemoteAddr(),
+		ResponseAddr: wr.LocalAddr(),
+		QueryTime:    queryTime,
+		QueryMessage: queryData,
+	})
+
+	if reply == nil {
+		return
+	}
+	replyData, err := reply.Pack()
+	if err != nil {
+		return
+	}
+	dnstap.Log(&dnstap.Message{
+		Type:            queryType + 1,
+		Protocol:        dnstapProtocol(wr),
+		QueryAddr:       wr.RemoteAddr(),
+		ResponseAddr:    wr.LocalAddr(),
+		QueryTime:       queryTime,
+		QueryMessage:    queryData,
+		ResponseTime:    time.Now(),
+		ResponseMessage: replyData,
+	})
+}
@@ -3,6 +3,9 @@ package handler
 type Handler struct {
 	child         Generator
 	authoritative bool
+
+	// ACL restricts who may use this handler, nil allows everyone
+	ACL *ACL
 }
 
 func New(child Generator, authoritative bool) *Handler {
@@ -21,11 +21,11 @@ func runLocalizerTest(t *testing.T, host string, qtype uint16, remoteIP net.IP,
 	remoteAddr := &net.TCPAddr{IP: remoteIP, Port: 12345}
 	wr := &util.DummyAddressable{RemoteAddress: remoteAddr}
 
-	rr, _, _, rcode, _ := handler.HandleQuestion([]dns.Question{{
+	rr, _, _, _, rcode, _, _ := handler.HandleQuestion([]dns.Question{{
 		Name:   host,
 		Qtype:  qtype,
 		Qclass: dns.ClassINET,
-	}}, true, true, wr)
+	}}, true, true, false, wr)
 	assert.Equal(t, dns.RcodeSuccess, rcode)
 
 	if expected == nil {
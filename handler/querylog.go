@@ -0,0 +1,59 @@
+package handler
+
+import (
+	"time"
+
+	"github.com/Doridian/foxDNS/querylog"
+	"github.com/Doridian/foxDNS/util"
+	"github.com/miekg/dns"
+)
+
+// queryLogWriter collects what the generator reports about how it answered
+type queryLogWriter struct {
+	util.Addressable
+	cacheResult string
+	upstream    string
+}
+
+func (w *queryLogWriter) RecordResolution(cacheResult string, upstream string) {
+	w.cacheResult = cacheResult
+	w.upstream = upstream
+}
+
+func (w *queryLogWriter) ClientSubnet() *dns.EDNS0_SUBNET {
+	return util.GetClientSubnet(w.Addressable)
+}
+
+func queryLogProtocol(wr util.Addressable) string {
+	if util.IsUDPQuery(wr) {
+		return "udp"
+	}
+	return "tcp"
+}
+
+func (h *Handler) logQuery(logger *querylog.Logger, wr util.Addressable, msg *dns.Msg, reply *dns.Msg, handlerName string, logWr *queryLogWriter, startTime time.Time) {
+	record := &querylog.Record{
+		Time:     startTime,
+		Client:   logger.ClientAddr(wr.RemoteAddr()),
+		Protocol: queryLogProtocol(wr),
+		Handler:  handlerName,
+		Duration: float64(time.Since(startTime).Microseconds()) / 1000,
+	}
+	if record.Handler == "" {
+		record.Handler = h.child.GetName()
+	}
+	if len(msg.Question) > 0 {
+		record.Name = msg.Question[0].Name
+		record.Type = dns.TypeToString[msg.Question[0].Qtype]
+	}
+	if reply == nil {
+		record.Rcode = "DROPPED"
+	} else {
+		record.Rcode = dns.RcodeToString[reply.Rcode]
+	}
+	if logWr != nil {
+		record.Cache = logWr.cacheResult
+		record.Upstream = logWr.upstream
+	}
+	logger.Log(record)
+}
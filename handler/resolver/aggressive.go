@@ -0,0 +1,377 @@
+package resolver
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Maximum number of NSEC/NSEC3 records kept per zone for aggressive negative caching
+const nsecCacheMaxRecordsPerZone = 512
+
+type nsecCacheRecord struct {
+	// The NSEC or NSEC3 record followed by its signatures
+	rrs    []dns.RR
+	time   time.Time
+	expiry time.Time
+}
+
+type nsecCacheZone struct {
+	lock    sync.Mutex
+	soa     *nsecCacheRecord
+	records map[string]*nsecCacheRecord
+}
+
+// copyEntryRecords copies records, counting down their TTLs by the time since they were cached
+func (g *Generator) copyEntryRecords(rrs []dns.RR, cachedAt time.Time, now time.Time) []dns.RR {
+	ttlAdjust := uint32(now.Sub(cachedAt).Seconds())
+	copied := make([]dns.RR, 0, len(rrs))
+	for _, rr := range rrs {
+		rr = dns.Copy(rr)
+		if ttlAdjust > 0 {
+			g.countdownRecordTTL(rr, ttlAdjust)
+		}
+		copied = append(copied, rr)
+	}
+	return copied
+}
+
+// findNXDomainCut implements RFC 8020, names below a cached NXDOMAIN do not exist either
+func (g *Generator) findNXDomainCut(q *dns.Question) *dns.Msg {
+	if !g.NXDomainCut || q.Name == "." {
+		return nil
+	}
+
+	now := g.CurrentTime()
+	for name := parentName(q.Name); name != "."; name = parentName(name) {
+		entry, ok := g.cache.Get(cacheKeyDomain(&dns.Question{Name: name}))
+		if !ok || entry.msg.Rcode != dns.RcodeNameError || len(entry.msg.Answer) > 0 || entry.bogusMsg != nil || !entry.expiry.After(now) {
+			continue
+		}
+
+		return &dns.Msg{
+			MsgHdr: dns.MsgHdr{
+				Rcode:             dns.RcodeNameError,
+				AuthenticatedData: entry.msg.AuthenticatedData,
+			},
+			Ns: g.copyEntryRecords(entry.msg.Ns, entry.time, now),
+		}
+	}
+	return nil
+}
+
+func isDelegationBitmap(bitmap []uint16) bool {
+	return typeInBitmap(bitmap, dns.TypeNS) && !typeInBitmap(bitmap, dns.TypeSOA)
+}
+
+// storeNSECRecords remembers the NSEC/NSEC3 records of a validated negative response
+func (g *Generator) storeNSECRecords(msg *dns.Msg) {
+	if !g.AggressiveNSEC || !msg.AuthenticatedData {
+		return
+	}
+
+	var soa *nsecCacheRecord
+	zone := ""
+	now := g.CurrentTime()
+	records := make(map[string]*nsecCacheRecord)
+
+	for _, set := range groupRRsets(msg.Ns) {
+		rrs := make([]dns.RR, 0, len(set.records)+len(set.sigs))
+		rrs = append(rrs, set.records...)
+		for _, sig := range set.sigs {
+			rrs = append(rrs, sig)
+		}
+
+		ttl := minRecordTTL(set.records)
+		switch set.rrtype {
+		case dns.TypeSOA:
+			zone = set.name
+			if soaTTL := set.records[0].(*dns.SOA).Minttl; soaTTL < ttl {
+				ttl = soaTTL
+			}
+		case dns.TypeNSEC, dns.TypeNSEC3:
+		default:
+			continue
+		}
+
+		record := &nsecCacheRecord{
+			rrs:    rrs,
+			time:   now,
+			expiry: now.Add(time.Duration(ttl) * time.Second),
+		}
+		if set.rrtype == dns.TypeSOA {
+			soa = record
+		} else {
+			records[set.name] = record
+		}
+	}
+
+	if soa == nil || len(records) == 0 {
+		return
+	}
+
+	zoneCache, ok := g.nsecCache.Get(zone)
+	if !ok {
+		zoneCache = &nsecCacheZone{
+			records: make(map[string]*nsecCacheRecord),
+		}
+		existing, ok, _ := g.nsecCache.PeekOrAdd(zone, zoneCache)
+		if ok {
+			zoneCache = existing
+		}
+	}
+
+	zoneCache.lock.Lock()
+	defer zoneCache.lock.Unlock()
+
+	zoneCache.soa = soa
+	for owner, record := range zoneCache.records {
+		if !record.expiry.After(now) {
+			delete(zoneCache.records, owner)
+		}
+	}
+	for owner, record := range records {
+		if len(zoneCache.records) >= nsecCacheMaxRecordsPerZone {
+			break
+		}
+		// Only keep records that are actually part of this zone
+		if !dns.IsSubDomain(zone, owner) {
+			continue
+		}
+		zoneCache.records[owner] = record
+	}
+}
+
+func commonAncestor(a string, b string) string {
+	labels := dns.CompareDomainName(a, b)
+	if labels <= 0 {
+		return "."
+	}
+	idx := dns.Split(a)
+	return a[idx[len(idx)-labels]:]
+}
+
+func nsec3OwnerHash(nsec3 *dns.NSEC3) string {
+	label, _, _ := strings.Cut(nsec3.Hdr.Name, ".")
+	return strings.ToUpper(label)
+}
+
+func nsec3HashCovers(nsec3 *dns.NSEC3, hash string) bool {
+	owner := nsec3OwnerHash(nsec3)
+	next := strings.ToUpper(nsec3.NextDomain)
+	if owner < next {
+		return owner < hash && hash < next
+	}
+	// Last NSEC3 in the chain, wrapping around
+	return hash > owner || hash < next
+}
+
+// synthesize looks for cached records proving q does not exist (RFC 8198)
+// and returns them together with the matching rcode, or nil if they do not prove anything
+func (z *nsecCacheZone) synthesize(q *dns.Question, now time.Time) ([]*nsecCacheRecord, int) {
+	z.lock.Lock()
+	defer z.lock.Unlock()
+
+	if z.soa == nil || !z.soa.expiry.After(now) {
+		return nil, dns.RcodeSuccess
+	}
+
+	var nsecs []*dns.NSEC
+	var nsec3s []*dns.NSEC3
+	recordsByRR := make(map[dns.RR]*nsecCacheRecord)
+	for _, record := range z.records {
+		if !record.expiry.After(now) {
+			continue
+		}
+		switch typedRR := record.rrs[0].(type) {
+		case *dns.NSEC:
+			nsecs = append(nsecs, typedRR)
+		case *dns.NSEC3:
+			nsec3s = append(nsec3s, typedRR)
+		}
+		recordsByRR[record.rrs[0]] = record
+	}
+
+	var proof []dns.RR
+	rcode := dns.RcodeSuccess
+	if len(nsecs) > 0 {
+		proof, rcode = synthesizeFromNSEC(q, nsecs)
+	} else if len(nsec3s) > 0 {
+		proof, rcode = synthesizeFromNSEC3(q, nsec3s)
+	}
+	if len(proof) == 0 {
+		return nil, dns.RcodeSuccess
+	}
+
+	result := []*nsecCacheRecord{z.soa}
+	seen := make(map[dns.RR]bool)
+	for _, rr := range proof {
+		if seen[rr] {
+			continue
+		}
+		seen[rr] = true
+		result = append(result, recordsByRR[rr])
+	}
+	return result, rcode
+}
+
+// synthesizeFromNSEC returns the NSEC records proving that q does not exist or has no data
+func synthesizeFromNSEC(q *dns.Question, nsecs []*dns.NSEC) ([]dns.RR, int) {
+	findCovering := func(name string) *dns.NSEC {
+		for _, nsec := range nsecs {
+			// Names below a delegation are not part of this zone's NSEC chain
+			if equalName(nsec.Hdr.Name, name) || (dns.IsSubDomain(dns.CanonicalName(nsec.Hdr.Name), name) && isDelegationBitmap(nsec.TypeBitMap)) {
+				return nil
+			}
+		}
+		for _, nsec := range nsecs {
+			if nsecCovers(nsec, name) {
+				return nsec
+			}
+		}
+		return nil
+	}
+
+	for _, nsec := range nsecs {
+		if !equalName(nsec.Hdr.Name, q.Name) {
+			continue
+		}
+		if typeInBitmap(nsec.TypeBitMap, q.Qtype) || typeInBitmap(nsec.TypeBitMap, dns.TypeCNAME) {
+			return nil, dns.RcodeSuccess
+		}
+		if q.Qtype != dns.TypeDS && isDelegationBitmap(nsec.TypeBitMap) {
+			return nil, dns.RcodeSuccess
+		}
+		return []dns.RR{nsec}, dns.RcodeSuccess
+	}
+
+	cover := findCovering(q.Name)
+	if cover == nil {
+		return nil, dns.RcodeSuccess
+	}
+
+	// The closest encloser is the longest existing ancestor, its wildcard must not exist either
+	closestEncloser := commonAncestor(q.Name, dns.CanonicalName(cover.Hdr.Name))
+	if nextAncestor := commonAncestor(q.Name, dns.CanonicalName(cover.NextDomain)); dns.CountLabel(nextAncestor) > dns.CountLabel(closestEncloser) {
+		closestEncloser = nextAncestor
+	}
+	wildcardCover := findCovering("*." + closestEncloser)
+	if wildcardCover == nil {
+		return nil, dns.RcodeSuccess
+	}
+
+	return []dns.RR{cover, wildcardCover}, dns.RcodeNameError
+}
+
+// synthesizeFromNSEC3 returns the NSEC3 records proving that q does not exist or has no data
+func synthesizeFromNSEC3(q *dns.Question, nsec3s []*dns.NSEC3) ([]dns.RR, int) {
+	params := nsec3s[0]
+	hashes := make(map[string]string)
+	hash := func(name string) string {
+		h, ok := hashes[name]
+		if !ok {
+			h = dns.HashName(name, params.Hash, params.Iterations, params.Salt)
+			hashes[name] = h
+		}
+		return h
+	}
+
+	findMatch := func(name string) *dns.NSEC3 {
+		for _, nsec3 := range nsec3s {
+			if nsec3OwnerHash(nsec3) == hash(name) {
+				return nsec3
+			}
+		}
+		return nil
+	}
+	findCovering := func(name string) *dns.NSEC3 {
+		for _, nsec3 := range nsec3s {
+			// Opt-out spans may contain unsigned delegations we know nothing about
+			if nsec3.Flags&1 == 0 && nsec3HashCovers(nsec3, hash(name)) {
+				return nsec3
+			}
+		}
+		return nil
+	}
+
+	if match := findMatch(q.Name); match != nil {
+		if typeInBitmap(match.TypeBitMap, q.Qtype) || typeInBitmap(match.TypeBitMap, dns.TypeCNAME) {
+			return nil, dns.RcodeSuccess
+		}
+		if q.Qtype != dns.TypeDS && isDelegationBitmap(match.TypeBitMap) {
+			return nil, dns.RcodeSuccess
+		}
+		return []dns.RR{match}, dns.RcodeSuccess
+	}
+
+	labels := dns.Split(q.Name)
+	for i := 1; i < len(labels); i++ {
+		closestEncloser := q.Name[labels[i]:]
+		encloserMatch := findMatch(closestEncloser)
+		if encloserMatch == nil {
+			continue
+		}
+		if isDelegationBitmap(encloserMatch.TypeBitMap) || typeInBitmap(encloserMatch.TypeBitMap, dns.TypeDNAME) {
+			return nil, dns.RcodeSuccess
+		}
+
+		nextCloserCover := findCovering(q.Name[labels[i-1]:])
+		wildcardCover := findCovering("*." + closestEncloser)
+		if nextCloserCover == nil || wildcardCover == nil {
+			return nil, dns.RcodeSuccess
+		}
+		return []dns.RR{encloserMatch, nextCloserCover, wildcardCover}, dns.RcodeNameError
+	}
+	return nil, dns.RcodeSuccess
+}
+
+// findNSECProof implements RFC 8198, synthesizing negative answers from cached NSEC/NSEC3 ranges
+func (g *Generator) findNSECProof(q *dns.Question) *dns.Msg {
+	if !g.AggressiveNSEC {
+		return nil
+	}
+
+	name := dns.CanonicalName(q.Name)
+	canonicalQ := &dns.Question{Name: name, Qtype: q.Qtype, Qclass: q.Qclass}
+	now := g.CurrentTime()
+	for zone := name; ; zone = parentName(zone) {
+		zoneCache, ok := g.nsecCache.Get(zone)
+		if ok {
+			records, rcode := zoneCache.synthesize(canonicalQ, now)
+			if records == nil {
+				return nil
+			}
+
+			msg := &dns.Msg{
+				MsgHdr: dns.MsgHdr{
+					Rcode:             rcode,
+					AuthenticatedData: true,
+				},
+			}
+			for _, record := range records {
+				msg.Ns = append(msg.Ns, g.copyEntryRecords(record.rrs, record.time, now)...)
+			}
+			return msg
+		}
+		if zone == "." {
+			return nil
+		}
+	}
+}
+
+// getSynthesizedFromCache answers q from cached negative answers of other names, if possible
+func (g *Generator) getSynthesizedFromCache(q *dns.Question) (*dns.Msg, string) {
+	msg := g.findNXDomainCut(q)
+	if msg != nil {
+		return msg, "nxdomain-cut"
+	}
+
+	msg = g.findNSECProof(q)
+	if msg != nil {
+		return msg, "nsec"
+	}
+
+	return nil, ""
+}
@@ -0,0 +1,90 @@
+package resolver_test
+
+import (
+	"testing"
+
+	"github.com/Doridian/foxDNS/handler/resolver"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func servfailHandler(wr dns.ResponseWriter, msg *dns.Msg) {
+	reply := &dns.Msg{}
+	reply.SetRcode(msg, dns.RcodeServerFailure)
+	_ = wr.WriteMsg(reply)
+}
+
+func TestNXDomainCut(t *testing.T) {
+	initTests()
+
+	msg := queryResolver(dns.Question{
+		Name:   "nx.example.com.",
+		Qtype:  dns.TypeA,
+		Qclass: dns.ClassINET,
+	})
+	assert.Equal(t, dns.RcodeNameError, msg.Rcode)
+
+	// Upstream is broken now, so the NXDOMAIN must come from the cached parent
+	dummyServer.SetHandler(dns.HandlerFunc(servfailHandler))
+
+	answer, _, _, _, rcode, _, _ := resolverGenerator.HandleQuestion([]dns.Question{{
+		Name:   "below.nx.example.com.",
+		Qtype:  dns.TypeAAAA,
+		Qclass: dns.ClassINET,
+	}}, true, true, false, nil)
+	assert.Equal(t, dns.RcodeNameError, rcode)
+	assert.Empty(t, answer)
+
+	answer, _, _, _, rcode, _, _ = resolverGenerator.HandleQuestion([]dns.Question{{
+		Name:   "other.example.com.",
+		Qtype:  dns.TypeA,
+		Qclass: dns.ClassINET,
+	}}, true, true, false, nil)
+	assert.Equal(t, dns.RcodeServerFailure, rcode)
+	assert.Empty(t, answer)
+}
+
+func TestAggressiveNSEC(t *testing.T) {
+	initTests()
+	zone := newSignedTestZone()
+	dummyServer.SetHandler(zone)
+	defer dummyServer.SetHandler(simpleHandler)
+
+	validatingGenerator := resolver.New([]*resolver.ServerConfig{
+		{
+			Addr:  "127.0.0.1:12053",
+			Proto: "udp",
+		},
+	})
+	validatingGenerator.DNSSECValidation = true
+	err := validatingGenerator.SetTrustAnchors([]string{zone.key.ToDS(dns.SHA256).String()})
+	assert.NoError(t, err)
+
+	_, _, _, _, rcode, authenticatedData, _ := validatingGenerator.HandleQuestion([]dns.Question{{
+		Name:   "nx.example.com.",
+		Qtype:  dns.TypeA,
+		Qclass: dns.ClassINET,
+	}}, true, true, false, nil)
+	assert.Equal(t, dns.RcodeNameError, rcode)
+	assert.True(t, authenticatedData)
+
+	dummyServer.SetHandler(dns.HandlerFunc(servfailHandler))
+
+	// Covered by the cached NSEC record of the first reply
+	_, ns, _, _, rcode, authenticatedData, _ := validatingGenerator.HandleQuestion([]dns.Question{{
+		Name:   "other.example.com.",
+		Qtype:  dns.TypeA,
+		Qclass: dns.ClassINET,
+	}}, true, true, false, nil)
+	assert.Equal(t, dns.RcodeNameError, rcode)
+	assert.True(t, authenticatedData)
+	assert.NotEmpty(t, ns)
+
+	// Past the end of the NSEC range, so this has to go upstream
+	_, _, _, _, rcode, _, _ = validatingGenerator.HandleQuestion([]dns.Question{{
+		Name:   "zzzz.example.com.",
+		Qtype:  dns.TypeA,
+		Qclass: dns.ClassINET,
+	}}, true, true, false, nil)
+	assert.Equal(t, dns.RcodeServerFailure, rcode)
+}
@@ -3,10 +3,15 @@ package resolver
 import (
 	"container/list"
 	"crypto/tls"
+	"log"
 	"math"
+	"net"
+	"net/http"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/Doridian/foxDNS/util"
 	lru "github.com/hashicorp/golang-lru/v2"
 	"github.com/miekg/dns"
 )
@@ -18,11 +23,31 @@ type ServerConfig struct {
 	RequireCookie      bool
 	MaxParallelQueries int
 	client             *dns.Client
+	httpClient         *http.Client
 	Timeout            time.Duration
 
+	// Send many queries at once over each TCP/DoT connection, using up to MaxConnections connections
+	Pipeline       bool
+	MaxConnections int
+	pipelineLock   sync.Mutex
+	pipelineConns  []*pipelineConn
+	// Held while dialing a new pipelined connection, pipelineLock is not
+	pipelineDialLock sync.Mutex
+	pipelineDialing  bool
+
 	freeQuerySlots  *list.List
 	querySlotCond   *sync.Cond
 	inFlightQueries int
+
+	rttLock sync.Mutex
+	rttEWMA time.Duration
+}
+
+func (s *ServerConfig) timeout() time.Duration {
+	if s.Timeout > 0 {
+		return s.Timeout
+	}
+	return util.DefaultTimeout
 }
 
 type ServerStrategy int
@@ -31,13 +56,22 @@ const (
 	StrategyRoundRobin ServerStrategy = iota
 	StrategyRandom
 	StrategyFailover
+	StrategyFastest
 )
 
 type Generator struct {
 	ServerStrategy ServerStrategy
 	Servers        []*ServerConfig
 
-	lastServerIdx int
+	// Chance for StrategyFastest to pick a random server instead of the fastest one
+	FastestExploreRate float64
+
+	// Number of upstream servers to query at once, the first valid response wins
+	RaceCount int
+	// Query another upstream server if none answered within this time, 0 to disable
+	HedgeDelay time.Duration
+
+	lastServerIdx atomic.Uint64
 	MaxIdleTime   time.Duration
 	Attempts      int
 	RetryWait     time.Duration
@@ -48,12 +82,55 @@ type Generator struct {
 
 	RequireCookie bool
 
+	// Randomise the case of names sent to plain UDP upstreams and require answers to match it (DNS 0x20)
+	QNameCaseRandomisation bool
+
+	// Send the subnet of the client to upstream servers (RFC 7871), truncated to these prefix lengths
+	ClientSubnet         bool
+	ClientSubnetPrefixV4 uint8
+	ClientSubnetPrefixV6 uint8
+	// Ignore subnets sent by clients and use their address instead
+	ClientSubnetStripClient bool
+	// Always send this subnet instead of the one of the client
+	ClientSubnetOverride *net.IPNet
+	ecsScopes            ecsScopes
+
+	Iterative         bool
+	RootHints         []string
+	QNameMinimisation bool
+	IterativeTimeout  time.Duration
+	delegationCache   *lru.Cache[string, *delegation]
+	lameCache         *lru.Cache[string, time.Time]
+	servFailCache     *lru.Cache[string, time.Time]
+	nameserverPort    string
+
+	DNSSECValidation bool
+	trustAnchors     map[string][]*dns.DS
+	trustCache       *lru.Cache[string, *zoneTrust]
+
+	// Answer names below a cached NXDOMAIN with NXDOMAIN (RFC 8020)
+	NXDomainCut bool
+	// Synthesize negative answers from cached, validated NSEC/NSEC3 records (RFC 8198)
+	AggressiveNSEC bool
+	nsecCache      *lru.Cache[string, *nsecCacheZone]
+
 	CacheMaxTTL               int
 	CacheMinTTL               int
 	CacheNoReplyTTL           int
 	CacheStaleEntryKeepPeriod time.Duration
 	CacheReturnStalePeriod    time.Duration
 
+	// Serve expired entries up to this long after expiry if the upstream servers fail (RFC 8767)
+	CacheMaxStalePeriod time.Duration
+	// Answer with such a stale entry if resolving takes longer than this, 0 to only use it on failure
+	StaleAnswerClientTimeout time.Duration
+
+	// Snapshot the cache to this file on Stop and every CachePersistInterval, restored on Start
+	CachePersistFile     string
+	CachePersistInterval time.Duration
+	cachePersistTicker   *time.Ticker
+	cacheRestored        bool
+
 	CurrentTime func() time.Time
 
 	RecordMinTTL uint32
@@ -66,10 +143,19 @@ type Generator struct {
 	cacheLock          *sync.Map
 	cacheWriteLock     sync.Mutex
 	cacheCleanupTicker *time.Ticker
+
+	// Closed by Stop to end the goroutines of all tickers, as stopping a ticker does not close its channel
+	tickerDone chan struct{}
 }
 
 func New(servers []*ServerConfig) *Generator {
 	cache, _ := lru.New[string, *cacheEntry](4096)
+	delegationCache, _ := lru.New[string, *delegation](4096)
+	lameCache, _ := lru.New[string, time.Time](1024)
+	servFailCache, _ := lru.New[string, time.Time](1024)
+	trustCache, _ := lru.New[string, *zoneTrust](1024)
+	nsecCache, _ := lru.New[string, *nsecCacheZone](1024)
+	trustAnchors, _ := parseTrustAnchors(defaultTrustAnchors)
 
 	gen := &Generator{
 		ServerStrategy: StrategyRoundRobin,
@@ -79,12 +165,27 @@ func New(servers []*ServerConfig) *Generator {
 		RetryWait:      time.Millisecond * 100,
 		LogFailures:    false,
 
+		FastestExploreRate: 0.05,
+
+		RaceCount:  1,
+		HedgeDelay: 0,
+
+		ClientSubnet:         false,
+		ClientSubnetPrefixV4: 24,
+		ClientSubnetPrefixV6: 56,
+		ecsScopes: ecsScopes{
+			seen: make(map[uint16][]uint8),
+		},
+
 		CacheMaxTTL:               3600,
 		CacheMinTTL:               0,
 		CacheNoReplyTTL:           30,
 		CacheStaleEntryKeepPeriod: time.Second * 15,
 		CacheReturnStalePeriod:    0,
 
+		CacheMaxStalePeriod:      0,
+		StaleAnswerClientTimeout: 0,
+
 		CurrentTime: time.Now,
 
 		RecordMinTTL: 0,
@@ -92,6 +193,23 @@ func New(servers []*ServerConfig) *Generator {
 
 		shouldPadLen: 0,
 
+		Iterative:         false,
+		RootHints:         defaultRootHints,
+		QNameMinimisation: true,
+		IterativeTimeout:  time.Second * 2,
+		delegationCache:   delegationCache,
+		lameCache:         lameCache,
+		servFailCache:     servFailCache,
+		nameserverPort:    "53",
+
+		DNSSECValidation: false,
+		trustAnchors:     trustAnchors,
+		trustCache:       trustCache,
+
+		NXDomainCut:    true,
+		AggressiveNSEC: true,
+		nsecCache:      nsecCache,
+
 		OpportunisticCacheMinHits:     math.MaxUint64,
 		OpportunisticCacheMaxTimeLeft: 0,
 
@@ -113,11 +231,18 @@ func New(servers []*ServerConfig) *Generator {
 		if srv.MaxParallelQueries <= 0 {
 			srv.MaxParallelQueries = 10
 		}
+		if srv.MaxConnections <= 0 {
+			srv.MaxConnections = 1
+		}
 
-		if srv.Proto == "tcp-tls" {
+		if srv.Proto == "tcp-tls" || srv.Proto == "https" {
 			gen.shouldPadLen = 128
 		}
 
+		if srv.Proto == "https" {
+			srv.httpClient = newHTTPSClient(srv, gen.MaxIdleTime)
+		}
+
 		if srv.ServerName != "" {
 			srv.client.TLSConfig = &tls.Config{
 				ServerName: srv.ServerName,
@@ -138,34 +263,53 @@ func (g *Generator) Start() error {
 		return err
 	}
 
+	if !g.cacheRestored {
+		g.cacheRestored = true
+		err = g.loadCache()
+		if err != nil {
+			log.Printf("Error restoring resolver cache from %s: %v", g.CachePersistFile, err)
+		}
+	}
+
+	tickerDone := make(chan struct{})
+	g.tickerDone = tickerDone
+
+	if g.CachePersistFile != "" && g.CachePersistInterval > 0 {
+		cachePersistTicker := time.NewTicker(g.CachePersistInterval)
+		g.cachePersistTicker = cachePersistTicker
+		go runTicker(cachePersistTicker, tickerDone, func() {
+			err := g.saveCache()
+			if err != nil {
+				log.Printf("Error saving resolver cache to %s: %v", g.CachePersistFile, err)
+			}
+		})
+	}
+
 	cacheCleanupTicker := time.NewTicker(time.Minute)
 	g.cacheCleanupTicker = cacheCleanupTicker
-	go func() {
-		for {
-			_, ok := <-cacheCleanupTicker.C
-			if !ok {
-				return
-			}
-			g.cleanupCache()
-		}
-	}()
+	go runTicker(cacheCleanupTicker, tickerDone, g.cleanupCache)
 
 	connCleanupTicker := time.NewTicker(g.MaxIdleTime / 2)
 	g.connCleanupTicker = connCleanupTicker
-	go func() {
-		for {
-			_, ok := <-connCleanupTicker.C
-			if !ok {
-				return
-			}
-			g.cleanupAllQuerySlots()
-		}
-	}()
+	go runTicker(connCleanupTicker, tickerDone, g.cleanupAllQuerySlots)
 
 	return nil
 }
 
+func runTicker(ticker *time.Ticker, done <-chan struct{}, f func()) {
+	for {
+		select {
+		case <-ticker.C:
+			f()
+		case <-done:
+			return
+		}
+	}
+}
+
 func (g *Generator) Stop() error {
+	started := g.cacheCleanupTicker != nil
+
 	if g.cacheCleanupTicker != nil {
 		g.cacheCleanupTicker.Stop()
 		g.cacheCleanupTicker = nil
@@ -174,6 +318,18 @@ func (g *Generator) Stop() error {
 		g.connCleanupTicker.Stop()
 		g.connCleanupTicker = nil
 	}
+	if g.cachePersistTicker != nil {
+		g.cachePersistTicker.Stop()
+		g.cachePersistTicker = nil
+	}
+	if g.tickerDone != nil {
+		close(g.tickerDone)
+		g.tickerDone = nil
+	}
+
+	if started {
+		return g.saveCache()
+	}
 	return nil
 }
 
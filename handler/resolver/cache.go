@@ -2,6 +2,8 @@ package resolver
 
 import (
 	"fmt"
+	"sort"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -13,12 +15,16 @@ import (
 
 type cacheEntry struct {
 	msg *dns.Msg
+	// SERVFAIL reply for responses that failed DNSSEC validation, msg is only served with CD set
+	bogusMsg *dns.Msg
 
 	time   time.Time
 	expiry time.Time
 	qtype  uint16
 	qclass uint16
 	hits   atomic.Uint64
+	// Upstream server the answer came from, for the query log and admin API
+	upstream string
 
 	refreshTriggered bool
 }
@@ -88,6 +94,90 @@ func (g *Generator) SetCacheSize(size int) {
 
 func (g *Generator) FlushCache() {
 	g.cache.Purge()
+	g.delegationCache.Purge()
+	g.lameCache.Purge()
+	g.servFailCache.Purge()
+	g.trustCache.Purge()
+	g.nsecCache.Purge()
+
+	cacheSize.Set(0)
+}
+
+// CacheIdentity describes everything that determines the contents of the cache.
+// Two generators with the same identity can share cache entries.
+func (g *Generator) CacheIdentity() string {
+	upstreams := make([]string, 0, len(g.Servers))
+	if g.Iterative {
+		upstreams = append(upstreams, g.RootHints...)
+	} else {
+		for _, srv := range g.Servers {
+			upstreams = append(upstreams, fmt.Sprintf("%s://%s#%s", srv.Proto, srv.Addr, srv.ServerName))
+		}
+	}
+	sort.Strings(upstreams)
+
+	// Validation results (AD and bogus) depend on the trust anchors
+	anchors := make([]string, 0, len(g.trustAnchors))
+	for _, zoneAnchors := range g.trustAnchors {
+		for _, ds := range zoneAnchors {
+			anchors = append(anchors, ds.String())
+		}
+	}
+	sort.Strings(anchors)
+
+	// Entries are scoped to client subnets, or not, depending on the ECS settings
+	clientSubnetOverride := ""
+	if g.ClientSubnetOverride != nil {
+		clientSubnetOverride = g.ClientSubnetOverride.String()
+	}
+	clientSubnet := fmt.Sprintf("%v/%d/%d/%v/%s", g.ClientSubnet, g.ClientSubnetPrefixV4, g.ClientSubnetPrefixV6, g.ClientSubnetStripClient, clientSubnetOverride)
+
+	return fmt.Sprintf("iterative=%v;dnssec=%v;upstreams=%s;anchors=%s;ecs=%s", g.Iterative, g.DNSSECValidation, strings.Join(upstreams, ","), strings.Join(anchors, ","), clientSubnet)
+}
+
+// TakeCacheFrom copies all cache entries of old into g, so a config reload does not start with a cold cache.
+// Callers should check that both generators have the same CacheIdentity.
+func (g *Generator) TakeCacheFrom(old *Generator) {
+	g.cacheWriteLock.Lock()
+	for _, key := range old.cache.Keys() {
+		entry, ok := old.cache.Peek(key)
+		if ok {
+			g.cache.Add(key, entry)
+		}
+	}
+	g.cacheWriteLock.Unlock()
+
+	for _, key := range old.delegationCache.Keys() {
+		deleg, ok := old.delegationCache.Peek(key)
+		if ok {
+			g.delegationCache.Add(key, deleg)
+		}
+	}
+	for _, key := range old.nsecCache.Keys() {
+		zoneCache, ok := old.nsecCache.Peek(key)
+		if ok {
+			g.nsecCache.Add(key, zoneCache)
+		}
+	}
+	for _, key := range old.lameCache.Keys() {
+		lameUntil, ok := old.lameCache.Peek(key)
+		if ok {
+			g.lameCache.Add(key, lameUntil)
+		}
+	}
+
+	old.ecsScopes.lock.RLock()
+	for family, scopes := range old.ecsScopes.seen {
+		for _, scope := range scopes {
+			g.noteECSScope(family, scope)
+		}
+	}
+	old.ecsScopes.lock.RUnlock()
+
+	// The old generator saves its snapshot when stopped, no need to load it again
+	g.cacheRestored = true
+
+	cacheSize.Set(float64(g.cache.Len()))
 }
 
 func cacheKey(q *dns.Question) string {
@@ -98,53 +188,141 @@ func cacheKeyDomain(q *dns.Question) string {
 	return fmt.Sprintf("%s:ANY", q.Name)
 }
 
-func (g *Generator) getOrAddCache(q *dns.Question, recurse bool, isCacheRefresh bool, incrementHits uint64) (string, string, *dns.Msg, error) {
-	key := cacheKey(q)
-	keyDomain := cacheKeyDomain(q)
+// getOrAddCache returns the cache result, match type, answer and the upstream server the answer came from
+func (g *Generator) getOrAddCache(q *dns.Question, ecs *dns.EDNS0_SUBNET, recurse bool, checkingDisabled bool, isCacheRefresh bool, incrementHits uint64) (string, string, *dns.Msg, string, error) {
+	baseKey := cacheKey(q)
+	baseKeyDomain := cacheKeyDomain(q)
+	key := g.clientCacheKey(baseKey, ecs)
+	keyDomain := g.clientCacheKey(baseKeyDomain, ecs)
+
+	// Queries for different client subnets may get different answers, so they must not wait for each other
+	lockKey := baseKey
+	if ecs != nil {
+		lockKey = scopedCacheKey(baseKey, ecs, ecs.SourceNetmask)
+	}
 
 	if !isCacheRefresh {
-		msg, matchType := g.getFromCache(key, keyDomain, q, recurse, incrementHits)
+		msg, matchType, upstream := g.getFromCache(key, keyDomain, q, ecs, recurse, checkingDisabled, incrementHits)
 		if msg != nil {
-			return "hit", matchType, msg, nil
+			return "hit", matchType, msg, upstream, nil
 		}
 	}
 
 	if !recurse {
-		return "", "", recursionDisabledAndNotCached, nil
+		return "", "", recursionDisabledAndNotCached, "", nil
+	}
+
+	var staleMsg *dns.Msg
+	var staleUpstream string
+	if !isCacheRefresh {
+		staleMsg, staleUpstream = g.getStaleFromCache(key, keyDomain, checkingDisabled)
 	}
+	serveStaleAfterTimeout := staleMsg != nil && g.StaleAnswerClientTimeout > 0
 
 	wg := &sync.WaitGroup{}
 	wg.Add(1)
-	defer wg.Done()
-	cacheLock, loaded := g.cacheLock.LoadOrStore(key, wg)
+	cacheLock, loaded := g.cacheLock.LoadOrStore(lockKey, wg)
 	cacheLockWG := cacheLock.(*sync.WaitGroup)
+	releaseCacheLock := func() {
+		if !loaded {
+			g.cacheLock.Delete(lockKey)
+		}
+		wg.Done()
+	}
 
 	if loaded {
+		releaseCacheLock()
+
 		if isCacheRefresh {
-			return "", "", nil, ErrNoRefreshCacheDuringRefetch
+			return "", "", nil, "", ErrNoRefreshCacheDuringRefetch
 		}
 
-		cacheLockWG.Wait()
+		if serveStaleAfterTimeout {
+			if !waitTimeout(cacheLockWG, g.StaleAnswerClientTimeout) {
+				return "stale", "", staleMsg, staleUpstream, nil
+			}
+		} else {
+			cacheLockWG.Wait()
+		}
 
-		msg, matchType := g.getFromCache(key, keyDomain, q, recurse, incrementHits)
+		key = g.clientCacheKey(baseKey, ecs)
+		keyDomain = g.clientCacheKey(baseKeyDomain, ecs)
+		msg, matchType, upstream := g.getFromCache(key, keyDomain, q, ecs, recurse, checkingDisabled, incrementHits)
 		if msg != nil {
-			return "wait", matchType, msg, nil
+			return "wait", matchType, msg, upstream, nil
 		}
-	} else {
-		defer g.cacheLock.Delete(key)
 	}
 
-	msg, err := g.exchangeWithRetry(q)
+	if !serveStaleAfterTimeout {
+		if !loaded {
+			defer releaseCacheLock()
+		}
+
+		matchType, msg, upstream, err := g.resolveAndCache(baseKey, baseKeyDomain, q, ecs, checkingDisabled, incrementHits)
+		if staleMsg != nil && !isUsableResult(msg, err) {
+			return "stale", "", staleMsg, staleUpstream, nil
+		}
+		if err != nil {
+			return "", "", nil, "", err
+		}
+		return "miss", matchType, msg, upstream, nil
+	}
+
+	// Keep resolving in the background if the client gets a stale answer in the meantime
+	resultChan := make(chan *resolveResult, 1)
+	go func() {
+		if !loaded {
+			defer releaseCacheLock()
+		}
+
+		matchType, msg, upstream, err := g.resolveAndCache(baseKey, baseKeyDomain, q, ecs, checkingDisabled, incrementHits)
+		resultChan <- &resolveResult{
+			matchType: matchType,
+			msg:       msg,
+			upstream:  upstream,
+			err:       err,
+		}
+	}()
+
+	timer := time.NewTimer(g.StaleAnswerClientTimeout)
+	defer timer.Stop()
+
+	select {
+	case result := <-resultChan:
+		if isUsableResult(result.msg, result.err) {
+			return "miss", result.matchType, result.msg, result.upstream, nil
+		}
+	case <-timer.C:
+	}
+	return "stale", "", staleMsg, staleUpstream, nil
+}
+
+func (g *Generator) resolveAndCache(key string, keyDomain string, q *dns.Question, ecs *dns.EDNS0_SUBNET, checkingDisabled bool, incrementHits uint64) (string, *dns.Msg, string, error) {
+	msg, upstream, err := g.resolve(q, ecs)
 	if err != nil {
-		return "", "", nil, err
+		return "", nil, "", err
 	}
 
-	matchType := g.processAndWriteToCache(key, keyDomain, q, msg, incrementHits)
-	return "miss", matchType, msg, nil
+	// Answers only valid for part of the internet are cached for that subnet only
+	if scope := responseScope(ecs, msg); scope > 0 {
+		key = scopedCacheKey(key, ecs, scope)
+		keyDomain = scopedCacheKey(keyDomain, ecs, scope)
+		g.noteECSScope(ecs.Family, scope)
+	}
+
+	bogusMsg := g.validateReply(q, msg)
+	matchType := g.processAndWriteToCache(key, keyDomain, q, msg, bogusMsg, upstream, incrementHits)
+	if bogusMsg == nil && len(msg.Answer) == 0 {
+		g.storeNSECRecords(msg)
+	}
+	if bogusMsg != nil && !checkingDisabled {
+		return matchType, bogusMsg, upstream, nil
+	}
+	return matchType, msg, upstream, nil
 }
 
 func (g *Generator) cleanupCache() {
-	minTime := g.CurrentTime().Add(-g.CacheStaleEntryKeepPeriod)
+	minTime := g.CurrentTime().Add(-max(g.CacheStaleEntryKeepPeriod, g.staleKeepPeriod()))
 
 	toRemove := make([]string, 0)
 	for _, key := range g.cache.Keys() {
@@ -194,13 +372,16 @@ func (g *Generator) adjustRecordTTL(rr dns.RR) (*dns.RR_Header, int) {
 	return rrHdr, int(origTtl)
 }
 
-func (g *Generator) getFromCache(key string, keyDomain string, q *dns.Question, recurse bool, incrementHits uint64) (*dns.Msg, string) {
+// getFromCache returns the cached answer, its match type and the upstream server it came from.
+// Answers synthesized from cached NSEC records have no single upstream.
+func (g *Generator) getFromCache(key string, keyDomain string, q *dns.Question, ecs *dns.EDNS0_SUBNET, recurse bool, checkingDisabled bool, incrementHits uint64) (*dns.Msg, string, string) {
 	entry, ok := g.cache.Get(key)
 	matchType := "exact"
 	if !ok {
 		entry, ok = g.cache.Get(keyDomain)
 		if !ok {
-			return nil, ""
+			msg, matchType := g.getSynthesizedFromCache(q)
+			return msg, matchType, ""
 		}
 		if entry.qtype != q.Qtype || entry.qclass != q.Qclass {
 			matchType = "domain"
@@ -212,7 +393,7 @@ func (g *Generator) getFromCache(key string, keyDomain string, q *dns.Question,
 	if entryExpiresIn <= -g.CacheReturnStalePeriod {
 		timeSinceMiss := entryExpiresIn + g.CacheReturnStalePeriod
 		cacheStaleMisses.Observe(float64(-timeSinceMiss.Seconds()))
-		return nil, ""
+		return nil, "", ""
 	}
 
 	if entryExpiresIn <= 0 {
@@ -224,10 +405,14 @@ func (g *Generator) getFromCache(key string, keyDomain string, q *dns.Question,
 	if (entryExpiresIn <= 0 || (entryHits >= g.OpportunisticCacheMinHits && entryExpiresIn <= g.OpportunisticCacheMaxTimeLeft)) && !entry.refreshTriggered {
 		entry.refreshTriggered = true
 		go func() {
-			_, _, _, _ = g.getOrAddCache(q, recurse, true, 0)
+			_, _, _, _, _ = g.getOrAddCache(q, ecs, recurse, false, true, 0)
 		}()
 	}
 
+	if entry.bogusMsg != nil && !checkingDisabled {
+		return entry.bogusMsg.Copy(), matchType, entry.upstream
+	}
+
 	ttlAdjust := uint32(now.Sub(entry.time).Seconds())
 
 	msg := entry.msg.Copy()
@@ -239,12 +424,18 @@ func (g *Generator) getFromCache(key string, keyDomain string, q *dns.Question,
 		for _, rr := range msg.Ns {
 			g.countdownRecordTTL(rr, ttlAdjust)
 		}
+		for _, rr := range msg.Extra {
+			if rr.Header().Rrtype == dns.TypeOPT {
+				continue
+			}
+			g.countdownRecordTTL(rr, ttlAdjust)
+		}
 	}
 
-	return msg, matchType
+	return msg, matchType, entry.upstream
 }
 
-func (g *Generator) processAndWriteToCache(key string, keyDomain string, q *dns.Question, m *dns.Msg, incrementHits uint64) string {
+func (g *Generator) processAndWriteToCache(key string, keyDomain string, q *dns.Question, m *dns.Msg, bogusMsg *dns.Msg, upstream string, incrementHits uint64) string {
 	minTTL := -1
 	cacheTTL := -1
 	authTTL := -1
@@ -268,6 +459,13 @@ func (g *Generator) processAndWriteToCache(key string, keyDomain string, q *dns.
 		}
 	}
 
+	for _, rr := range m.Extra {
+		if rr.Header().Rrtype == dns.TypeOPT {
+			continue
+		}
+		g.adjustRecordTTL(rr)
+	}
+
 	if m.Rcode != dns.RcodeSuccess && m.Rcode != dns.RcodeNameError {
 		return ""
 	}
@@ -294,17 +492,23 @@ func (g *Generator) processAndWriteToCache(key string, keyDomain string, q *dns.
 		cacheTTL = g.CacheMinTTL
 	}
 
+	if bogusMsg != nil && cacheTTL > dnssecBogusTTL {
+		cacheTTL = dnssecBogusTTL
+	}
+
 	if cacheTTL == 0 {
 		return ""
 	}
 
 	now := g.CurrentTime()
 	entry := &cacheEntry{
-		time:   now,
-		expiry: now.Add(time.Duration(cacheTTL) * time.Second),
-		qtype:  q.Qtype,
-		qclass: q.Qclass,
-		msg:    m,
+		time:     now,
+		expiry:   now.Add(time.Duration(cacheTTL) * time.Second),
+		qtype:    q.Qtype,
+		qclass:   q.Qclass,
+		msg:      m,
+		bogusMsg: bogusMsg,
+		upstream: upstream,
 	}
 	entry.hits.Store(incrementHits)
 
@@ -0,0 +1,147 @@
+package resolver
+
+import (
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// CacheEntryInfo describes a cache entry for the admin API
+type CacheEntryInfo struct {
+	Name     string    `json:"name"`
+	Type     string    `json:"type"`
+	Class    string    `json:"class"`
+	Rcode    string    `json:"rcode"`
+	Cached   time.Time `json:"cached"`
+	Expiry   time.Time `json:"expiry"`
+	Stale    bool      `json:"stale"`
+	Bogus    bool      `json:"bogus"`
+	Hits     uint64    `json:"hits"`
+	Subnet   string    `json:"subnet,omitempty"`
+	Upstream string    `json:"upstream,omitempty"`
+	Records  []string  `json:"records,omitempty"`
+}
+
+// cacheKeyName returns the domain name a cache key (see cacheKey and cacheKeyDomain) belongs to
+func cacheKeyName(key string) string {
+	key, _, _ = strings.Cut(key, ecsCacheKeySeparator)
+
+	name, isDomain := strings.CutSuffix(key, ":ANY")
+	if isDomain {
+		return name
+	}
+
+	// Strip :class:type
+	for range 2 {
+		idx := strings.LastIndexByte(name, ':')
+		if idx < 0 {
+			return name
+		}
+		name = name[:idx]
+	}
+	return name
+}
+
+// CacheLen returns the number of entries in the answer cache
+func (g *Generator) CacheLen() int {
+	return g.cache.Len()
+}
+
+// matchesName checks whether name is target (or below it, with subtree)
+func matchesName(name string, target string, subtree bool) bool {
+	if subtree {
+		return dns.IsSubDomain(target, name)
+	}
+	return equalName(name, target)
+}
+
+// CacheEntries lists all cache entries for name, or for name and everything below it with subtree.
+// With records set the cached records are included as zone file lines.
+func (g *Generator) CacheEntries(name string, subtree bool, records bool) []*CacheEntryInfo {
+	name = dns.CanonicalName(name)
+	now := g.CurrentTime()
+
+	entries := make([]*CacheEntryInfo, 0)
+	for _, key := range g.cache.Keys() {
+		keyName := cacheKeyName(key)
+		if !matchesName(dns.CanonicalName(keyName), name, subtree) {
+			continue
+		}
+
+		entry, ok := g.cache.Peek(key)
+		if !ok {
+			continue
+		}
+
+		_, subnet, _ := strings.Cut(key, ecsCacheKeySeparator)
+		info := &CacheEntryInfo{
+			Subnet:   subnet,
+			Name:     keyName,
+			Type:     dns.TypeToString[entry.qtype],
+			Class:    dns.ClassToString[entry.qclass],
+			Rcode:    dns.RcodeToString[entry.msg.Rcode],
+			Cached:   entry.time,
+			Expiry:   entry.expiry,
+			Stale:    !entry.expiry.After(now),
+			Bogus:    entry.bogusMsg != nil,
+			Hits:     entry.hits.Load(),
+			Upstream: entry.upstream,
+		}
+		// NXDOMAIN entries cover all types of the name
+		if baseKey, _, _ := strings.Cut(key, ecsCacheKeySeparator); strings.HasSuffix(baseKey, ":ANY") {
+			info.Type = "ANY"
+		}
+
+		if records {
+			info.Records = make([]string, 0, len(entry.msg.Answer)+len(entry.msg.Ns))
+			for _, section := range [][]dns.RR{entry.msg.Answer, entry.msg.Ns, entry.msg.Extra} {
+				for _, rr := range section {
+					if rr.Header().Rrtype == dns.TypeOPT {
+						continue
+					}
+					info.Records = append(info.Records, rr.String())
+				}
+			}
+		}
+
+		entries = append(entries, info)
+	}
+	return entries
+}
+
+// FlushName removes all cache entries for name, or for name and everything below it with subtree.
+// Cached delegations, DNSSEC trust and NSEC ranges that could still answer for name are dropped as well.
+// Returns the number of removed answer cache entries.
+func (g *Generator) FlushName(name string, subtree bool) int {
+	name = dns.CanonicalName(name)
+
+	removed := 0
+	g.cacheWriteLock.Lock()
+	for _, key := range g.cache.Keys() {
+		if matchesName(dns.CanonicalName(cacheKeyName(key)), name, subtree) && g.cache.Remove(key) {
+			removed++
+		}
+	}
+	g.cacheWriteLock.Unlock()
+
+	for _, zone := range g.delegationCache.Keys() {
+		if matchesName(zone, name, subtree) {
+			g.delegationCache.Remove(zone)
+		}
+	}
+	for _, zone := range g.trustCache.Keys() {
+		if matchesName(zone, name, subtree) {
+			g.trustCache.Remove(zone)
+		}
+	}
+	// NSEC ranges of the enclosing zones would keep synthesizing the old negative answers
+	for _, zone := range g.nsecCache.Keys() {
+		if matchesName(zone, name, subtree) || dns.IsSubDomain(zone, name) {
+			g.nsecCache.Remove(zone)
+		}
+	}
+
+	cacheSize.Set(float64(g.cache.Len()))
+	return removed
+}
@@ -0,0 +1,91 @@
+package resolver_test
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/Doridian/foxDNS/handler"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCacheEntriesAndFlushName(t *testing.T) {
+	initTests()
+
+	for _, name := range []string{"example.com.", "nx.example.com.", "a.nx.example.com."} {
+		_, _, _, _, _, _, _ = resolverGenerator.HandleQuestion([]dns.Question{{
+			Name:   name,
+			Qtype:  dns.TypeA,
+			Qclass: dns.ClassINET,
+		}}, true, true, false, nil)
+	}
+
+	entries := resolverGenerator.CacheEntries("example.com.", false, true)
+	if assert.Len(t, entries, 1) {
+		assert.Equal(t, "example.com.", entries[0].Name)
+		assert.Equal(t, "A", entries[0].Type)
+		assert.Equal(t, "NOERROR", entries[0].Rcode)
+		assert.Len(t, entries[0].Records, 1)
+		assert.Equal(t, "127.0.0.1:12053", entries[0].Upstream)
+	}
+
+	entries = resolverGenerator.CacheEntries("EXAMPLE.com", true, false)
+	assert.Len(t, entries, 2)
+
+	removed := resolverGenerator.FlushName("nx.example.com.", true)
+	assert.Equal(t, 1, removed)
+	assert.Empty(t, resolverGenerator.CacheEntries("nx.example.com.", true, false))
+	assert.Len(t, resolverGenerator.CacheEntries("example.com.", false, false), 1)
+
+	removed = resolverGenerator.FlushName("example.com.", false)
+	assert.Equal(t, 1, removed)
+	assert.Empty(t, resolverGenerator.CacheEntries(".", true, false))
+}
+
+type resolutionRecorder struct {
+	handler.TestResponseWriter
+	cacheResult string
+	upstream    string
+}
+
+func (r *resolutionRecorder) RecordResolution(cacheResult string, upstream string) {
+	r.cacheResult = cacheResult
+	r.upstream = upstream
+}
+
+func TestResolutionRecorder(t *testing.T) {
+	initTests()
+
+	q := []dns.Question{{
+		Name:   "example.com.",
+		Qtype:  dns.TypeA,
+		Qclass: dns.ClassINET,
+	}}
+	wr := &resolutionRecorder{}
+	wr.RemoteAddrVal = &net.UDPAddr{IP: net.IPv4(127, 0, 0, 2), Port: 5053}
+
+	_, _, _, _, _, _, _ = resolverGenerator.HandleQuestion(q, true, false, false, wr)
+	assert.Equal(t, "miss", wr.cacheResult)
+	assert.Equal(t, "127.0.0.1:12053", wr.upstream)
+
+	// Cache hits report where the cached answer came from
+	_, _, _, _, _, _, _ = resolverGenerator.HandleQuestion(q, true, false, false, wr)
+	assert.Equal(t, "hit", wr.cacheResult)
+	assert.Equal(t, "127.0.0.1:12053", wr.upstream)
+
+	// Stale answers report the upstream of the entry that was served
+	resolverGenerator.CacheMaxStalePeriod = time.Minute
+	defer func() {
+		resolverGenerator.CacheMaxStalePeriod = 0
+	}()
+	fakedTime := time.Now().Add(10 * time.Second)
+	resolverGenerator.CurrentTime = func() time.Time {
+		return fakedTime
+	}
+	dummyServer.SetHandler(dns.HandlerFunc(servfailHandler))
+
+	_, _, _, _, _, _, _ = resolverGenerator.HandleQuestion(q, true, false, false, wr)
+	assert.Equal(t, "stale", wr.cacheResult)
+	assert.Equal(t, "127.0.0.1:12053", wr.upstream)
+}
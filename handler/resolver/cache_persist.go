@@ -0,0 +1,175 @@
+package resolver
+
+import (
+	"encoding/gob"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const cachePersistVersion = 2
+
+type persistedCacheEntry struct {
+	Key      string
+	Msg      []byte
+	BogusMsg []byte
+	Time     time.Time
+	Expiry   time.Time
+	Qtype    uint16
+	Qclass   uint16
+	Hits     uint64
+}
+
+type persistedCache struct {
+	Version int
+	// CacheIdentity of the generator that wrote the snapshot
+	Identity string
+	Entries  []persistedCacheEntry
+}
+
+// saveCache writes a snapshot of the cache to CachePersistFile.
+// The file is replaced atomically, so a crash while saving never leaves a truncated snapshot behind.
+func (g *Generator) saveCache() error {
+	if g.CachePersistFile == "" {
+		return nil
+	}
+
+	snapshot := persistedCache{
+		Version:  cachePersistVersion,
+		Identity: g.CacheIdentity(),
+	}
+
+	// Keys are ordered from oldest to newest, restoring them in that order keeps the LRU order intact
+	for _, key := range g.cache.Keys() {
+		entry, ok := g.cache.Peek(key)
+		if !ok {
+			continue
+		}
+
+		msgData, err := entry.msg.Pack()
+		if err != nil {
+			continue
+		}
+
+		var bogusMsgData []byte
+		if entry.bogusMsg != nil {
+			bogusMsgData, err = entry.bogusMsg.Pack()
+			if err != nil {
+				continue
+			}
+		}
+
+		snapshot.Entries = append(snapshot.Entries, persistedCacheEntry{
+			Key:      key,
+			Msg:      msgData,
+			BogusMsg: bogusMsgData,
+			Time:     entry.time,
+			Expiry:   entry.expiry,
+			Qtype:    entry.qtype,
+			Qclass:   entry.qclass,
+			Hits:     entry.hits.Load(),
+		})
+	}
+
+	tmpFile, err := os.CreateTemp(filepath.Dir(g.CachePersistFile), filepath.Base(g.CachePersistFile)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	tmpName := tmpFile.Name()
+	defer func() {
+		_ = os.Remove(tmpName)
+	}()
+
+	err = gob.NewEncoder(tmpFile).Encode(&snapshot)
+	if err != nil {
+		_ = tmpFile.Close()
+		return err
+	}
+
+	err = tmpFile.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmpName, g.CachePersistFile)
+}
+
+// loadCache restores a snapshot written by saveCache with the same CacheIdentity.
+// Entries that went stale for longer than they could still be served are discarded.
+func (g *Generator) loadCache() error {
+	if g.CachePersistFile == "" {
+		return nil
+	}
+
+	fh, err := os.Open(g.CachePersistFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = fh.Close()
+	}()
+
+	var snapshot persistedCache
+	err = gob.NewDecoder(fh).Decode(&snapshot)
+	if err != nil {
+		return err
+	}
+	if snapshot.Version != cachePersistVersion {
+		log.Printf("Ignoring resolver cache snapshot %s with unknown version %d", g.CachePersistFile, snapshot.Version)
+		return nil
+	}
+	// Entries resolved from other upstreams, trust anchors or ECS settings must not be served
+	if snapshot.Identity != g.CacheIdentity() {
+		log.Printf("Ignoring resolver cache snapshot %s written with different settings", g.CachePersistFile)
+		return nil
+	}
+
+	now := g.CurrentTime()
+	loaded := 0
+
+	g.cacheWriteLock.Lock()
+	for _, persisted := range snapshot.Entries {
+		if now.Sub(persisted.Expiry) >= g.staleKeepPeriod() {
+			continue
+		}
+
+		msg := new(dns.Msg)
+		if msg.Unpack(persisted.Msg) != nil {
+			continue
+		}
+
+		var bogusMsg *dns.Msg
+		if len(persisted.BogusMsg) > 0 {
+			bogusMsg = new(dns.Msg)
+			if bogusMsg.Unpack(persisted.BogusMsg) != nil {
+				continue
+			}
+		}
+
+		entry := &cacheEntry{
+			msg:      msg,
+			bogusMsg: bogusMsg,
+			time:     persisted.Time,
+			expiry:   persisted.Expiry,
+			qtype:    persisted.Qtype,
+			qclass:   persisted.Qclass,
+		}
+		entry.hits.Store(persisted.Hits)
+
+		g.cache.Add(persisted.Key, entry)
+		g.noteScopedCacheKey(persisted.Key)
+		loaded++
+	}
+	g.cacheWriteLock.Unlock()
+
+	cacheSize.Set(float64(g.cache.Len()))
+	log.Printf("Restored %d of %d resolver cache entries from %s", loaded, len(snapshot.Entries), g.CachePersistFile)
+	return nil
+}
@@ -0,0 +1,111 @@
+package resolver_test
+
+import (
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/Doridian/foxDNS/handler/resolver"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func newPersistingGenerator(file string) *resolver.Generator {
+	persistingGenerator := resolver.New([]*resolver.ServerConfig{
+		{
+			Addr:  "127.0.0.1:12053",
+			Proto: "udp",
+		},
+	})
+	persistingGenerator.CachePersistFile = file
+	return persistingGenerator
+}
+
+func TestCachePersistence(t *testing.T) {
+	initTests()
+
+	file := filepath.Join(t.TempDir(), "resolver.cache")
+	q := dns.Question{
+		Name:   "example.com.",
+		Qtype:  dns.TypeA,
+		Qclass: dns.ClassINET,
+	}
+
+	firstGenerator := newPersistingGenerator(file)
+	assert.NoError(t, firstGenerator.Start())
+	_, _, _, _, rcode, _, _ := firstGenerator.HandleQuestion([]dns.Question{q}, true, false, false, nil)
+	assert.Equal(t, dns.RcodeSuccess, rcode)
+	assert.NoError(t, firstGenerator.Stop())
+
+	fakedTime := time.Now().Add(time.Second * 2)
+	secondGenerator := newPersistingGenerator(file)
+	secondGenerator.CurrentTime = func() time.Time {
+		return fakedTime
+	}
+	assert.NoError(t, secondGenerator.Start())
+	defer secondGenerator.Stop()
+
+	// Without recursion only cached records can be returned
+	answer, _, _, _, rcode, _, _ := secondGenerator.HandleQuestion([]dns.Question{q}, false, false, false, nil)
+	assert.Equal(t, dns.RcodeSuccess, rcode)
+	if assert.Len(t, answer, 1) {
+		assert.Equal(t, uint32(3), answer[0].Header().Ttl)
+	}
+
+	// Entries that expired while we were down are dropped
+	fakedTime = time.Now().Add(time.Second * 10)
+	expiredGenerator := newPersistingGenerator(file)
+	expiredGenerator.CurrentTime = func() time.Time {
+		return fakedTime
+	}
+	assert.NoError(t, expiredGenerator.Start())
+	defer expiredGenerator.Stop()
+
+	_, _, _, _, rcode, _, _ = expiredGenerator.HandleQuestion([]dns.Question{q}, false, false, false, nil)
+	assert.Equal(t, dns.RcodeServerFailure, rcode)
+}
+
+func TestCachePersistenceIgnoresOtherIdentity(t *testing.T) {
+	initTests()
+
+	file := filepath.Join(t.TempDir(), "resolver.cache")
+	q := dns.Question{
+		Name:   "example.com.",
+		Qtype:  dns.TypeA,
+		Qclass: dns.ClassINET,
+	}
+
+	firstGenerator := newPersistingGenerator(file)
+	assert.NoError(t, firstGenerator.Start())
+	_, _, _, _, rcode, _, _ := firstGenerator.HandleQuestion([]dns.Question{q}, true, false, false, nil)
+	assert.Equal(t, dns.RcodeSuccess, rcode)
+	assert.NoError(t, firstGenerator.Stop())
+
+	// The snapshot was resolved without client subnets, it must not be restored with them
+	secondGenerator := newPersistingGenerator(file)
+	secondGenerator.ClientSubnet = true
+	assert.NoError(t, secondGenerator.Start())
+	defer secondGenerator.Stop()
+
+	_, _, _, _, rcode, _, _ = secondGenerator.HandleQuestion([]dns.Question{q}, false, false, false, nil)
+	assert.Equal(t, dns.RcodeServerFailure, rcode)
+}
+
+func TestRestartDoesNotLeakGoroutines(t *testing.T) {
+	initTests()
+
+	generator := newPersistingGenerator(filepath.Join(t.TempDir(), "resolver.cache"))
+	generator.CachePersistInterval = time.Hour
+	assert.NoError(t, generator.Start())
+	before := runtime.NumGoroutine()
+
+	for range 20 {
+		assert.NoError(t, generator.Start())
+	}
+	assert.NoError(t, generator.Stop())
+
+	assert.Eventually(t, func() bool {
+		return runtime.NumGoroutine() < before
+	}, time.Second, 10*time.Millisecond)
+}
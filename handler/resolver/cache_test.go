@@ -5,6 +5,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/Doridian/foxDNS/handler/resolver"
 	"github.com/miekg/dns"
 	"github.com/stretchr/testify/assert"
 )
@@ -23,7 +24,7 @@ func TestExistingRecordWithCache(t *testing.T) {
 		Qtype:  dns.TypeA,
 		Qclass: dns.ClassINET,
 	}
-	answer, ns, _, rcode, _ := resolverGenerator.HandleQuestion([]dns.Question{q}, true, true, nil)
+	answer, ns, _, _, rcode, _, _ := resolverGenerator.HandleQuestion([]dns.Question{q}, true, true, false, nil)
 
 	assert.Equal(t, dns.RcodeSuccess, rcode)
 	assert.ElementsMatch(t, []dns.RR{
@@ -46,7 +47,7 @@ func TestExistingRecordWithCache(t *testing.T) {
 	// Fake time 0.8 seconds ahead to test TTL countdown not tripping just yet
 	fakedTime = timeBegin.Add(800 * time.Millisecond)
 
-	answer, ns, _, rcode, _ = resolverGenerator.HandleQuestion([]dns.Question{q}, true, true, nil)
+	answer, ns, _, _, rcode, _, _ = resolverGenerator.HandleQuestion([]dns.Question{q}, true, true, false, nil)
 
 	assert.Equal(t, dns.RcodeSuccess, rcode)
 	assert.ElementsMatch(t, []dns.RR{
@@ -66,7 +67,7 @@ func TestExistingRecordWithCache(t *testing.T) {
 	// Fake time 3.1 seconds ahead to test TTL countdown
 	fakedTime = timeBegin.Add(3100 * time.Millisecond)
 
-	answer, ns, _, rcode, _ = resolverGenerator.HandleQuestion([]dns.Question{q}, true, true, nil)
+	answer, ns, _, _, rcode, _, _ = resolverGenerator.HandleQuestion([]dns.Question{q}, true, true, false, nil)
 	assert.Equal(t, dns.RcodeSuccess, rcode)
 	assert.ElementsMatch(t, []dns.RR{
 		&dns.A{
@@ -85,7 +86,7 @@ func TestExistingRecordWithCache(t *testing.T) {
 	// Fake time 6 seconds ahead to force record to be uncached
 	fakedTime = timeBegin.Add(6 * time.Second)
 
-	answer, ns, _, rcode, _ = resolverGenerator.HandleQuestion([]dns.Question{q}, true, true, nil)
+	answer, ns, _, _, rcode, _, _ = resolverGenerator.HandleQuestion([]dns.Question{q}, true, true, false, nil)
 
 	assert.Equal(t, dns.RcodeSuccess, rcode)
 	assert.ElementsMatch(t, []dns.RR{}, answer)
@@ -110,3 +111,61 @@ func TestExistingRecordWithCache(t *testing.T) {
 
 	resolverGenerator.CurrentTime = time.Now
 }
+
+func TestTakeCacheFrom(t *testing.T) {
+	initTests()
+
+	q := dns.Question{
+		Name:   "example.com.",
+		Qtype:  dns.TypeA,
+		Qclass: dns.ClassINET,
+	}
+
+	_, _, _, _, rcode, _, _ := resolverGenerator.HandleQuestion([]dns.Question{q}, true, false, false, nil)
+	assert.Equal(t, dns.RcodeSuccess, rcode)
+
+	newGenerator := resolver.New([]*resolver.ServerConfig{
+		{
+			Addr:  "127.0.0.1:12053",
+			Proto: "udp",
+		},
+	})
+	assert.Equal(t, resolverGenerator.CacheIdentity(), newGenerator.CacheIdentity())
+	newGenerator.TakeCacheFrom(resolverGenerator)
+
+	// Without recursion only cached records can be returned
+	answer, _, _, _, rcode, _, _ := newGenerator.HandleQuestion([]dns.Question{q}, false, false, false, nil)
+	assert.Equal(t, dns.RcodeSuccess, rcode)
+	assert.Len(t, answer, 1)
+}
+
+func TestCacheIdentityCoversTrustAnchorsAndClientSubnet(t *testing.T) {
+	newGenerator := func() *resolver.Generator {
+		return resolver.New([]*resolver.ServerConfig{
+			{
+				Addr:  "127.0.0.1:12053",
+				Proto: "udp",
+			},
+		})
+	}
+	base := newGenerator().CacheIdentity()
+	assert.Equal(t, base, newGenerator().CacheIdentity())
+
+	anchored := newGenerator()
+	assert.NoError(t, anchored.SetTrustAnchors([]string{"example.com. IN DS 12345 13 2 0000000000000000000000000000000000000000000000000000000000000000"}))
+	assert.NotEqual(t, base, anchored.CacheIdentity())
+
+	withECS := newGenerator()
+	withECS.ClientSubnet = true
+	assert.NotEqual(t, base, withECS.CacheIdentity())
+
+	withPrefix := newGenerator()
+	withPrefix.ClientSubnet = true
+	withPrefix.ClientSubnetPrefixV4 = 16
+	assert.NotEqual(t, withECS.CacheIdentity(), withPrefix.CacheIdentity())
+
+	withOverride := newGenerator()
+	withOverride.ClientSubnet = true
+	_, withOverride.ClientSubnetOverride, _ = net.ParseCIDR("192.0.2.0/24")
+	assert.NotEqual(t, withECS.CacheIdentity(), withOverride.CacheIdentity())
+}
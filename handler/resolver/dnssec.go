@@ -0,0 +1,828 @@
+package resolver
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+type dnssecState int
+
+const (
+	dnssecIndeterminate dnssecState = iota
+	dnssecInsecure
+	dnssecSecure
+	dnssecBogus
+)
+
+func (s dnssecState) String() string {
+	switch s {
+	case dnssecInsecure:
+		return "insecure"
+	case dnssecSecure:
+		return "secure"
+	case dnssecBogus:
+		return "bogus"
+	}
+	return "indeterminate"
+}
+
+const dnssecMinTrustTTL = 30
+const dnssecMaxTrustTTL = 3600
+const dnssecBogusTTL = 60
+
+// The root zone KSKs, as published in https://data.iana.org/root-anchors/root-anchors.xml
+var defaultTrustAnchors = []string{
+	". IN DS 20326 8 2 E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D",
+	". IN DS 38696 8 2 683D2D0ACB8C9B712A1948B27F741219298D0A450D612C483AF444A4C0FB2B16",
+}
+
+var (
+	dnssecResults = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "foxdns_resolver_dnssec_results_total",
+		Help: "The total number of DNSSEC validation results of upstream replies",
+	}, []string{"result"})
+)
+
+// zoneTrust is the validated state of a zone, for secure zones this includes the keys
+// that were authenticated through the chain of trust from a trust anchor
+type zoneTrust struct {
+	zone   string
+	state  dnssecState
+	keys   []*dns.DNSKEY
+	reason *dns.EDNS0_EDE
+	expiry time.Time
+}
+
+type signedRRset struct {
+	name    string
+	rrtype  uint16
+	records []dns.RR
+	sigs    []*dns.RRSIG
+}
+
+func dnssecError(code uint16, format string, args ...any) *dns.EDNS0_EDE {
+	return &dns.EDNS0_EDE{
+		InfoCode:  code,
+		ExtraText: fmt.Sprintf(format, args...),
+	}
+}
+
+func parseTrustAnchors(anchors []string) (map[string][]*dns.DS, error) {
+	parsed := make(map[string][]*dns.DS)
+	for _, anchor := range anchors {
+		rr, err := dns.NewRR(anchor)
+		if err != nil {
+			return nil, err
+		}
+
+		var ds *dns.DS
+		switch typedRR := rr.(type) {
+		case *dns.DS:
+			ds = typedRR
+		case *dns.DNSKEY:
+			ds = typedRR.ToDS(dns.SHA256)
+		}
+		if ds == nil {
+			return nil, fmt.Errorf("trust anchor must be a DS or DNSKEY record: %s", anchor)
+		}
+
+		zone := dns.CanonicalName(ds.Hdr.Name)
+		parsed[zone] = append(parsed[zone], ds)
+	}
+	return parsed, nil
+}
+
+// SetTrustAnchors replaces the trust anchors used for DNSSEC validation.
+// Each anchor is a DS or DNSKEY record in zone file presentation format.
+func (g *Generator) SetTrustAnchors(anchors []string) error {
+	parsed, err := parseTrustAnchors(anchors)
+	if err != nil {
+		return err
+	}
+	g.trustAnchors = parsed
+	g.trustCache.Purge()
+	return nil
+}
+
+func dnssecAlgorithmSupported(algorithm uint8) bool {
+	switch algorithm {
+	case dns.RSASHA1, dns.RSASHA1NSEC3SHA1, dns.RSASHA256, dns.RSASHA512, dns.ECDSAP256SHA256, dns.ECDSAP384SHA384, dns.ED25519:
+		return true
+	}
+	return false
+}
+
+func dsDigestSupported(digestType uint8) bool {
+	switch digestType {
+	case dns.SHA1, dns.SHA256, dns.SHA384:
+		return true
+	}
+	return false
+}
+
+func equalName(a string, b string) bool {
+	return strings.EqualFold(dns.Fqdn(a), dns.Fqdn(b))
+}
+
+func typeInBitmap(bitmap []uint16, rrtype uint16) bool {
+	for _, t := range bitmap {
+		if t == rrtype {
+			return true
+		}
+	}
+	return false
+}
+
+func groupRRsets(section []dns.RR) []*signedRRset {
+	sets := make([]*signedRRset, 0, len(section))
+	setIndex := make(map[string]*signedRRset)
+
+	for _, rr := range section {
+		rrHdr := rr.Header()
+		rrtype := rrHdr.Rrtype
+		sig, isSig := rr.(*dns.RRSIG)
+		if isSig {
+			rrtype = sig.TypeCovered
+		} else if rrtype == dns.TypeOPT {
+			continue
+		}
+
+		name := dns.CanonicalName(rrHdr.Name)
+		key := fmt.Sprintf("%s:%d", name, rrtype)
+		set := setIndex[key]
+		if set == nil {
+			set = &signedRRset{
+				name:   name,
+				rrtype: rrtype,
+			}
+			setIndex[key] = set
+			sets = append(sets, set)
+		}
+
+		if isSig {
+			set.sigs = append(set.sigs, sig)
+		} else {
+			set.records = append(set.records, rr)
+		}
+	}
+
+	result := sets[:0]
+	for _, set := range sets {
+		if len(set.records) > 0 {
+			result = append(result, set)
+		}
+	}
+	return result
+}
+
+func minRecordTTL(records []dns.RR) uint32 {
+	var minTTL uint32 = dnssecMaxTrustTTL
+	for _, rr := range records {
+		if ttl := rr.Header().Ttl; ttl < minTTL {
+			minTTL = ttl
+		}
+	}
+	return minTTL
+}
+
+func (g *Generator) newZoneTrust(zone string, state dnssecState, ttl uint32) *zoneTrust {
+	if ttl < dnssecMinTrustTTL {
+		ttl = dnssecMinTrustTTL
+	} else if ttl > dnssecMaxTrustTTL {
+		ttl = dnssecMaxTrustTTL
+	}
+
+	return &zoneTrust{
+		zone:   zone,
+		state:  state,
+		expiry: g.CurrentTime().Add(time.Duration(ttl) * time.Second),
+	}
+}
+
+func (g *Generator) bogusZoneTrust(zone string, reason *dns.EDNS0_EDE) *zoneTrust {
+	trust := g.newZoneTrust(zone, dnssecBogus, dnssecBogusTTL)
+	trust.reason = reason
+	return trust
+}
+
+func (g *Generator) fetchDNSSECRecords(name string, qtype uint16) (*dns.Msg, error) {
+	// This deliberately bypasses the answer cache, the trust cache takes its place
+	msg, _, err := g.resolve(&dns.Question{
+		Name:   name,
+		Qtype:  qtype,
+		Qclass: dns.ClassINET,
+	}, nil)
+	return msg, err
+}
+
+func (g *Generator) cachedZoneTrust(name string) *zoneTrust {
+	trust, ok := g.trustCache.Get(name)
+	if !ok || g.CurrentTime().After(trust.expiry) {
+		return nil
+	}
+	return trust
+}
+
+func (g *Generator) closestTrustAnchor(name string) (string, []*dns.DS) {
+	for zone := name; ; zone = parentName(zone) {
+		if anchors := g.trustAnchors[zone]; len(anchors) > 0 {
+			return zone, anchors
+		}
+		if zone == "." {
+			return "", nil
+		}
+	}
+}
+
+// zoneTrustFor walks the chain of trust from the closest trust anchor down to name
+// and returns the state of the closest enclosing zone
+func (g *Generator) zoneTrustFor(name string) *zoneTrust {
+	name = dns.CanonicalName(name)
+	if trust := g.cachedZoneTrust(name); trust != nil {
+		return trust
+	}
+
+	anchorZone, anchors := g.closestTrustAnchor(name)
+	if anchors == nil {
+		return &zoneTrust{
+			zone:  ".",
+			state: dnssecInsecure,
+		}
+	}
+
+	trust := g.cachedZoneTrust(anchorZone)
+	if trust == nil {
+		trust = g.anchorZoneTrust(anchorZone, anchors)
+		g.trustCache.Add(anchorZone, trust)
+	}
+
+	labels := dns.Split(name)
+	for i := len(labels) - dns.CountLabel(anchorZone) - 1; i >= 0 && trust.state == dnssecSecure; i-- {
+		child := name[labels[i]:]
+		if cached := g.cachedZoneTrust(child); cached != nil {
+			trust = cached
+			continue
+		}
+		trust = g.childZoneTrust(trust, child)
+		g.trustCache.Add(child, trust)
+	}
+
+	return trust
+}
+
+func (g *Generator) anchorZoneTrust(zone string, anchors []*dns.DS) *zoneTrust {
+	resp, err := g.fetchDNSSECRecords(zone, dns.TypeDNSKEY)
+	if err != nil {
+		return g.bogusZoneTrust(zone, dnssecError(dns.ExtendedErrorCodeDNSKEYMissing, "failed to fetch DNSKEY for %s: %v", zone, err))
+	}
+	return g.verifyZoneKeys(zone, resp, anchors)
+}
+
+// verifyZoneKeys authenticates the DNSKEY RRset of zone using the given DS records
+func (g *Generator) verifyZoneKeys(zone string, resp *dns.Msg, dsSet []*dns.DS) *zoneTrust {
+	var keySet []dns.RR
+	var sigs []*dns.RRSIG
+	var zoneKeys []*dns.DNSKEY
+	for _, rr := range resp.Answer {
+		if !equalName(rr.Header().Name, zone) {
+			continue
+		}
+		switch typedRR := rr.(type) {
+		case *dns.DNSKEY:
+			keySet = append(keySet, typedRR)
+			if typedRR.Flags&dns.ZONE != 0 && typedRR.Flags&dns.REVOKE == 0 {
+				zoneKeys = append(zoneKeys, typedRR)
+			}
+		case *dns.RRSIG:
+			if typedRR.TypeCovered == dns.TypeDNSKEY {
+				sigs = append(sigs, typedRR)
+			}
+		}
+	}
+
+	if len(keySet) == 0 {
+		return g.bogusZoneTrust(zone, dnssecError(dns.ExtendedErrorCodeDNSKEYMissing, "no DNSKEY records for %s", zone))
+	}
+	if len(zoneKeys) == 0 {
+		return g.bogusZoneTrust(zone, dnssecError(dns.ExtendedErrorCodeNoZoneKeyBitSet, "no zone keys for %s", zone))
+	}
+
+	supported := false
+	reason := dnssecError(dns.ExtendedErrorCodeDNSKEYMissing, "no DNSKEY for %s matches its DS records", zone)
+	for _, ds := range dsSet {
+		if !dnssecAlgorithmSupported(ds.Algorithm) || !dsDigestSupported(ds.DigestType) {
+			continue
+		}
+		supported = true
+
+		for _, key := range zoneKeys {
+			if key.Algorithm != ds.Algorithm || key.KeyTag() != ds.KeyTag {
+				continue
+			}
+			keyDS := key.ToDS(ds.DigestType)
+			if keyDS == nil || !strings.EqualFold(keyDS.Digest, ds.Digest) {
+				continue
+			}
+
+			sigReason := g.verifySignatures(sigs, []*dns.DNSKEY{key}, keySet)
+			if sigReason != nil {
+				reason = sigReason
+				continue
+			}
+
+			trust := g.newZoneTrust(zone, dnssecSecure, minRecordTTL(keySet))
+			trust.keys = zoneKeys
+			return trust
+		}
+	}
+
+	if !supported {
+		// RFC 4035 section 5.2: zones only signed with unsupported algorithms are treated as insecure
+		return g.newZoneTrust(zone, dnssecInsecure, minRecordTTL(keySet))
+	}
+	return g.bogusZoneTrust(zone, reason)
+}
+
+// childZoneTrust determines whether child is a zone cut below parent and, if so, whether it is signed
+func (g *Generator) childZoneTrust(parent *zoneTrust, child string) *zoneTrust {
+	resp, err := g.fetchDNSSECRecords(child, dns.TypeDS)
+	if err != nil {
+		return g.bogusZoneTrust(child, dnssecError(dns.ExtendedErrorCodeDNSSECIndeterminate, "failed to fetch DS for %s: %v", child, err))
+	}
+
+	if resp.Rcode == dns.RcodeNameError {
+		// The name does not exist, the denial itself is checked when validating the answer
+		return parent
+	}
+	if resp.Rcode != dns.RcodeSuccess {
+		return g.bogusZoneTrust(child, dnssecError(dns.ExtendedErrorCodeDNSSECIndeterminate, "failed to fetch DS for %s: %s", child, dns.RcodeToString[resp.Rcode]))
+	}
+
+	var dsRecords []dns.RR
+	var dsSet []*dns.DS
+	var sigs []*dns.RRSIG
+	for _, rr := range resp.Answer {
+		if !equalName(rr.Header().Name, child) {
+			continue
+		}
+		switch typedRR := rr.(type) {
+		case *dns.DS:
+			dsRecords = append(dsRecords, typedRR)
+			dsSet = append(dsSet, typedRR)
+		case *dns.RRSIG:
+			if typedRR.TypeCovered == dns.TypeDS {
+				sigs = append(sigs, typedRR)
+			}
+		case *dns.CNAME:
+			// An alias can never be a zone cut
+			return parent
+		}
+	}
+
+	if len(dsSet) > 0 {
+		reason := g.verifySignatures(sigs, parent.keys, dsRecords)
+		if reason != nil {
+			return g.bogusZoneTrust(child, reason)
+		}
+
+		keyResp, err := g.fetchDNSSECRecords(child, dns.TypeDNSKEY)
+		if err != nil {
+			return g.bogusZoneTrust(child, dnssecError(dns.ExtendedErrorCodeDNSKEYMissing, "failed to fetch DNSKEY for %s: %v", child, err))
+		}
+		return g.verifyZoneKeys(child, keyResp, dsSet)
+	}
+
+	// No DS records, so the parent has to prove either that there is no zone cut or that the delegation is unsigned
+	var nsecs []*dns.NSEC
+	var nsec3s []*dns.NSEC3
+	for _, set := range groupRRsets(resp.Ns) {
+		if set.rrtype != dns.TypeNSEC && set.rrtype != dns.TypeNSEC3 {
+			continue
+		}
+		reason := g.verifySignatures(set.sigs, parent.keys, set.records)
+		if reason != nil {
+			return g.bogusZoneTrust(child, reason)
+		}
+		for _, rr := range set.records {
+			switch typedRR := rr.(type) {
+			case *dns.NSEC:
+				nsecs = append(nsecs, typedRR)
+			case *dns.NSEC3:
+				nsec3s = append(nsec3s, typedRR)
+			}
+		}
+	}
+
+	for _, nsec := range nsecs {
+		if equalName(nsec.Hdr.Name, child) {
+			if typeInBitmap(nsec.TypeBitMap, dns.TypeNS) && !typeInBitmap(nsec.TypeBitMap, dns.TypeSOA) {
+				return g.newZoneTrust(child, dnssecInsecure, nsec.Hdr.Ttl)
+			}
+			return parent
+		}
+		if nsecCovers(nsec, child) && dns.IsSubDomain(child, dns.CanonicalName(nsec.NextDomain)) {
+			// Empty non-terminal
+			return parent
+		}
+	}
+
+	for _, nsec3 := range nsec3s {
+		if nsec3.Match(child) {
+			if typeInBitmap(nsec3.TypeBitMap, dns.TypeNS) && !typeInBitmap(nsec3.TypeBitMap, dns.TypeSOA) {
+				return g.newZoneTrust(child, dnssecInsecure, nsec3.Hdr.Ttl)
+			}
+			return parent
+		}
+	}
+	for _, nsec3 := range nsec3s {
+		if nsec3.Flags&1 != 0 && nsec3.Cover(child) {
+			// Opt-out span, any delegation in here is unsigned
+			return g.newZoneTrust(child, dnssecInsecure, nsec3.Hdr.Ttl)
+		}
+	}
+
+	return g.bogusZoneTrust(child, dnssecError(dns.ExtendedErrorCodeNSECMissing, "no proof of missing DS for %s", child))
+}
+
+func (g *Generator) verifySignatures(sigs []*dns.RRSIG, keys []*dns.DNSKEY, records []dns.RR) *dns.EDNS0_EDE {
+	name := records[0].Header().Name
+	rrtype := dns.TypeToString[records[0].Header().Rrtype]
+	if len(sigs) == 0 {
+		return dnssecError(dns.ExtendedErrorCodeRRSIGsMissing, "no signatures for %s/%s", name, rrtype)
+	}
+
+	now := g.CurrentTime()
+	reason := dnssecError(dns.ExtendedErrorCodeDNSBogus, "no usable key for signatures of %s/%s", name, rrtype)
+	for _, sig := range sigs {
+		for _, key := range keys {
+			if key.Algorithm != sig.Algorithm || key.KeyTag() != sig.KeyTag || !equalName(key.Hdr.Name, sig.SignerName) {
+				continue
+			}
+
+			if !sig.ValidityPeriod(now) {
+				if now.Before(time.Unix(int64(sig.Inception), 0)) {
+					reason = dnssecError(dns.ExtendedErrorCodeSignatureNotYetValid, "signature for %s/%s not yet valid", name, rrtype)
+				} else {
+					reason = dnssecError(dns.ExtendedErrorCodeSignatureExpired, "signature for %s/%s expired", name, rrtype)
+				}
+				continue
+			}
+
+			err := sig.Verify(key, records)
+			if err != nil {
+				reason = dnssecError(dns.ExtendedErrorCodeDNSBogus, "invalid signature for %s/%s: %v", name, rrtype, err)
+				continue
+			}
+			return nil
+		}
+	}
+	return reason
+}
+
+func (g *Generator) validateRRset(set *signedRRset) (dnssecState, *dns.EDNS0_EDE) {
+	trustName := set.name
+	if set.rrtype == dns.TypeDS {
+		// DS records live in (and are signed by) the parent zone
+		trustName = parentName(set.name)
+	}
+
+	reason := dnssecError(dns.ExtendedErrorCodeDNSBogus, "no usable signer for %s/%s", set.name, dns.TypeToString[set.rrtype])
+	for _, sig := range set.sigs {
+		signer := dns.CanonicalName(sig.SignerName)
+		if !dns.IsSubDomain(signer, trustName) {
+			continue
+		}
+
+		trust := g.zoneTrustFor(signer)
+		switch trust.state {
+		case dnssecBogus:
+			reason = trust.reason
+			continue
+		case dnssecInsecure:
+			return dnssecInsecure, nil
+		}
+		if trust.zone != signer {
+			continue
+		}
+
+		sigReason := g.verifySignatures([]*dns.RRSIG{sig}, trust.keys, set.records)
+		if sigReason == nil {
+			return dnssecSecure, nil
+		}
+		reason = sigReason
+	}
+
+	trust := g.zoneTrustFor(trustName)
+	switch trust.state {
+	case dnssecInsecure:
+		return dnssecInsecure, nil
+	case dnssecBogus:
+		return dnssecBogus, trust.reason
+	}
+	if len(set.sigs) == 0 {
+		return dnssecBogus, dnssecError(dns.ExtendedErrorCodeRRSIGsMissing, "no signatures for %s/%s", set.name, dns.TypeToString[set.rrtype])
+	}
+	return dnssecBogus, reason
+}
+
+// canonicalCompare orders names as defined in RFC 4034 section 6.1
+func canonicalCompare(a string, b string) int {
+	aLabels := dns.SplitDomainName(strings.ToLower(a))
+	bLabels := dns.SplitDomainName(strings.ToLower(b))
+
+	for i := 1; i <= len(aLabels) && i <= len(bLabels); i++ {
+		cmp := strings.Compare(aLabels[len(aLabels)-i], bLabels[len(bLabels)-i])
+		if cmp != 0 {
+			return cmp
+		}
+	}
+	return len(aLabels) - len(bLabels)
+}
+
+func nsecCovers(nsec *dns.NSEC, name string) bool {
+	owner := nsec.Hdr.Name
+	next := nsec.NextDomain
+	if canonicalCompare(owner, next) < 0 {
+		return canonicalCompare(owner, name) < 0 && canonicalCompare(name, next) < 0
+	}
+	// Last NSEC in the zone, wrapping around to the apex
+	return canonicalCompare(owner, name) < 0 || canonicalCompare(name, next) < 0
+}
+
+// nsecClosestEncloser returns the closest encloser of name according to an NSEC record covering it
+func nsecClosestEncloser(name string, nsec *dns.NSEC) string {
+	closestEncloser := commonAncestor(name, dns.CanonicalName(nsec.Hdr.Name))
+	if nextAncestor := commonAncestor(name, dns.CanonicalName(nsec.NextDomain)); dns.CountLabel(nextAncestor) > dns.CountLabel(closestEncloser) {
+		closestEncloser = nextAncestor
+	}
+	return closestEncloser
+}
+
+func nsecCovered(name string, nsecs []*dns.NSEC) bool {
+	for _, nsec := range nsecs {
+		if nsecCovers(nsec, name) {
+			return true
+		}
+	}
+	return false
+}
+
+func nsec3Covered(name string, nsec3s []*dns.NSEC3, requireOptOut bool) bool {
+	for _, nsec3 := range nsec3s {
+		if nsec3.Cover(name) && (!requireOptOut || nsec3.Flags&1 != 0) {
+			return true
+		}
+	}
+	return false
+}
+
+// ancestorName returns the ancestor of name with the given number of labels
+func ancestorName(name string, labels int) string {
+	idx := dns.Split(name)
+	if labels <= 0 {
+		return "."
+	}
+	if labels >= len(idx) {
+		return name
+	}
+	return name[idx[len(idx)-labels]:]
+}
+
+// wildcardAt returns the wildcard directly below closestEncloser
+func wildcardAt(closestEncloser string) string {
+	if closestEncloser == "." {
+		return "*."
+	}
+	return "*." + closestEncloser
+}
+
+// nsec3ClosestEncloser returns the closest encloser of name, proven by an NSEC3 matching it
+// and one covering the next closer name (RFC 5155 section 8.3)
+func nsec3ClosestEncloser(name string, nsec3s []*dns.NSEC3, requireOptOut bool) (string, bool) {
+	labels := dns.CountLabel(name)
+	for i := labels - 1; i >= 0; i-- {
+		closestEncloser := ancestorName(name, i)
+		for _, match := range nsec3s {
+			if match.Match(closestEncloser) {
+				return closestEncloser, nsec3Covered(ancestorName(name, i+1), nsec3s, requireOptOut)
+			}
+		}
+	}
+	return "", false
+}
+
+// proveNameError checks that neither name nor the wildcard that could have been expanded for it exist
+// (RFC 4035 section 5.4, RFC 5155 section 8.4)
+func proveNameError(name string, nsecs []*dns.NSEC, nsec3s []*dns.NSEC3) bool {
+	for _, nsec := range nsecs {
+		if nsecCovers(nsec, name) && nsecCovered(wildcardAt(nsecClosestEncloser(name, nsec)), nsecs) {
+			return true
+		}
+	}
+
+	closestEncloser, ok := nsec3ClosestEncloser(name, nsec3s, false)
+	return ok && nsec3Covered(wildcardAt(closestEncloser), nsec3s, false)
+}
+
+// wildcardClosestEncloser returns the closest encloser of the wildcard set was expanded from, if any
+func wildcardClosestEncloser(set *signedRRset) (string, bool) {
+	ownerLabels := dns.CountLabel(set.name)
+	if strings.HasPrefix(set.name, "*.") {
+		ownerLabels--
+	}
+
+	labels := ownerLabels
+	for _, sig := range set.sigs {
+		labels = min(labels, int(sig.Labels))
+	}
+	if labels == ownerLabels {
+		return "", false
+	}
+	return ancestorName(set.name, labels), true
+}
+
+// proveWildcardExpansion checks that an answer for name expanded from the wildcard at closestEncloser
+// could not have come from a closer match (RFC 4035 section 5.3.4, RFC 5155 section 8.8)
+func proveWildcardExpansion(name string, closestEncloser string, nsecs []*dns.NSEC, nsec3s []*dns.NSEC3) bool {
+	for _, nsec := range nsecs {
+		if nsecCovers(nsec, name) && equalName(nsecClosestEncloser(name, nsec), closestEncloser) {
+			return true
+		}
+	}
+
+	return nsec3Covered(ancestorName(name, dns.CountLabel(closestEncloser)+1), nsec3s, false)
+}
+
+func proveDenial(name string, qtype uint16, nameError bool, nsecs []*dns.NSEC, nsec3s []*dns.NSEC3) bool {
+	if nameError {
+		return proveNameError(name, nsecs, nsec3s)
+	}
+
+	for _, nsec := range nsecs {
+		if equalName(nsec.Hdr.Name, name) {
+			return !typeInBitmap(nsec.TypeBitMap, qtype) && !typeInBitmap(nsec.TypeBitMap, dns.TypeCNAME)
+		}
+		if nsecCovers(nsec, name) && dns.IsSubDomain(name, dns.CanonicalName(nsec.NextDomain)) {
+			// Empty non-terminal
+			return true
+		}
+	}
+
+	for _, nsec3 := range nsec3s {
+		if nsec3.Match(name) {
+			return !typeInBitmap(nsec3.TypeBitMap, qtype) && !typeInBitmap(nsec3.TypeBitMap, dns.TypeCNAME)
+		}
+	}
+	// RFC 5155 section 8.6: DS queries for unsigned delegations in an opt-out span
+	_, ok := nsec3ClosestEncloser(name, nsec3s, true)
+	return qtype == dns.TypeDS && ok
+}
+
+func replyTarget(q *dns.Question, msg *dns.Msg) (string, bool) {
+	target := q.Name
+	if q.Qtype != dns.TypeCNAME {
+		for range len(msg.Answer) {
+			found := false
+			for _, rr := range msg.Answer {
+				cname, ok := rr.(*dns.CNAME)
+				if ok && equalName(cname.Hdr.Name, target) {
+					target = dns.CanonicalName(cname.Target)
+					found = true
+					break
+				}
+			}
+			if !found {
+				break
+			}
+		}
+	}
+
+	for _, rr := range msg.Answer {
+		rrHdr := rr.Header()
+		if equalName(rrHdr.Name, target) && (rrHdr.Rrtype == q.Qtype || q.Qtype == dns.TypeANY) {
+			return target, true
+		}
+	}
+	return target, false
+}
+
+func (g *Generator) validateResponse(q *dns.Question, msg *dns.Msg) (dnssecState, *dns.EDNS0_EDE) {
+	if msg.Rcode != dns.RcodeSuccess && msg.Rcode != dns.RcodeNameError {
+		return dnssecIndeterminate, nil
+	}
+
+	state := dnssecSecure
+	var nsecs []*dns.NSEC
+	var nsec3s []*dns.NSEC3
+	var wildcardSets []*signedRRset
+
+	for _, set := range groupRRsets(msg.Answer) {
+		setState, reason := g.validateRRset(set)
+		if setState == dnssecBogus {
+			return dnssecBogus, reason
+		}
+		if setState != dnssecSecure {
+			state = dnssecInsecure
+		} else if _, ok := wildcardClosestEncloser(set); ok {
+			wildcardSets = append(wildcardSets, set)
+		}
+	}
+
+	for _, set := range groupRRsets(msg.Ns) {
+		switch set.rrtype {
+		case dns.TypeSOA, dns.TypeNSEC, dns.TypeNSEC3, dns.TypeDS:
+		default:
+			continue
+		}
+
+		setState, reason := g.validateRRset(set)
+		if setState == dnssecBogus {
+			return dnssecBogus, reason
+		}
+		if setState != dnssecSecure {
+			state = dnssecInsecure
+			continue
+		}
+
+		for _, rr := range set.records {
+			switch typedRR := rr.(type) {
+			case *dns.NSEC:
+				nsecs = append(nsecs, typedRR)
+			case *dns.NSEC3:
+				nsec3s = append(nsec3s, typedRR)
+			}
+		}
+	}
+
+	for _, set := range wildcardSets {
+		closestEncloser, _ := wildcardClosestEncloser(set)
+		if !proveWildcardExpansion(set.name, closestEncloser, nsecs, nsec3s) {
+			return dnssecBogus, dnssecError(dns.ExtendedErrorCodeNSECMissing, "no proof that %s/%s is not closer than %s", set.name, dns.TypeToString[set.rrtype], wildcardAt(closestEncloser))
+		}
+	}
+
+	target, answered := replyTarget(q, msg)
+	if answered && msg.Rcode == dns.RcodeSuccess {
+		return state, nil
+	}
+
+	trustName := target
+	if q.Qtype == dns.TypeDS {
+		trustName = parentName(target)
+	}
+	trust := g.zoneTrustFor(trustName)
+	switch trust.state {
+	case dnssecBogus:
+		return dnssecBogus, trust.reason
+	case dnssecInsecure:
+		return dnssecInsecure, nil
+	}
+
+	if !proveDenial(target, q.Qtype, msg.Rcode == dns.RcodeNameError, nsecs, nsec3s) {
+		return dnssecBogus, dnssecError(dns.ExtendedErrorCodeNSECMissing, "no valid denial of existence for %s/%s", target, dns.TypeToString[q.Qtype])
+	}
+	return state, nil
+}
+
+// validateReply sets the AD bit on msg if it validated as secure,
+// if it is bogus a SERVFAIL reply to send instead is returned
+func (g *Generator) validateReply(q *dns.Question, msg *dns.Msg) *dns.Msg {
+	msg.AuthenticatedData = false
+	if !g.DNSSECValidation {
+		return nil
+	}
+
+	state, reason := g.validateResponse(q, msg)
+	dnssecResults.WithLabelValues(state.String()).Inc()
+
+	if state == dnssecSecure {
+		msg.AuthenticatedData = true
+	}
+	if state != dnssecBogus {
+		return nil
+	}
+
+	if g.LogFailures {
+		log.Printf("DNSSEC validation failed for %s[%s]: %s", q.Name, dns.TypeToString[q.Qtype], reason.ExtraText)
+	}
+
+	return &dns.Msg{
+		MsgHdr: dns.MsgHdr{
+			Rcode: dns.RcodeServerFailure,
+		},
+		Extra: []dns.RR{
+			&dns.OPT{
+				Hdr: dns.RR_Header{
+					Rrtype: dns.TypeOPT,
+				},
+				Option: []dns.EDNS0{reason},
+			},
+		},
+	}
+}
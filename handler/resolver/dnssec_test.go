@@ -0,0 +1,268 @@
+package resolver_test
+
+import (
+	"crypto"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Doridian/foxDNS/handler/resolver"
+	"github.com/Doridian/foxDNS/util"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+type signedTestZone struct {
+	key     *dns.DNSKEY
+	privkey crypto.Signer
+}
+
+func newSignedTestZone() *signedTestZone {
+	key := &dns.DNSKEY{
+		Flags:     257,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}
+	util.FillHeader(key, "example.com.", dns.TypeDNSKEY, 300)
+	privkey, err := key.Generate(256)
+	if err != nil {
+		panic(err)
+	}
+
+	return &signedTestZone{
+		key:     key,
+		privkey: privkey.(crypto.Signer),
+	}
+}
+
+func (z *signedTestZone) sign(rrs ...dns.RR) []dns.RR {
+	rrHdr := rrs[0].Header()
+	sig := &dns.RRSIG{
+		TypeCovered: rrHdr.Rrtype,
+		Algorithm:   z.key.Algorithm,
+		Labels:      uint8(dns.CountLabel(rrHdr.Name)),
+		OrigTtl:     rrHdr.Ttl,
+		Expiration:  uint32(time.Now().Add(time.Hour).Unix()),
+		Inception:   uint32(time.Now().Add(-time.Hour).Unix()),
+		KeyTag:      z.key.KeyTag(),
+		SignerName:  "example.com.",
+	}
+	util.FillHeader(sig, rrHdr.Name, dns.TypeRRSIG, rrHdr.Ttl)
+	err := sig.Sign(z.privkey, rrs)
+	if err != nil {
+		panic(err)
+	}
+	return append(rrs, sig)
+}
+
+// signWildcard signs rr as if it was expanded from the wildcard *.example.com.
+func (z *signedTestZone) signWildcard(name string, rr dns.RR) []dns.RR {
+	rr.Header().Name = "*.example.com."
+	signed := z.sign(rr)
+	for _, signedRR := range signed {
+		signedRR.Header().Name = name
+	}
+	return signed
+}
+
+func (z *signedTestZone) nsec(owner string, next string, types ...uint16) []dns.RR {
+	nsec := &dns.NSEC{
+		NextDomain: next,
+		TypeBitMap: append(types, dns.TypeRRSIG, dns.TypeNSEC),
+	}
+	return z.sign(util.FillHeader(nsec, owner, dns.TypeNSEC, 300))
+}
+
+func nsec3Hash(name string) string {
+	return dns.HashName(name, dns.SHA1, 0, "")
+}
+
+func (z *signedTestZone) nsec3(ownerHash string, nextHash string, types ...uint16) []dns.RR {
+	nsec3 := &dns.NSEC3{
+		Hash:       dns.SHA1,
+		SaltLength: 0,
+		Salt:       "",
+		HashLength: 20,
+		NextDomain: nextHash,
+		TypeBitMap: types,
+	}
+	return z.sign(util.FillHeader(nsec3, ownerHash+".example.com.", dns.TypeNSEC3, 300))
+}
+
+// nsec3NameError proves the closest encloser example.com. and covers the next closer name,
+// the wildcard *.example.com. is only covered if coverWildcard is set
+func (z *signedTestZone) nsec3NameError(name string, coverWildcard bool) []dns.RR {
+	// Ranges end before their next hash, so this never covers the wildcard
+	wildcardHash := nsec3Hash("*.example.com.")
+	records := z.nsec3(nsec3Hash("example.com."), wildcardHash, dns.TypeNS, dns.TypeSOA, dns.TypeRRSIG, dns.TypeDNSKEY)
+
+	low := strings.Repeat("0", 32)
+	high := strings.Repeat("V", 32)
+	if !coverWildcard {
+		// Appending to the wildcard hash gives the smallest owner name after it
+		if nsec3Hash(name) < wildcardHash {
+			high = wildcardHash
+		} else {
+			low = wildcardHash + "0"
+		}
+	}
+	return append(records, z.nsec3(low, high)...)
+}
+
+func (z *signedTestZone) ServeDNS(wr dns.ResponseWriter, msg *dns.Msg) {
+	reply := &dns.Msg{}
+	reply.SetReply(msg)
+
+	q := msg.Question[0]
+	aRec := util.FillHeader(&dns.A{A: net.IPv4(10, 13, 37, 0)}, q.Name, dns.TypeA, 300)
+
+	switch {
+	case q.Qtype == dns.TypeDNSKEY && q.Name == "example.com.":
+		reply.Answer = z.sign(z.key)
+	case q.Qtype == dns.TypeA && q.Name == "example.com.":
+		reply.Answer = z.sign(aRec)
+	case q.Qtype == dns.TypeA && q.Name == "bad.example.com.":
+		reply.Answer = z.sign(aRec)
+		aRec.(*dns.A).A = net.IPv4(10, 13, 37, 1)
+	case q.Qtype == dns.TypeA && q.Name == "unsigned.example.com.":
+		reply.Answer = []dns.RR{aRec}
+	case q.Name == "nowildcard.example.com.":
+		// Covers the name, but not the wildcard
+		reply.Ns = z.nsec("m.example.com.", "p.example.com.", dns.TypeA)
+		reply.Rcode = dns.RcodeNameError
+	case q.Name == "nsec3.example.com." || q.Name == "nsec3-nowildcard.example.com.":
+		reply.Ns = z.nsec3NameError(q.Name, q.Name == "nsec3.example.com.")
+		reply.Rcode = dns.RcodeNameError
+	case q.Name == "wildcard.example.com.":
+		reply.Answer = z.signWildcard(q.Name, aRec)
+		reply.Ns = z.nsec("*.example.com.", "zzz.example.com.", dns.TypeA)
+	case q.Name == "wildcard-nsec3.example.com.":
+		reply.Answer = z.signWildcard(q.Name, aRec)
+		reply.Ns = z.nsec3NameError(q.Name, true)[2:]
+	case q.Name == "wildcard-noproof.example.com.":
+		reply.Answer = z.signWildcard(q.Name, aRec)
+	case q.Name == "bad.example.com." || q.Name == "unsigned.example.com.":
+		nsec := &dns.NSEC{
+			NextDomain: "zzz.example.com.",
+			TypeBitMap: []uint16{dns.TypeA, dns.TypeRRSIG, dns.TypeNSEC},
+		}
+		reply.Ns = z.sign(util.FillHeader(nsec, q.Name, dns.TypeNSEC, 300))
+	default:
+		nsec := &dns.NSEC{
+			NextDomain: "zzz.example.com.",
+			TypeBitMap: []uint16{dns.TypeA, dns.TypeNS, dns.TypeSOA, dns.TypeRRSIG, dns.TypeNSEC, dns.TypeDNSKEY},
+		}
+		soa := &dns.SOA{
+			Ns:     "ns1.example.com.",
+			Mbox:   "hostmaster.example.com.",
+			Serial: 1,
+			Minttl: 300,
+		}
+		reply.Ns = append(z.sign(util.FillHeader(soa, "example.com.", dns.TypeSOA, 300)), z.sign(util.FillHeader(nsec, "example.com.", dns.TypeNSEC, 300))...)
+		reply.Rcode = dns.RcodeNameError
+	}
+
+	_ = wr.WriteMsg(reply)
+}
+
+func queryValidating(t *testing.T, name string, checkingDisabled bool) ([]dns.RR, []dns.EDNS0, int, bool) {
+	initTests()
+	zone := newSignedTestZone()
+	dummyServer.SetHandler(zone)
+	defer dummyServer.SetHandler(simpleHandler)
+
+	validatingGenerator := resolver.New([]*resolver.ServerConfig{
+		{
+			Addr:  "127.0.0.1:12053",
+			Proto: "udp",
+		},
+	})
+	validatingGenerator.DNSSECValidation = true
+	err := validatingGenerator.SetTrustAnchors([]string{zone.key.ToDS(dns.SHA256).String()})
+	assert.NoError(t, err)
+
+	answer, _, _, edns0, rcode, authenticatedData, _ := validatingGenerator.HandleQuestion([]dns.Question{{
+		Name:   name,
+		Qtype:  dns.TypeA,
+		Qclass: dns.ClassINET,
+	}}, true, true, checkingDisabled, nil)
+	return answer, edns0, rcode, authenticatedData
+}
+
+func assertEDE(t *testing.T, edns0 []dns.EDNS0, code uint16) {
+	if assert.Len(t, edns0, 1) {
+		ede, ok := edns0[0].(*dns.EDNS0_EDE)
+		assert.True(t, ok)
+		assert.Equal(t, code, ede.InfoCode)
+	}
+}
+
+func TestDNSSECSecureAnswer(t *testing.T) {
+	answer, _, rcode, authenticatedData := queryValidating(t, "example.com.", false)
+	assert.Equal(t, dns.RcodeSuccess, rcode)
+	assert.True(t, authenticatedData)
+	assert.Len(t, answer, 2)
+}
+
+func TestDNSSECSecureNXDOMAIN(t *testing.T) {
+	_, _, rcode, authenticatedData := queryValidating(t, "nx.example.com.", false)
+	assert.Equal(t, dns.RcodeNameError, rcode)
+	assert.True(t, authenticatedData)
+}
+
+func TestDNSSECBogusSignature(t *testing.T) {
+	answer, edns0, rcode, authenticatedData := queryValidating(t, "bad.example.com.", false)
+	assert.Equal(t, dns.RcodeServerFailure, rcode)
+	assert.False(t, authenticatedData)
+	assert.Empty(t, answer)
+	assertEDE(t, edns0, dns.ExtendedErrorCodeDNSBogus)
+}
+
+func TestDNSSECMissingSignature(t *testing.T) {
+	_, edns0, rcode, _ := queryValidating(t, "unsigned.example.com.", false)
+	assert.Equal(t, dns.RcodeServerFailure, rcode)
+	assertEDE(t, edns0, dns.ExtendedErrorCodeRRSIGsMissing)
+}
+
+func TestDNSSECCheckingDisabled(t *testing.T) {
+	answer, edns0, rcode, authenticatedData := queryValidating(t, "bad.example.com.", true)
+	assert.Equal(t, dns.RcodeSuccess, rcode)
+	assert.False(t, authenticatedData)
+	assert.Empty(t, edns0)
+	assert.Len(t, answer, 2)
+}
+
+func TestDNSSECNXDOMAINNeedsWildcardProof(t *testing.T) {
+	_, edns0, rcode, authenticatedData := queryValidating(t, "nowildcard.example.com.", false)
+	assert.Equal(t, dns.RcodeServerFailure, rcode)
+	assert.False(t, authenticatedData)
+	assertEDE(t, edns0, dns.ExtendedErrorCodeNSECMissing)
+}
+
+func TestDNSSECNSEC3NXDOMAIN(t *testing.T) {
+	_, _, rcode, authenticatedData := queryValidating(t, "nsec3.example.com.", false)
+	assert.Equal(t, dns.RcodeNameError, rcode)
+	assert.True(t, authenticatedData)
+
+	_, edns0, rcode, authenticatedData := queryValidating(t, "nsec3-nowildcard.example.com.", false)
+	assert.Equal(t, dns.RcodeServerFailure, rcode)
+	assert.False(t, authenticatedData)
+	assertEDE(t, edns0, dns.ExtendedErrorCodeNSECMissing)
+}
+
+func TestDNSSECWildcardAnswer(t *testing.T) {
+	for _, name := range []string{"wildcard.example.com.", "wildcard-nsec3.example.com."} {
+		answer, _, rcode, authenticatedData := queryValidating(t, name, false)
+		assert.Equal(t, dns.RcodeSuccess, rcode, name)
+		assert.True(t, authenticatedData, name)
+		assert.Len(t, answer, 2, name)
+	}
+
+	// Without proof that the name does not exist, the wildcard might have been used to hide it
+	answer, edns0, rcode, authenticatedData := queryValidating(t, "wildcard-noproof.example.com.", false)
+	assert.Equal(t, dns.RcodeServerFailure, rcode)
+	assert.False(t, authenticatedData)
+	assert.Empty(t, answer)
+	assertEDE(t, edns0, dns.ExtendedErrorCodeNSECMissing)
+}
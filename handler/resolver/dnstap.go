@@ -0,0 +1,77 @@
+package resolver
+
+import (
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/Doridian/foxDNS/dnstap"
+	"github.com/miekg/dns"
+)
+
+func dnstapProtocol(proto string) dnstap.SocketProtocol {
+	switch proto {
+	case "tcp":
+		return dnstap.ProtocolTCP
+	case "tcp-tls":
+		return dnstap.ProtocolDoT
+	case "https":
+		return dnstap.ProtocolDoH
+	default:
+		return dnstap.ProtocolUDP
+	}
+}
+
+// dnstapAddr returns nil for servers not given as IP:port, like DoH URLs
+func dnstapAddr(addr string) net.Addr {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil
+	}
+	ip := net.ParseIP(host)
+	port, err := strconv.Atoi(portStr)
+	if ip == nil || err != nil {
+		return nil
+	}
+	return &net.TCPAddr{IP: ip, Port: port}
+}
+
+// logDnstap logs an upstream query and, if there was one, its response
+func logDnstap(queryType dnstap.MessageType, proto string, addr string, m *dns.Msg, queryTime time.Time, resp *dns.Msg) {
+	if !dnstap.UpstreamEnabled() {
+		return
+	}
+
+	queryData, err := m.Pack()
+	if err != nil {
+		return
+	}
+	serverAddr := dnstapAddr(addr)
+	protocol := dnstapProtocol(proto)
+
+	dnstap.Log(&dnstap.Message{
+		Type:         queryType,
+		Protocol:     protocol,
+		ResponseAddr: serverAddr,
+		QueryTime:    queryTime,
+		QueryMessage: queryData,
+	})
+
+	if resp == nil {
+		return
+	}
+	respData, err := resp.Pack()
+	if err != nil {
+		return
+	}
+	// Response types directly follow their query types
+	dnstap.Log(&dnstap.Message{
+		Type:            queryType + 1,
+		Protocol:        protocol,
+		ResponseAddr:    serverAddr,
+		QueryTime:       queryTime,
+		QueryMessage:    queryData,
+		ResponseTime:    time.Now(),
+		ResponseMessage: respData,
+	})
+}
@@ -0,0 +1,192 @@
+package resolver
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/Doridian/foxDNS/util"
+	"github.com/miekg/dns"
+)
+
+const (
+	ecsFamilyIPv4 = 1
+	ecsFamilyIPv6 = 2
+
+	ecsCacheKeySeparator = "|ecs="
+)
+
+// ecsScopes remembers which scope prefix lengths upstream servers answered with,
+// so lookups only have to try those instead of every possible prefix length
+type ecsScopes struct {
+	lock sync.RWMutex
+	seen map[uint16][]uint8
+}
+
+func newClientSubnet(ip net.IP, prefix uint8) *dns.EDNS0_SUBNET {
+	family := uint16(ecsFamilyIPv6)
+	bits := 128
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+		family = ecsFamilyIPv4
+		bits = 32
+	}
+	if int(prefix) > bits {
+		prefix = uint8(bits)
+	}
+
+	return &dns.EDNS0_SUBNET{
+		Code:          dns.EDNS0SUBNET,
+		Family:        family,
+		SourceNetmask: prefix,
+		SourceScope:   0,
+		Address:       ip.Mask(net.CIDRMask(int(prefix), bits)),
+	}
+}
+
+func (g *Generator) clientSubnetPrefix(ip net.IP) uint8 {
+	if ip.To4() != nil {
+		return g.ClientSubnetPrefixV4
+	}
+	return g.ClientSubnetPrefixV6
+}
+
+// upstreamClientSubnet returns the EDNS Client Subnet option to send upstream for a query from wr (RFC 7871), or nil
+func (g *Generator) upstreamClientSubnet(wr util.Addressable) *dns.EDNS0_SUBNET {
+	if !g.ClientSubnet || g.Iterative {
+		return nil
+	}
+
+	if g.ClientSubnetOverride != nil {
+		prefix, _ := g.ClientSubnetOverride.Mask.Size()
+		return newClientSubnet(g.ClientSubnetOverride.IP, uint8(prefix))
+	}
+
+	if wr == nil {
+		return nil
+	}
+
+	if clientSubnet := util.GetClientSubnet(wr); clientSubnet != nil && !g.ClientSubnetStripClient {
+		// A source prefix of 0 asks us not to reveal anything about the client
+		if clientSubnet.SourceNetmask == 0 || clientSubnet.Address == nil {
+			return nil
+		}
+		return newClientSubnet(clientSubnet.Address, min(clientSubnet.SourceNetmask, g.clientSubnetPrefix(clientSubnet.Address)))
+	}
+
+	ip := util.ExtractIP(wr.RemoteAddr())
+	if ip == nil || ip.IsUnspecified() || util.IPIsPrivateOrLocal(ip) {
+		return nil
+	}
+	return newClientSubnet(ip, g.clientSubnetPrefix(ip))
+}
+
+// responseScope returns the scope prefix length resp applies to, 0 meaning it is valid for every client
+func responseScope(ecs *dns.EDNS0_SUBNET, resp *dns.Msg) uint8 {
+	if ecs == nil {
+		return 0
+	}
+
+	respSubnet := util.FindClientSubnet(resp)
+	if respSubnet == nil || respSubnet.Family != ecs.Family || !respSubnet.Address.Equal(ecs.Address) {
+		return 0
+	}
+	// Answers can never be more specific than what we told the upstream
+	return min(respSubnet.SourceScope, ecs.SourceNetmask)
+}
+
+func scopedCacheKey(key string, ecs *dns.EDNS0_SUBNET, scope uint8) string {
+	bits := 128
+	if ecs.Family == ecsFamilyIPv4 {
+		bits = 32
+	}
+	return fmt.Sprintf("%s%s%s/%d", key, ecsCacheKeySeparator, ecs.Address.Mask(net.CIDRMask(int(scope), bits)), scope)
+}
+
+func (g *Generator) noteECSScope(family uint16, scope uint8) {
+	g.ecsScopes.lock.RLock()
+	known := slices.Contains(g.ecsScopes.seen[family], scope)
+	g.ecsScopes.lock.RUnlock()
+	if known {
+		return
+	}
+
+	g.ecsScopes.lock.Lock()
+	defer g.ecsScopes.lock.Unlock()
+	if slices.Contains(g.ecsScopes.seen[family], scope) {
+		return
+	}
+	// Sorted longest first, the most specific answer wins
+	scopes := append(g.ecsScopes.seen[family], scope)
+	slices.SortFunc(scopes, func(a uint8, b uint8) int {
+		return int(b) - int(a)
+	})
+	g.ecsScopes.seen[family] = scopes
+}
+
+// noteScopedCacheKey learns the scope of a cache key restored from somewhere else
+func (g *Generator) noteScopedCacheKey(key string) {
+	_, subnet, found := strings.Cut(key, ecsCacheKeySeparator)
+	if !found {
+		return
+	}
+
+	addr, scopeStr, found := strings.Cut(subnet, "/")
+	if !found {
+		return
+	}
+	ip := net.ParseIP(addr)
+	scope, err := strconv.ParseUint(scopeStr, 10, 8)
+	if ip == nil || err != nil {
+		return
+	}
+
+	family := uint16(ecsFamilyIPv6)
+	if ip.To4() != nil {
+		family = ecsFamilyIPv4
+	}
+	g.noteECSScope(family, uint8(scope))
+}
+
+// clientCacheKey returns the most specific cache key for key that exists for a client in ecs
+func (g *Generator) clientCacheKey(key string, ecs *dns.EDNS0_SUBNET) string {
+	if ecs == nil {
+		return key
+	}
+
+	g.ecsScopes.lock.RLock()
+	scopes := g.ecsScopes.seen[ecs.Family]
+	g.ecsScopes.lock.RUnlock()
+
+	for _, scope := range scopes {
+		if scope > ecs.SourceNetmask {
+			continue
+		}
+		scopedKey := scopedCacheKey(key, ecs, scope)
+		if g.cache.Contains(scopedKey) {
+			return scopedKey
+		}
+	}
+	return key
+}
+
+// replyClientSubnet builds the EDNS Client Subnet option for the reply to a client that sent clientSubnet
+func (g *Generator) replyClientSubnet(clientSubnet *dns.EDNS0_SUBNET, upstreamReply *dns.Msg) *dns.EDNS0_SUBNET {
+	scope := uint8(0)
+	if g.ClientSubnet && g.ClientSubnetOverride == nil && !g.ClientSubnetStripClient {
+		if upstreamSubnet := util.FindClientSubnet(upstreamReply); upstreamSubnet != nil {
+			scope = min(upstreamSubnet.SourceScope, clientSubnet.SourceNetmask)
+		}
+	}
+
+	return &dns.EDNS0_SUBNET{
+		Code:          dns.EDNS0SUBNET,
+		Family:        clientSubnet.Family,
+		SourceNetmask: clientSubnet.SourceNetmask,
+		SourceScope:   scope,
+		Address:       clientSubnet.Address,
+	}
+}
@@ -0,0 +1,133 @@
+package resolver_test
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+
+	"github.com/Doridian/foxDNS/handler/resolver"
+	"github.com/Doridian/foxDNS/util"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+type subnetAddressable struct {
+	util.DummyAddressable
+	subnet *dns.EDNS0_SUBNET
+}
+
+func (a *subnetAddressable) ClientSubnet() *dns.EDNS0_SUBNET {
+	return a.subnet
+}
+
+// subnetHandler answers with the first address of the client subnet it was sent, scoped to that subnet
+func subnetHandler(queries *atomic.Int32) dns.HandlerFunc {
+	return func(wr dns.ResponseWriter, msg *dns.Msg) {
+		queries.Add(1)
+
+		reply := &dns.Msg{}
+		reply.SetReply(msg)
+
+		ip := net.IPv4(10, 0, 0, 0)
+		var options []dns.EDNS0
+		if subnet := util.FindClientSubnet(msg); subnet != nil {
+			ip = subnet.Address
+			options = append(options, &dns.EDNS0_SUBNET{
+				Code:          dns.EDNS0SUBNET,
+				Family:        subnet.Family,
+				SourceNetmask: subnet.SourceNetmask,
+				SourceScope:   subnet.SourceNetmask,
+				Address:       subnet.Address,
+			})
+		}
+
+		reply.Answer = []dns.RR{util.FillHeader(&dns.A{A: ip}, msg.Question[0].Name, dns.TypeA, 300)}
+		util.SetEDNS0(reply, options, 0, false)
+		_ = wr.WriteMsg(reply)
+	}
+}
+
+func newSubnetGenerator(t *testing.T) (*resolver.Generator, *atomic.Int32) {
+	initTests()
+	queries := &atomic.Int32{}
+	dummyServer.SetHandler(subnetHandler(queries))
+	t.Cleanup(func() {
+		dummyServer.SetHandler(simpleHandler)
+	})
+
+	subnetGenerator := resolver.New([]*resolver.ServerConfig{
+		{
+			Addr:  "127.0.0.1:12053",
+			Proto: "udp",
+		},
+	})
+	subnetGenerator.ClientSubnet = true
+	return subnetGenerator, queries
+}
+
+func querySubnet(subnetGenerator *resolver.Generator, wr util.Addressable) (net.IP, []dns.EDNS0) {
+	answer, _, _, edns0, _, _, _ := subnetGenerator.HandleQuestion([]dns.Question{{
+		Name:   "example.com.",
+		Qtype:  dns.TypeA,
+		Qclass: dns.ClassINET,
+	}}, true, false, false, wr)
+	if len(answer) != 1 {
+		return nil, edns0
+	}
+	return answer[0].(*dns.A).A, edns0
+}
+
+func clientAt(ip net.IP) *util.DummyAddressable {
+	return &util.DummyAddressable{
+		RemoteAddress: &net.UDPAddr{IP: ip, Port: 12345},
+	}
+}
+
+func TestClientSubnetScopedCache(t *testing.T) {
+	subnetGenerator, queries := newSubnetGenerator(t)
+
+	ip, _ := querySubnet(subnetGenerator, clientAt(net.IPv4(198, 51, 100, 7)))
+	assert.Equal(t, "198.51.100.0", ip.String())
+
+	ip, _ = querySubnet(subnetGenerator, clientAt(net.IPv4(203, 0, 113, 9)))
+	assert.Equal(t, "203.0.113.0", ip.String())
+	assert.Equal(t, int32(2), queries.Load())
+
+	// Same /24 as the first client, so this comes from cache
+	ip, _ = querySubnet(subnetGenerator, clientAt(net.IPv4(198, 51, 100, 200)))
+	assert.Equal(t, "198.51.100.0", ip.String())
+	assert.Equal(t, int32(2), queries.Load())
+
+	// Private addresses are never sent upstream
+	ip, _ = querySubnet(subnetGenerator, clientAt(net.IPv4(192, 168, 1, 1)))
+	assert.Equal(t, "10.0.0.0", ip.String())
+	assert.Equal(t, int32(3), queries.Load())
+}
+
+func TestClientSubnetFromClient(t *testing.T) {
+	subnetGenerator, _ := newSubnetGenerator(t)
+
+	client := &subnetAddressable{
+		DummyAddressable: *clientAt(net.IPv4(192, 168, 1, 1)),
+		subnet: &dns.EDNS0_SUBNET{
+			Code:          dns.EDNS0SUBNET,
+			Family:        1,
+			SourceNetmask: 28,
+			Address:       net.IPv4(198, 51, 100, 16).To4(),
+		},
+	}
+
+	// The client subnet is truncated to /24 before it is sent upstream
+	ip, edns0 := querySubnet(subnetGenerator, client)
+	assert.Equal(t, "198.51.100.0", ip.String())
+	if assert.Len(t, edns0, 1) {
+		replySubnet := edns0[0].(*dns.EDNS0_SUBNET)
+		assert.Equal(t, uint8(28), replySubnet.SourceNetmask)
+		assert.Equal(t, uint8(24), replySubnet.SourceScope)
+	}
+
+	subnetGenerator.ClientSubnetStripClient = true
+	subnetGenerator.FlushCache()
+	ip, _ = querySubnet(subnetGenerator, client)
+	assert.Equal(t, "10.0.0.0", ip.String())
+}
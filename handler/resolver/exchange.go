@@ -1,11 +1,13 @@
 package resolver
 
 import (
+	"context"
 	"encoding/hex"
 	"errors"
 	"log"
 	"time"
 
+	"github.com/Doridian/foxDNS/dnstap"
 	"github.com/Doridian/foxDNS/util"
 	"github.com/miekg/dns"
 	"github.com/prometheus/client_golang/prometheus"
@@ -25,21 +27,65 @@ var (
 	}, []string{"server"})
 )
 
-func (g *Generator) exchange(info *querySlotInfo, m *dns.Msg) (resp *dns.Msg, err error) {
-	startTime := g.CurrentTime()
-	m.Id = dns.Id()
-	resp, _, err = info.server.client.ExchangeWithConn(m, info.conn)
+func (g *Generator) exchange(ctx context.Context, info *querySlotInfo, m *dns.Msg) (resp *dns.Msg, err error) {
+	// Latency is measured with the real clock, CurrentTime may be faked
+	queryTime := time.Now()
+	if info.server.httpClient != nil {
+		resp, err = exchangeHTTPS(ctx, info.server, m)
+	} else if info.server.usesPipeline() {
+		resp, err = exchangePipelined(ctx, info.server, m)
+	} else {
+		m.Id = dns.Id()
+		resp, _, err = info.server.client.ExchangeWithConn(m, info.conn)
+	}
 
 	if err == nil {
-		duration := time.Since(startTime)
+		duration := time.Since(queryTime)
 		upstreamQueryTime.WithLabelValues(info.server.Addr).Observe(duration.Seconds())
+		info.server.recordRTT(duration)
 	}
+
+	logDnstap(dnstap.MessageForwarderQuery, info.server.Proto, info.server.Addr, m, queryTime, resp)
 	return
 }
 
+// resolve also returns the upstream server that answered
+func (g *Generator) resolve(q *dns.Question, ecs *dns.EDNS0_SUBNET) (*dns.Msg, string, error) {
+	if g.Iterative {
+		msg, err := g.resolveIterative(q)
+		return msg, iterativeServerLabel, err
+	}
+	if g.RaceCount > 1 || g.HedgeDelay > 0 {
+		return g.exchangeHedged(q, ecs)
+	}
+	return g.exchangeWithRetry(context.Background(), q, ecs, nil)
+}
+
 var ErrCookieMismatch = errors.New("client cookie returned from server invalid")
 
-func (g *Generator) exchangeWithRetry(q *dns.Question) (resp *dns.Msg, err error) {
+// exchangeContext aborts the exchange once ctx is cancelled.
+// The connection of an aborted exchange can not be reused, as its deadline has been reset.
+func (g *Generator) exchangeContext(ctx context.Context, info *querySlotInfo, m *dns.Msg) (*dns.Msg, error) {
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	if info.conn == nil {
+		return g.exchange(ctx, info, m)
+	}
+
+	stop := context.AfterFunc(ctx, func() {
+		_ = info.conn.SetDeadline(time.Now())
+	})
+	resp, err := g.exchange(ctx, info, m)
+	if !stop() {
+		return nil, ctx.Err()
+	}
+	return resp, err
+}
+
+// exchangeWithRetry sends q to upstream servers until one answers or all attempts are used up.
+// Parallel branches of a race share race, so they query different servers while there are enough.
+func (g *Generator) exchangeWithRetry(ctx context.Context, q *dns.Question, ecs *dns.EDNS0_SUBNET, race *raceServers) (resp *dns.Msg, upstream string, err error) {
 	var info *querySlotInfo
 	keepConn := false
 
@@ -47,26 +93,40 @@ func (g *Generator) exchangeWithRetry(q *dns.Question) (resp *dns.Msg, err error
 		if info != nil && !keepConn {
 			g.returnQuerySlot(info, err)
 			upstreamQueryErrors.WithLabelValues(info.server.Addr).Inc()
+			info.server.recordError()
 			info = nil
 			err = nil
-			time.Sleep(g.RetryWait)
+
+			select {
+			case <-ctx.Done():
+				return nil, "", ctx.Err()
+			case <-time.After(g.RetryWait):
+			}
 		}
 
 		keepConn = false
 		if info == nil {
-			info, err = g.acquireQuerySlot(currentTry)
+			info, err = g.acquireQuerySlot(currentTry, race)
 		}
 
 		if err != nil {
 			continue
 		}
 
+		upstreamQ := *q
+		caseRandomised := g.QNameCaseRandomisation && info.server.usesFreshSocket()
+		if caseRandomised {
+			upstreamQ.Name = randomiseCase(q.Name)
+		}
+
 		m := &dns.Msg{
 			Compress: true,
-			Question: []dns.Question{*q},
+			Question: []dns.Question{upstreamQ},
 			MsgHdr: dns.MsgHdr{
 				Opcode:           dns.OpcodeQuery,
 				RecursionDesired: true,
+				// We validate ourselves, so we also want to see bogus data
+				CheckingDisabled: g.DNSSECValidation,
 			},
 		}
 
@@ -77,19 +137,32 @@ func (g *Generator) exchangeWithRetry(q *dns.Question) (resp *dns.Msg, err error
 			continue
 		}
 
-		edns0Opts := make([]dns.EDNS0, 0, 1)
-		if info.server.RequireCookie || !util.IsSecureProtocol(info.conn) {
+		edns0Opts := make([]dns.EDNS0, 0, 2)
+		if info.server.RequireCookie || !info.isSecure() {
 			edns0Opts = append(edns0Opts, &dns.EDNS0_COOKIE{
 				Code:   dns.EDNS0COOKIE,
 				Cookie: hex.EncodeToString(append(clientCookie, info.serverCookie...)),
 			})
 		}
+		if ecs != nil {
+			edns0Opts = append(edns0Opts, ecs)
+		}
 		util.SetEDNS0(m, edns0Opts, g.shouldPadLen, true)
 
-		resp, err = g.exchange(info, m)
+		resp, err = g.exchangeContext(ctx, info, m)
+		if errors.Is(err, context.Canceled) {
+			g.returnQuerySlot(info, err)
+			return nil, "", err
+		}
+		if err != nil {
+			continue
+		}
+
+		err = checkResponseQuestion(info.server.Addr, m, resp, caseRandomised)
 		if err != nil {
 			continue
 		}
+		restoreQuestionCase(resp, upstreamQ.Name, q.Name)
 
 		cookieMatch := false
 		if serverEDNS0 := resp.IsEdns0(); serverEDNS0 != nil && serverEDNS0.Version() == 0 {
@@ -119,6 +192,7 @@ func (g *Generator) exchangeWithRetry(q *dns.Question) (resp *dns.Msg, err error
 		}
 
 		if !cookieMatch && info.server.RequireCookie {
+			upstreamSpoofedResponses.WithLabelValues(info.server.Addr, "cookie").Inc()
 			err = ErrCookieMismatch
 			continue
 		}
@@ -130,10 +204,14 @@ func (g *Generator) exchangeWithRetry(q *dns.Question) (resp *dns.Msg, err error
 		}
 
 		g.returnQuerySlot(info, nil)
+		upstream = info.server.Addr
 		return
 	}
 
 	g.returnQuerySlot(info, err)
+	if err != nil && info != nil {
+		info.server.recordError()
+	}
 
 	if g.LogFailures && (err != nil || resp == nil || resp.Rcode == dns.RcodeServerFailure) {
 		rcodeStr := ""
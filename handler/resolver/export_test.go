@@ -0,0 +1,6 @@
+package resolver
+
+// SetNameserverPort makes iterative resolution query delegated nameservers on port instead of 53
+func (g *Generator) SetNameserverPort(port string) {
+	g.nameserverPort = port
+}
@@ -0,0 +1,65 @@
+package resolver
+
+import (
+	"math/rand"
+	"sort"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Weight of the newest sample in the RTT moving average
+const rttEWMAWeight = 0.2
+
+var (
+	upstreamRTTEWMA = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "foxdns_resolver_upstream_rtt_ewma_seconds",
+		Help: "Exponentially weighted moving average of upstream resolver RTTs, including error penalties",
+	}, []string{"server"})
+)
+
+func (s *ServerConfig) recordRTT(sample time.Duration) {
+	s.rttLock.Lock()
+	if s.rttEWMA <= 0 {
+		s.rttEWMA = sample
+	} else {
+		s.rttEWMA = time.Duration(rttEWMAWeight*float64(sample) + (1-rttEWMAWeight)*float64(s.rttEWMA))
+	}
+	rtt := s.rttEWMA
+	s.rttLock.Unlock()
+
+	upstreamRTTEWMA.WithLabelValues(s.Addr).Set(rtt.Seconds())
+}
+
+// recordError counts a failed query as if it had taken the full timeout
+func (s *ServerConfig) recordError() {
+	s.recordRTT(s.timeout())
+}
+
+func (s *ServerConfig) getRTT() time.Duration {
+	s.rttLock.Lock()
+	defer s.rttLock.Unlock()
+	return s.rttEWMA
+}
+
+// fastestServers orders servers by their RTT average, retries start at the next fastest one.
+// Servers without any samples yet are preferred, and every now and then a random server comes first
+// so that recovered servers get a chance to lower their average again.
+func (g *Generator) fastestServers(currentTry int) []*ServerConfig {
+	if currentTry == 1 && rand.Float64() < g.FastestExploreRate {
+		return randomServers(g.Servers)
+	}
+
+	servers := make([]*ServerConfig, len(g.Servers))
+	copy(servers, g.Servers)
+	rtts := make(map[*ServerConfig]time.Duration, len(servers))
+	for _, server := range servers {
+		rtts[server] = server.getRTT()
+	}
+	sort.SliceStable(servers, func(i, j int) bool {
+		return rtts[servers[i]] < rtts[servers[j]]
+	})
+
+	return rotateServers(servers, currentTry-1)
+}
@@ -0,0 +1,44 @@
+package resolver_test
+
+import (
+	"testing"
+
+	"github.com/Doridian/foxDNS/handler/resolver"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFastestStrategyAvoidsFailingServer(t *testing.T) {
+	initTests()
+
+	fastestGenerator := resolver.New([]*resolver.ServerConfig{
+		{
+			// Nothing listens here, so every query fails
+			Addr:  "127.0.0.1:1",
+			Proto: "udp",
+		},
+		{
+			Addr:  "127.0.0.1:12053",
+			Proto: "udp",
+		},
+	})
+	fastestGenerator.ServerStrategy = resolver.StrategyFastest
+	fastestGenerator.FastestExploreRate = 0
+	fastestGenerator.Attempts = 1
+
+	q := dns.Question{
+		Name:   "example.com.",
+		Qtype:  dns.TypeA,
+		Qclass: dns.ClassINET,
+	}
+
+	// Neither server has any samples yet, so the first one is tried first
+	_, _, _, _, rcode, _, _ := fastestGenerator.HandleQuestion([]dns.Question{q}, true, false, false, nil)
+	assert.Equal(t, dns.RcodeServerFailure, rcode)
+
+	for i := 0; i < 5; i++ {
+		fastestGenerator.FlushCache()
+		_, _, _, _, rcode, _, _ = fastestGenerator.HandleQuestion([]dns.Question{q}, true, false, false, nil)
+		assert.Equal(t, dns.RcodeSuccess, rcode)
+	}
+}
@@ -7,10 +7,57 @@ import (
 	"github.com/miekg/dns"
 )
 
-func (g *Generator) HandleQuestion(questions []dns.Question, recurse bool, dnssec bool, _ util.Addressable) (answer []dns.RR, ns []dns.RR, edns0 []dns.EDNS0, rcode int, handlerName string) {
+// filterAdditionalRecords only passes through address records for NS/MX/SRV targets
+// (and their signatures if DNSSEC was requested), the rest of the upstream additional section is dropped.
+// Iterative answers were already scrubbed to the bailiwick of the server that sent them.
+func filterAdditionalRecords(upstreamReply *dns.Msg, dnssec bool) []dns.RR {
+	if len(upstreamReply.Extra) == 0 {
+		return nil
+	}
+
+	targets := make(map[string]bool)
+	for _, section := range [][]dns.RR{upstreamReply.Answer, upstreamReply.Ns} {
+		for _, rr := range section {
+			switch typedRR := rr.(type) {
+			case *dns.NS:
+				targets[dns.CanonicalName(typedRR.Ns)] = true
+			case *dns.MX:
+				targets[dns.CanonicalName(typedRR.Mx)] = true
+			case *dns.SRV:
+				targets[dns.CanonicalName(typedRR.Target)] = true
+			}
+		}
+	}
+
+	if len(targets) == 0 {
+		return nil
+	}
+
+	var extra []dns.RR
+	for _, rr := range upstreamReply.Extra {
+		rrHdr := rr.Header()
+		if !targets[dns.CanonicalName(rrHdr.Name)] {
+			continue
+		}
+
+		switch rrHdr.Rrtype {
+		case dns.TypeA, dns.TypeAAAA:
+			extra = append(extra, rr)
+		case dns.TypeRRSIG:
+			typeCovered := rr.(*dns.RRSIG).TypeCovered
+			if dnssec && (typeCovered == dns.TypeA || typeCovered == dns.TypeAAAA) {
+				extra = append(extra, rr)
+			}
+		}
+	}
+	return extra
+}
+
+func (g *Generator) HandleQuestion(questions []dns.Question, recurse bool, dnssec bool, checkingDisabled bool, wr util.Addressable) (answer []dns.RR, ns []dns.RR, extra []dns.RR, edns0 []dns.EDNS0, rcode int, authenticatedData bool, handlerName string) {
 	rcode = dns.RcodeServerFailure
 
-	cacheResult, matchType, upstreamReply, err := g.getOrAddCache(&questions[0], recurse, false, 1)
+	ecs := g.upstreamClientSubnet(wr)
+	cacheResult, matchType, upstreamReply, upstream, err := g.getOrAddCache(&questions[0], ecs, recurse, checkingDisabled, false, 1)
 	if err != nil {
 		log.Printf("Error handling DNS request: %v", err)
 		return
@@ -19,10 +66,15 @@ func (g *Generator) HandleQuestion(questions []dns.Question, recurse bool, dnsse
 	if cacheResult != "" {
 		cacheResults.WithLabelValues(cacheResult, matchType).Inc()
 	}
+	if recorder, ok := wr.(util.ResolutionRecorder); ok {
+		recorder.RecordResolution(cacheResult, upstream)
+	}
 
 	rcode = upstreamReply.Rcode
+	authenticatedData = upstreamReply.AuthenticatedData
 	ns = upstreamReply.Ns
 	answer = upstreamReply.Answer
+	extra = filterAdditionalRecords(upstreamReply, dnssec)
 	upstreamReplyEdns0 := upstreamReply.IsEdns0()
 	if upstreamReplyEdns0 != nil {
 		for _, upstreamOpt := range upstreamReplyEdns0.Option {
@@ -35,6 +87,11 @@ func (g *Generator) HandleQuestion(questions []dns.Question, recurse bool, dnsse
 		}
 	}
 
+	// RFC 7871 section 7.2.2: clients that sent ECS get to know which subnet the answer is valid for
+	if clientSubnet := util.GetClientSubnet(wr); clientSubnet != nil && g.ClientSubnet {
+		edns0 = append(edns0, g.replyClientSubnet(clientSubnet, upstreamReply))
+	}
+
 	if !dnssec {
 		newAnswers := make([]dns.RR, 0, len(answer))
 		for _, rr := range answer {
@@ -0,0 +1,82 @@
+package resolver
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const dohContentType = "application/dns-message"
+
+func newHTTPSClient(srv *ServerConfig, maxIdleTime time.Duration) *http.Client {
+	timeout := srv.timeout()
+
+	transport := &http.Transport{
+		ForceAttemptHTTP2:   true,
+		MaxIdleConnsPerHost: srv.MaxParallelQueries,
+		MaxConnsPerHost:     srv.MaxParallelQueries,
+		IdleConnTimeout:     maxIdleTime,
+		TLSHandshakeTimeout: timeout,
+		TLSClientConfig: &tls.Config{
+			ServerName: srv.ServerName,
+		},
+	}
+
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: transport,
+	}
+}
+
+// exchangeHTTPS sends m to a DNS-over-HTTPS (RFC 8484) upstream, Addr is the URL of the endpoint
+func exchangeHTTPS(ctx context.Context, srv *ServerConfig, m *dns.Msg) (*dns.Msg, error) {
+	// RFC 8484 section 4.1: the ID should be 0 to make responses cache friendly
+	m.Id = 0
+	data, err := m.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, srv.Addr, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", dohContentType)
+	req.Header.Set("Accept", dohContentType)
+
+	httpResp, err := srv.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = httpResp.Body.Close()
+	}()
+
+	if httpResp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("upstream returned HTTP status %d", httpResp.StatusCode)
+	}
+	if contentType := httpResp.Header.Get("Content-Type"); contentType != dohContentType {
+		return nil, fmt.Errorf("upstream returned unexpected content type %q", contentType)
+	}
+
+	respData, err := io.ReadAll(io.LimitReader(httpResp.Body, dns.MaxMsgSize))
+	if err != nil {
+		return nil, err
+	}
+
+	resp := new(dns.Msg)
+	err = resp.Unpack(respData)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Id != m.Id {
+		return nil, dns.ErrId
+	}
+	return resp, nil
+}
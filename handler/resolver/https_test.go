@@ -0,0 +1,40 @@
+package resolver_test
+
+import (
+	"testing"
+
+	"github.com/Doridian/foxDNS/handler/resolver"
+	"github.com/Doridian/foxDNS/server"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHTTPSUpstream(t *testing.T) {
+	initTests()
+
+	dohServer := server.NewServer([]string{}, false)
+	dohServer.SetDoHConfig(&server.DoHConfig{
+		Listen:   []string{"127.0.0.1:12054"},
+		Insecure: true,
+	})
+	dohServer.SetHandler(simpleHandler)
+	go dohServer.Serve()
+	dohServer.WaitReady()
+	defer dohServer.Shutdown()
+
+	httpsGenerator := resolver.New([]*resolver.ServerConfig{
+		{
+			Addr:  "http://127.0.0.1:12054/dns-query",
+			Proto: "https",
+		},
+	})
+
+	answer, _, _, _, rcode, _, _ := httpsGenerator.HandleQuestion([]dns.Question{{
+		Name:   "example.com.",
+		Qtype:  dns.TypeA,
+		Qclass: dns.ClassINET,
+	}}, true, false, false, nil)
+
+	assert.Equal(t, dns.RcodeSuccess, rcode)
+	assert.Len(t, answer, 1)
+}
@@ -0,0 +1,544 @@
+package resolver
+
+import (
+	"encoding/hex"
+	"errors"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/Doridian/foxDNS/dnstap"
+	"github.com/Doridian/foxDNS/util"
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const iterativeMaxDepth = 8
+const iterativeMaxSteps = 32
+const iterativeLameTime = time.Minute * 15
+const iterativeServFailTime = time.Second * 5
+const iterativeServerLabel = "iterative"
+
+var (
+	ErrIterativeDepthExceeded = errors.New("maximum iterative resolution depth exceeded")
+	ErrIterativeTooManySteps  = errors.New("too many steps during iterative resolution")
+	ErrNoUsableNameservers    = errors.New("no usable nameservers for zone")
+	ErrLameNameserver         = errors.New("nameserver is lame for zone")
+	ErrNameserverFailure      = errors.New("nameserver failed to answer")
+)
+
+var (
+	lameNameservers = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "foxdns_resolver_lame_nameservers_total",
+		Help: "The total number of nameservers marked as lame during iterative resolution",
+	})
+)
+
+type nameserver struct {
+	name     string
+	addrs    []string
+	resolved bool
+}
+
+type delegation struct {
+	zone        string
+	nameservers []*nameserver
+	expiry      time.Time
+	lock        sync.Mutex
+}
+
+func (g *Generator) rootDelegation() *delegation {
+	return &delegation{
+		zone: ".",
+		nameservers: []*nameserver{
+			{
+				addrs:    g.RootHints,
+				resolved: true,
+			},
+		},
+	}
+}
+
+func (g *Generator) findDelegation(name string) *delegation {
+	now := g.CurrentTime()
+	for off, end := 0, false; !end; off, end = dns.NextLabel(name, off) {
+		deleg, ok := g.delegationCache.Get(name[off:])
+		if ok && deleg.expiry.After(now) {
+			return deleg
+		}
+	}
+	return g.rootDelegation()
+}
+
+// minimisedName returns the name consisting of known plus the next label of name (RFC 9156)
+func minimisedName(known string, name string) string {
+	labelIdx := dns.Split(name)
+	knownLabels := dns.CountLabel(known)
+	if knownLabels+1 >= len(labelIdx) {
+		return name
+	}
+	return name[labelIdx[len(labelIdx)-knownLabels-1]:]
+}
+
+func parentName(name string) string {
+	off, end := dns.NextLabel(name, 0)
+	if end {
+		return "."
+	}
+	return name[off:]
+}
+
+// scrubOutOfBailiwick removes all records the server authoritative for zone can not speak for,
+// so an answer from one zone can not inject records for another one into the cache
+func scrubOutOfBailiwick(resp *dns.Msg, zone string) {
+	resp.Answer = inBailiwick(resp.Answer, zone)
+	resp.Ns = inBailiwick(resp.Ns, zone)
+	resp.Extra = inBailiwick(resp.Extra, zone)
+}
+
+func inBailiwick(rrs []dns.RR, zone string) []dns.RR {
+	scrubbed := rrs[:0]
+	for _, rr := range rrs {
+		rrHdr := rr.Header()
+		if rrHdr.Rrtype == dns.TypeOPT || dns.IsSubDomain(zone, dns.CanonicalName(rrHdr.Name)) {
+			scrubbed = append(scrubbed, rr)
+		}
+	}
+	return scrubbed
+}
+
+func (g *Generator) buildDelegation(nsRecords []dns.RR, extra []dns.RR, currentZone string, qname string) *delegation {
+	zone := ""
+	minTTL := -1
+	nameservers := make(map[string]*nameserver)
+	deleg := &delegation{}
+
+	for _, rr := range nsRecords {
+		nsRR, ok := rr.(*dns.NS)
+		if !ok {
+			continue
+		}
+
+		owner := dns.CanonicalName(nsRR.Hdr.Name)
+		if owner == currentZone || !dns.IsSubDomain(currentZone, owner) || !dns.IsSubDomain(owner, qname) {
+			continue
+		}
+		if zone == "" {
+			zone = owner
+		} else if owner != zone {
+			continue
+		}
+
+		nsName := dns.CanonicalName(nsRR.Ns)
+		if nameservers[nsName] == nil {
+			ns := &nameserver{name: nsName}
+			nameservers[nsName] = ns
+			deleg.nameservers = append(deleg.nameservers, ns)
+		}
+
+		if minTTL < 0 || int(nsRR.Hdr.Ttl) < minTTL {
+			minTTL = int(nsRR.Hdr.Ttl)
+		}
+	}
+
+	if zone == "" {
+		return nil
+	}
+
+	for _, rr := range extra {
+		rrHdr := rr.Header()
+		glueName := dns.CanonicalName(rrHdr.Name)
+		ns := nameservers[glueName]
+		// Only accept glue from within the bailiwick of the server that sent it
+		if ns == nil || !dns.IsSubDomain(currentZone, glueName) {
+			continue
+		}
+
+		switch glueRR := rr.(type) {
+		case *dns.A:
+			ns.addrs = append(ns.addrs, net.JoinHostPort(glueRR.A.String(), g.nameserverPort))
+		case *dns.AAAA:
+			ns.addrs = append(ns.addrs, net.JoinHostPort(glueRR.AAAA.String(), g.nameserverPort))
+		default:
+			continue
+		}
+		ns.resolved = true
+	}
+
+	if minTTL > g.CacheMaxTTL {
+		minTTL = g.CacheMaxTTL
+	} else if minTTL < g.CacheMinTTL {
+		minTTL = g.CacheMinTTL
+	}
+
+	deleg.zone = zone
+	deleg.expiry = g.CurrentTime().Add(time.Duration(minTTL) * time.Second)
+	return deleg
+}
+
+func (g *Generator) lookupNameserverAddrs(name string, depth int) []string {
+	addrs := make([]string, 0)
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		resp, err := g.resolveIterativeDepth(&dns.Question{
+			Name:   name,
+			Qtype:  qtype,
+			Qclass: dns.ClassINET,
+		}, depth+1)
+		if err != nil {
+			continue
+		}
+
+		for _, rr := range resp.Answer {
+			switch addrRR := rr.(type) {
+			case *dns.A:
+				addrs = append(addrs, net.JoinHostPort(addrRR.A.String(), g.nameserverPort))
+			case *dns.AAAA:
+				addrs = append(addrs, net.JoinHostPort(addrRR.AAAA.String(), g.nameserverPort))
+			}
+		}
+	}
+	return addrs
+}
+
+func (g *Generator) delegationAddrs(deleg *delegation, depth int) []string {
+	addrs := make([]string, 0)
+	unresolved := make([]*nameserver, 0)
+
+	deleg.lock.Lock()
+	for _, ns := range deleg.nameservers {
+		addrs = append(addrs, ns.addrs...)
+		if !ns.resolved {
+			unresolved = append(unresolved, ns)
+		}
+	}
+	deleg.lock.Unlock()
+
+	for _, ns := range unresolved {
+		if len(addrs) > 0 {
+			break
+		}
+
+		// Nameservers within the zone they serve can not be resolved without glue
+		if dns.IsSubDomain(deleg.zone, ns.name) {
+			continue
+		}
+
+		nsAddrs := g.lookupNameserverAddrs(ns.name, depth)
+
+		deleg.lock.Lock()
+		ns.addrs = nsAddrs
+		ns.resolved = true
+		deleg.lock.Unlock()
+
+		addrs = append(addrs, nsAddrs...)
+	}
+
+	rand.Shuffle(len(addrs), func(i, j int) {
+		addrs[i], addrs[j] = addrs[j], addrs[i]
+	})
+	return addrs
+}
+
+// isLameResponse checks whether the server does not serve zone at all.
+// Failures that might only affect a single name are not considered lame.
+func isLameResponse(resp *dns.Msg, zone string) bool {
+	switch resp.Rcode {
+	case dns.RcodeRefused:
+		return true
+	case dns.RcodeSuccess:
+	default:
+		return false
+	}
+
+	if resp.Authoritative || len(resp.Answer) > 0 {
+		return false
+	}
+
+	// Referrals that do not lead further down the tree
+	hasNS := false
+	for _, rr := range resp.Ns {
+		switch rr.Header().Rrtype {
+		case dns.TypeSOA:
+			return false
+		case dns.TypeNS:
+			hasNS = true
+			owner := dns.CanonicalName(rr.Header().Name)
+			if owner != zone && dns.IsSubDomain(zone, owner) {
+				return false
+			}
+		}
+	}
+	return hasNS
+}
+
+func getServerCookie(resp *dns.Msg, clientCookie []byte) []byte {
+	respEdns0 := resp.IsEdns0()
+	if respEdns0 == nil {
+		return nil
+	}
+
+	for _, opt := range respEdns0.Option {
+		cookieOpt, ok := opt.(*dns.EDNS0_COOKIE)
+		if !ok {
+			continue
+		}
+
+		binaryCookie, err := hex.DecodeString(cookieOpt.Cookie)
+		if err != nil || len(binaryCookie) < util.ClientCookieLength+util.MinServerCookieLength {
+			continue
+		}
+
+		if util.CookieCompare(binaryCookie[:util.ClientCookieLength], clientCookie) {
+			return binaryCookie[util.ClientCookieLength:]
+		}
+	}
+	return nil
+}
+
+func (g *Generator) exchangeIterative(addr string, q *dns.Question) (resp *dns.Msg, err error) {
+	client := &dns.Client{
+		Net:     "udp",
+		Timeout: g.IterativeTimeout,
+	}
+
+	clientCookie := util.GenerateClientCookie(false, addr)
+	var serverCookie []byte
+
+	upstreamQ := *q
+	if g.QNameCaseRandomisation {
+		upstreamQ.Name = randomiseCase(q.Name)
+	}
+
+	startTime := g.CurrentTime()
+	for try := 0; try < 2; try++ {
+		m := &dns.Msg{
+			Question: []dns.Question{upstreamQ},
+			MsgHdr: dns.MsgHdr{
+				Id:     dns.Id(),
+				Opcode: dns.OpcodeQuery,
+			},
+		}
+
+		edns0Opts := make([]dns.EDNS0, 0, 1)
+		if clientCookie != nil {
+			edns0Opts = append(edns0Opts, &dns.EDNS0_COOKIE{
+				Code:   dns.EDNS0COOKIE,
+				Cookie: hex.EncodeToString(append(clientCookie, serverCookie...)),
+			})
+		}
+		util.SetEDNS0(m, edns0Opts, 0, true)
+
+		client.Net = "udp"
+		queryTime := time.Now()
+		resp, _, err = client.Exchange(m, addr)
+		logDnstap(dnstap.MessageResolverQuery, client.Net, addr, m, queryTime, resp)
+		if err == nil && resp.Truncated {
+			client.Net = "tcp"
+			queryTime = time.Now()
+			resp, _, err = client.Exchange(m, addr)
+			logDnstap(dnstap.MessageResolverQuery, client.Net, addr, m, queryTime, resp)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		// Only plain UDP answers have to carry the randomised case, TCP is hard enough to spoof
+		err = checkResponseQuestion(iterativeServerLabel, m, resp, g.QNameCaseRandomisation && client.Net == "udp")
+		if err != nil {
+			return nil, err
+		}
+		restoreQuestionCase(resp, upstreamQ.Name, q.Name)
+
+		if resp.Rcode != dns.RcodeBadCookie {
+			break
+		}
+		// Retry once with the server cookie we just learned
+		serverCookie = getServerCookie(resp, clientCookie)
+		if serverCookie == nil {
+			break
+		}
+	}
+
+	upstreamQueryTime.WithLabelValues(iterativeServerLabel).Observe(time.Since(startTime).Seconds())
+	return resp, nil
+}
+
+func (g *Generator) queryDelegation(deleg *delegation, q *dns.Question, depth int) (*dns.Msg, error) {
+	var lastErr error = ErrNoUsableNameservers
+	failures := 0
+
+	for _, addr := range g.delegationAddrs(deleg, depth) {
+		if failures >= g.Attempts {
+			break
+		}
+
+		lameKey := deleg.zone + "@" + addr
+		lameUntil, isLame := g.lameCache.Get(lameKey)
+		if isLame && lameUntil.After(g.CurrentTime()) {
+			continue
+		}
+		servFailKey := q.Name + "/" + dns.TypeToString[q.Qtype] + "@" + addr
+		servFailUntil, isFailing := g.servFailCache.Get(servFailKey)
+		if isFailing && servFailUntil.After(g.CurrentTime()) {
+			continue
+		}
+
+		resp, err := g.exchangeIterative(addr, q)
+		if err != nil {
+			upstreamQueryErrors.WithLabelValues(iterativeServerLabel).Inc()
+			lastErr = err
+			// Unreachable (e.g. IPv6 without connectivity) servers fail fast, only count timeouts
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				failures++
+			}
+			continue
+		}
+
+		if isLameResponse(resp, deleg.zone) {
+			lameNameservers.Inc()
+			g.lameCache.Add(lameKey, g.CurrentTime().Add(iterativeLameTime))
+			lastErr = ErrLameNameserver
+			failures++
+			continue
+		}
+
+		// Another server of the zone might still be able to answer, back off from this one only for this name
+		if resp.Rcode == dns.RcodeServerFailure || resp.Rcode == dns.RcodeNotImplemented {
+			g.servFailCache.Add(servFailKey, g.CurrentTime().Add(iterativeServFailTime))
+			lastErr = ErrNameserverFailure
+			failures++
+			continue
+		}
+
+		return resp, nil
+	}
+
+	return nil, lastErr
+}
+
+func (g *Generator) resolveIterative(q *dns.Question) (*dns.Msg, error) {
+	return g.resolveIterativeDepth(q, 0)
+}
+
+func (g *Generator) resolveIterativeDepth(q *dns.Question, depth int) (*dns.Msg, error) {
+	if depth > iterativeMaxDepth {
+		return nil, ErrIterativeDepthExceeded
+	}
+
+	// DS records are served by the parent side of a zone cut
+	delegationName := q.Name
+	if q.Qtype == dns.TypeDS && q.Name != "." {
+		delegationName = parentName(q.Name)
+	}
+
+	deleg := g.findDelegation(delegationName)
+	known := deleg.zone
+	minimise := g.QNameMinimisation
+
+	for step := 0; step < iterativeMaxSteps; step++ {
+		query := *q
+		if minimise && known != q.Name {
+			query.Name = minimisedName(known, q.Name)
+			if query.Name != q.Name {
+				query.Qtype = dns.TypeNS
+			}
+		}
+		isMinimised := query.Name != q.Name
+
+		resp, err := g.queryDelegation(deleg, &query, depth)
+		if err != nil {
+			if isMinimised {
+				minimise = false
+				continue
+			}
+			return nil, err
+		}
+		scrubOutOfBailiwick(resp, deleg.zone)
+
+		var next *delegation
+		if resp.Rcode == dns.RcodeSuccess {
+			if len(resp.Answer) == 0 {
+				next = g.buildDelegation(resp.Ns, resp.Extra, deleg.zone, delegationName)
+			} else if isMinimised {
+				// Child zone apex hosted on the same nameservers as the parent
+				next = g.buildDelegation(resp.Answer, resp.Extra, deleg.zone, delegationName)
+			}
+		}
+
+		if next != nil {
+			g.delegationCache.Add(next.zone, next)
+			deleg = next
+			known = next.zone
+			continue
+		}
+
+		if isMinimised {
+			switch resp.Rcode {
+			case dns.RcodeNameError:
+				// Nothing can exist below a name that does not exist (RFC 8020)
+				resp.Question = []dns.Question{*q}
+				return resp, nil
+			case dns.RcodeSuccess:
+				// Not a zone cut, continue with the next label
+				known = query.Name
+			default:
+				minimise = false
+			}
+			continue
+		}
+
+		return g.followIterativeCNAME(q, resp, depth), nil
+	}
+
+	return nil, ErrIterativeTooManySteps
+}
+
+func (g *Generator) followIterativeCNAME(q *dns.Question, resp *dns.Msg, depth int) *dns.Msg {
+	resp.Question = []dns.Question{*q}
+
+	if resp.Rcode != dns.RcodeSuccess || q.Qtype == dns.TypeCNAME {
+		return resp
+	}
+
+	target := q.Name
+	seenTargets := make(map[string]bool)
+	for !seenTargets[target] {
+		seenTargets[target] = true
+		for _, rr := range resp.Answer {
+			cname, ok := rr.(*dns.CNAME)
+			if ok && dns.CanonicalName(cname.Hdr.Name) == target {
+				target = dns.CanonicalName(cname.Target)
+				break
+			}
+		}
+	}
+
+	if target == q.Name {
+		return resp
+	}
+
+	// Targets outside the zone were scrubbed, those are always resolved from their own delegation
+	for _, rr := range resp.Answer {
+		rrHdr := rr.Header()
+		if rrHdr.Rrtype == q.Qtype && dns.CanonicalName(rrHdr.Name) == target {
+			return resp
+		}
+	}
+
+	targetResp, err := g.resolveIterativeDepth(&dns.Question{
+		Name:   target,
+		Qtype:  q.Qtype,
+		Qclass: q.Qclass,
+	}, depth+1)
+	if err != nil {
+		return resp
+	}
+
+	resp.Answer = append(resp.Answer, targetResp.Answer...)
+	resp.Ns = targetResp.Ns
+	resp.Rcode = targetResp.Rcode
+	return resp
+}
@@ -0,0 +1,221 @@
+package resolver_test
+
+import (
+	"net"
+	"testing"
+
+	"github.com/Doridian/foxDNS/handler/resolver"
+	"github.com/Doridian/foxDNS/server"
+	"github.com/Doridian/foxDNS/util"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIterativeAuthoritativeAnswer(t *testing.T) {
+	initTests()
+
+	iterativeGenerator := resolver.New(nil)
+	iterativeGenerator.Iterative = true
+	iterativeGenerator.QNameMinimisation = false
+	iterativeGenerator.RootHints = []string{"127.0.0.1:12053"}
+
+	answer, _, _, _, rcode, _, _ := iterativeGenerator.HandleQuestion([]dns.Question{{
+		Name:   "example.com.",
+		Qtype:  dns.TypeA,
+		Qclass: dns.ClassINET,
+	}}, true, false, false, nil)
+
+	assert.Equal(t, dns.RcodeSuccess, rcode)
+	assert.ElementsMatch(t, []dns.RR{
+		&dns.A{
+			Hdr: dns.RR_Header{
+				Name:     "example.com.",
+				Rrtype:   dns.TypeA,
+				Class:    dns.ClassINET,
+				Ttl:      5,
+				Rdlength: 4,
+			},
+			A: net.ParseIP("10.13.37.0").To4(),
+		},
+	}, answer)
+}
+
+func TestIterativeNXDOMAIN(t *testing.T) {
+	initTests()
+
+	iterativeGenerator := resolver.New(nil)
+	iterativeGenerator.Iterative = true
+	iterativeGenerator.QNameMinimisation = false
+	iterativeGenerator.RootHints = []string{"127.0.0.1:12053"}
+
+	answer, ns, _, _, rcode, _, _ := iterativeGenerator.HandleQuestion([]dns.Question{{
+		Name:   "nx.example.com.",
+		Qtype:  dns.TypeA,
+		Qclass: dns.ClassINET,
+	}}, true, false, false, nil)
+
+	assert.Equal(t, dns.RcodeNameError, rcode)
+	assert.Empty(t, answer)
+	assert.Len(t, ns, 1)
+}
+
+// referralHandler delegates every zone in zones to ns.<zone> at 127.0.0.1
+func referralHandler(zones ...string) dns.HandlerFunc {
+	return func(wr dns.ResponseWriter, msg *dns.Msg) {
+		reply := &dns.Msg{}
+		reply.SetReply(msg)
+		for _, zone := range zones {
+			if dns.IsSubDomain(zone, msg.Question[0].Name) {
+				reply.Ns = append(reply.Ns, util.FillHeader(&dns.NS{Ns: "ns." + zone}, zone, dns.TypeNS, 60))
+				reply.Extra = append(reply.Extra, util.FillHeader(&dns.A{A: net.IPv4(127, 0, 0, 1)}, "ns."+zone, dns.TypeA, 60))
+			}
+		}
+		_ = wr.WriteMsg(reply)
+	}
+}
+
+func TestIterativeScrubsOutOfBailiwickRecords(t *testing.T) {
+	initTests()
+	dummyServer.SetHandler(referralHandler("evil.test.", "bank.test."))
+
+	authServer := server.NewServer([]string{"127.0.0.1:12055"}, false)
+	authServer.SetHandler(dns.HandlerFunc(func(wr dns.ResponseWriter, msg *dns.Msg) {
+		reply := &dns.Msg{}
+		reply.SetReply(msg)
+		reply.Authoritative = true
+		if msg.Question[0].Name == "www.evil.test." {
+			// Only the CNAME is ours to give, the address of the target is not
+			reply.Answer = []dns.RR{
+				util.FillHeader(&dns.CNAME{Target: "www.bank.test."}, "www.evil.test.", dns.TypeCNAME, 60),
+				util.FillHeader(&dns.A{A: net.IPv4(192, 0, 2, 66)}, "www.bank.test.", dns.TypeA, 60),
+			}
+		} else if msg.Question[0].Name == "www.bank.test." {
+			reply.Answer = []dns.RR{util.FillHeader(&dns.A{A: net.IPv4(192, 0, 2, 1)}, "www.bank.test.", dns.TypeA, 60)}
+		}
+		_ = wr.WriteMsg(reply)
+	}))
+	go authServer.Serve()
+	authServer.WaitReady()
+	defer authServer.Shutdown()
+
+	iterativeGenerator := resolver.New(nil)
+	iterativeGenerator.Iterative = true
+	iterativeGenerator.QNameMinimisation = false
+	iterativeGenerator.RootHints = []string{"127.0.0.1:12053"}
+	iterativeGenerator.SetNameserverPort("12055")
+
+	answer, _, _, _, rcode, _, _ := iterativeGenerator.HandleQuestion([]dns.Question{{
+		Name:   "www.evil.test.",
+		Qtype:  dns.TypeA,
+		Qclass: dns.ClassINET,
+	}}, true, false, false, nil)
+
+	assert.Equal(t, dns.RcodeSuccess, rcode)
+	if assert.Len(t, answer, 2) {
+		assert.Equal(t, "www.bank.test.", answer[0].(*dns.CNAME).Target)
+		assert.Equal(t, net.IPv4(192, 0, 2, 1).To4(), answer[1].(*dns.A).A.To4())
+	}
+
+	// The injected address must not have been cached either
+	answer, _, _, _, _, _, _ = iterativeGenerator.HandleQuestion([]dns.Question{{
+		Name:   "www.bank.test.",
+		Qtype:  dns.TypeA,
+		Qclass: dns.ClassINET,
+	}}, true, false, false, nil)
+	if assert.Len(t, answer, 1) {
+		assert.Equal(t, net.IPv4(192, 0, 2, 1).To4(), answer[0].(*dns.A).A.To4())
+	}
+}
+
+func TestIterativeServFailIsNotLame(t *testing.T) {
+	initTests()
+	dummyServer.SetHandler(dns.HandlerFunc(func(wr dns.ResponseWriter, msg *dns.Msg) {
+		if msg.Question[0].Name == "fail.example.com." {
+			reply := &dns.Msg{}
+			reply.SetRcode(msg, dns.RcodeServerFailure)
+			_ = wr.WriteMsg(reply)
+			return
+		}
+		simpleHandler.ServeDNS(wr, msg)
+	}))
+
+	iterativeGenerator := resolver.New(nil)
+	iterativeGenerator.Iterative = true
+	iterativeGenerator.QNameMinimisation = false
+	iterativeGenerator.RootHints = []string{"127.0.0.1:12053"}
+
+	_, _, _, _, rcode, _, _ := iterativeGenerator.HandleQuestion([]dns.Question{{
+		Name:   "fail.example.com.",
+		Qtype:  dns.TypeA,
+		Qclass: dns.ClassINET,
+	}}, true, false, false, nil)
+	assert.Equal(t, dns.RcodeServerFailure, rcode)
+
+	// Other names of the zone are still asked
+	answer, _, _, _, rcode, _, _ := iterativeGenerator.HandleQuestion([]dns.Question{{
+		Name:   "example.com.",
+		Qtype:  dns.TypeA,
+		Qclass: dns.ClassINET,
+	}}, true, false, false, nil)
+	assert.Equal(t, dns.RcodeSuccess, rcode)
+	assert.Len(t, answer, 1)
+
+	// Failing names are asked from the next server of the zone
+	healthyServer := server.NewServer([]string{"127.0.0.1:12055"}, false)
+	healthyServer.SetHandler(simpleHandler)
+	go healthyServer.Serve()
+	healthyServer.WaitReady()
+	defer healthyServer.Shutdown()
+
+	iterativeGenerator.RootHints = []string{"127.0.0.1:12053", "127.0.0.1:12055"}
+	iterativeGenerator.FlushCache()
+	_, _, _, _, rcode, _, _ = iterativeGenerator.HandleQuestion([]dns.Question{{
+		Name:   "fail.example.com.",
+		Qtype:  dns.TypeA,
+		Qclass: dns.ClassINET,
+	}}, true, false, false, nil)
+	assert.Equal(t, dns.RcodeNameError, rcode)
+}
+
+func TestIterativeScrubsOutOfBailiwickAdditionalRecords(t *testing.T) {
+	initTests()
+	dummyServer.SetHandler(referralHandler("evil.test."))
+
+	authServer := server.NewServer([]string{"127.0.0.1:12055"}, false)
+	authServer.SetHandler(dns.HandlerFunc(func(wr dns.ResponseWriter, msg *dns.Msg) {
+		reply := &dns.Msg{}
+		reply.SetReply(msg)
+		reply.Authoritative = true
+		reply.Answer = []dns.RR{
+			util.FillHeader(&dns.MX{Preference: 10, Mx: "mail.evil.test."}, "evil.test.", dns.TypeMX, 60),
+			util.FillHeader(&dns.MX{Preference: 20, Mx: "mail.bank.test."}, "evil.test.", dns.TypeMX, 60),
+		}
+		reply.Extra = []dns.RR{
+			util.FillHeader(&dns.A{A: net.IPv4(192, 0, 2, 25)}, "mail.evil.test.", dns.TypeA, 60),
+			util.FillHeader(&dns.A{A: net.IPv4(192, 0, 2, 66)}, "mail.bank.test.", dns.TypeA, 60),
+		}
+		_ = wr.WriteMsg(reply)
+	}))
+	go authServer.Serve()
+	authServer.WaitReady()
+	defer authServer.Shutdown()
+
+	iterativeGenerator := resolver.New(nil)
+	iterativeGenerator.Iterative = true
+	iterativeGenerator.QNameMinimisation = false
+	iterativeGenerator.RootHints = []string{"127.0.0.1:12053"}
+	iterativeGenerator.SetNameserverPort("12055")
+
+	answer, _, extra, _, rcode, _, _ := iterativeGenerator.HandleQuestion([]dns.Question{{
+		Name:   "evil.test.",
+		Qtype:  dns.TypeMX,
+		Qclass: dns.ClassINET,
+	}}, true, false, false, nil)
+
+	assert.Equal(t, dns.RcodeSuccess, rcode)
+	assert.Len(t, answer, 2)
+	// The address of mail.bank.test. is not for evil.test. to give
+	if assert.Len(t, extra, 1) {
+		assert.Equal(t, "mail.evil.test.", extra[0].Header().Name)
+	}
+}
@@ -0,0 +1,290 @@
+package resolver
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var ErrPipelineClosed = errors.New("pipelined upstream connection closed")
+
+var (
+	pipelinedConnections = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "foxdns_resolver_pipelined_connections",
+		Help: "The number of open pipelined connections to upstream resolvers",
+	}, []string{"server"})
+)
+
+type pipelineResult struct {
+	msg *dns.Msg
+	err error
+}
+
+// pipelineConn carries many outstanding queries on one TCP/DoT connection,
+// responses may arrive in any order and are matched by message ID (RFC 7766)
+type pipelineConn struct {
+	conn      *dns.Conn
+	server    *ServerConfig
+	writeLock sync.Mutex
+
+	lock    sync.Mutex
+	pending map[uint16]chan *pipelineResult
+	closed  bool
+	lastUse time.Time
+	// When the last message was read, to tell slow from black-holed connections
+	lastRead time.Time
+}
+
+func (s *ServerConfig) usesPipeline() bool {
+	return s.Pipeline && (s.Proto == "tcp" || s.Proto == "tcp-tls")
+}
+
+// usablePipelineConn returns the least busy pipelined connection, if it should be used instead of dialing a new one.
+// Must be called with pipelineLock held.
+func (s *ServerConfig) usablePipelineConn() (*pipelineConn, bool) {
+	var best *pipelineConn
+	bestPending := 0
+	for _, pc := range s.pipelineConns {
+		pc.lock.Lock()
+		pending := len(pc.pending)
+		pc.lock.Unlock()
+
+		if best == nil || pending < bestPending {
+			best = pc
+			bestPending = pending
+		}
+	}
+
+	// Busy connections are still used while another query is dialing, instead of waiting for it
+	usable := best != nil && (bestPending == 0 || s.pipelineDialing || len(s.pipelineConns) >= s.MaxConnections)
+	return best, usable
+}
+
+// getPipelineConn picks the least busy pipelined connection, opening a new one
+// while there are fewer than MaxConnections and all existing ones are busy
+func (s *ServerConfig) getPipelineConn() (*pipelineConn, error) {
+	s.pipelineLock.Lock()
+	best, usable := s.usablePipelineConn()
+	s.pipelineLock.Unlock()
+	if usable {
+		return best, nil
+	}
+
+	// Only one dial at a time, queries waiting here use its connection once it is up
+	s.pipelineDialLock.Lock()
+	defer s.pipelineDialLock.Unlock()
+
+	s.pipelineLock.Lock()
+	best, usable = s.usablePipelineConn()
+	if usable {
+		s.pipelineLock.Unlock()
+		return best, nil
+	}
+	s.pipelineDialing = true
+	s.pipelineLock.Unlock()
+
+	// Dialing (including the TLS handshake) can take up to the full timeout, so it must not block pipelineLock
+	conn, err := s.client.Dial(s.Addr)
+
+	s.pipelineLock.Lock()
+	defer s.pipelineLock.Unlock()
+	s.pipelineDialing = false
+
+	if err != nil {
+		best, _ = s.usablePipelineConn()
+		if best != nil {
+			return best, nil
+		}
+		return nil, err
+	}
+
+	pc := &pipelineConn{
+		conn:    conn,
+		server:  s,
+		pending: make(map[uint16]chan *pipelineResult),
+		lastUse: time.Now(),
+	}
+	s.pipelineConns = append(s.pipelineConns, pc)
+	pipelinedConnections.WithLabelValues(s.Addr).Set(float64(len(s.pipelineConns)))
+
+	go pc.readLoop()
+	return pc, nil
+}
+
+func (s *ServerConfig) removePipelineConn(pc *pipelineConn) {
+	s.pipelineLock.Lock()
+	defer s.pipelineLock.Unlock()
+
+	for i, existing := range s.pipelineConns {
+		if existing == pc {
+			s.pipelineConns = append(s.pipelineConns[:i], s.pipelineConns[i+1:]...)
+			break
+		}
+	}
+	pipelinedConnections.WithLabelValues(s.Addr).Set(float64(len(s.pipelineConns)))
+}
+
+// cleanupPipelineConns closes pipelined connections without outstanding queries that were idle for maxIdleTime
+func (s *ServerConfig) cleanupPipelineConns(maxIdleTime time.Duration) {
+	s.pipelineLock.Lock()
+	toClose := make([]*pipelineConn, 0)
+	for _, pc := range s.pipelineConns {
+		pc.lock.Lock()
+		if len(pc.pending) == 0 && time.Since(pc.lastUse) > maxIdleTime {
+			toClose = append(toClose, pc)
+		}
+		pc.lock.Unlock()
+	}
+	s.pipelineLock.Unlock()
+
+	for _, pc := range toClose {
+		pc.close(ErrPipelineClosed)
+	}
+}
+
+func (pc *pipelineConn) close(err error) {
+	pc.lock.Lock()
+	if pc.closed {
+		pc.lock.Unlock()
+		return
+	}
+	pc.closed = true
+	pending := pc.pending
+	pc.pending = make(map[uint16]chan *pipelineResult)
+	pc.lock.Unlock()
+
+	pc.server.removePipelineConn(pc)
+	_ = pc.conn.Close()
+
+	for _, resultChan := range pending {
+		resultChan <- &pipelineResult{err: err}
+	}
+}
+
+func (pc *pipelineConn) readLoop() {
+	for {
+		msg, err := pc.conn.ReadMsg()
+		if err != nil {
+			pc.close(err)
+			return
+		}
+
+		pc.lock.Lock()
+		pc.lastRead = time.Now()
+		resultChan, ok := pc.pending[msg.Id]
+		if ok {
+			delete(pc.pending, msg.Id)
+		}
+		pc.lock.Unlock()
+
+		// Late answers to queries that already timed out are dropped
+		if ok {
+			resultChan <- &pipelineResult{msg: msg}
+		}
+	}
+}
+
+// register assigns m an ID that is not used by any other outstanding query on this connection
+func (pc *pipelineConn) register(m *dns.Msg) (chan *pipelineResult, error) {
+	pc.lock.Lock()
+	defer pc.lock.Unlock()
+
+	if pc.closed {
+		return nil, ErrPipelineClosed
+	}
+
+	for {
+		m.Id = dns.Id()
+		if _, ok := pc.pending[m.Id]; !ok {
+			break
+		}
+	}
+
+	resultChan := make(chan *pipelineResult, 1)
+	pc.pending[m.Id] = resultChan
+	pc.lastUse = time.Now()
+	return resultChan, nil
+}
+
+func (pc *pipelineConn) unregister(id uint16) {
+	pc.lock.Lock()
+	delete(pc.pending, id)
+	pc.lock.Unlock()
+}
+
+func (pc *pipelineConn) readSince(since time.Time) bool {
+	pc.lock.Lock()
+	defer pc.lock.Unlock()
+	return pc.lastRead.After(since)
+}
+
+func (pc *pipelineConn) exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	resultChan, err := pc.register(m)
+	if err != nil {
+		return nil, err
+	}
+
+	timeout := pc.server.timeout()
+	sentTime := time.Now()
+
+	pc.writeLock.Lock()
+	_ = pc.conn.SetWriteDeadline(time.Now().Add(timeout))
+	err = pc.conn.WriteMsg(m)
+	pc.writeLock.Unlock()
+	if err != nil {
+		pc.unregister(m.Id)
+		// A partially written message leaves the stream unusable for everyone else
+		go pc.close(err)
+		return nil, err
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case result := <-resultChan:
+		if result.err != nil {
+			return nil, result.err
+		}
+		if !questionsMatch(m, result.msg) {
+			return nil, dns.ErrId
+		}
+		return result.msg, nil
+	case <-timer.C:
+		pc.unregister(m.Id)
+		// Nothing arrived on the connection for the whole timeout, it will not recover and must not be picked again
+		if !pc.readSince(sentTime) {
+			go pc.close(context.DeadlineExceeded)
+		}
+		return nil, context.DeadlineExceeded
+	case <-ctx.Done():
+		pc.unregister(m.Id)
+		return nil, ctx.Err()
+	}
+}
+
+func questionsMatch(req *dns.Msg, resp *dns.Msg) bool {
+	if len(req.Question) != len(resp.Question) {
+		return false
+	}
+	for i, q := range req.Question {
+		respQ := resp.Question[i]
+		if q.Qtype != respQ.Qtype || q.Qclass != respQ.Qclass || !equalName(q.Name, respQ.Name) {
+			return false
+		}
+	}
+	return true
+}
+
+func exchangePipelined(ctx context.Context, srv *ServerConfig, m *dns.Msg) (*dns.Msg, error) {
+	pc, err := srv.getPipelineConn()
+	if err != nil {
+		return nil, err
+	}
+	return pc.exchange(ctx, m)
+}
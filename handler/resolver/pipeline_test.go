@@ -0,0 +1,154 @@
+package resolver_test
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Doridian/foxDNS/handler/resolver"
+	"github.com/Doridian/foxDNS/util"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// serveReversed reads batchSize queries from each connection before answering them in reverse order
+func serveReversed(listener net.Listener, batchSize int, connCount *atomic.Int32) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		connCount.Add(1)
+
+		go func() {
+			defer func() {
+				_ = conn.Close()
+			}()
+			dnsConn := &dns.Conn{Conn: conn}
+
+			for {
+				queries := make([]*dns.Msg, 0, batchSize)
+				for len(queries) < batchSize {
+					msg, err := dnsConn.ReadMsg()
+					if err != nil {
+						return
+					}
+					queries = append(queries, msg)
+				}
+
+				for i := len(queries) - 1; i >= 0; i-- {
+					reply := &dns.Msg{}
+					reply.SetReply(queries[i])
+					reply.Answer = []dns.RR{
+						util.FillHeader(&dns.A{A: net.IPv4(10, 13, 37, byte(i))}, queries[i].Question[0].Name, dns.TypeA, 5),
+					}
+					err := dnsConn.WriteMsg(reply)
+					if err != nil {
+						return
+					}
+				}
+			}
+		}()
+	}
+}
+
+func TestPipelinedQueries(t *testing.T) {
+	initTests()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer func() {
+		_ = listener.Close()
+	}()
+
+	connCount := &atomic.Int32{}
+	go serveReversed(listener, 2, connCount)
+
+	pipelineGenerator := resolver.New([]*resolver.ServerConfig{
+		{
+			Addr:           listener.Addr().String(),
+			Proto:          "tcp",
+			Pipeline:       true,
+			MaxConnections: 1,
+			Timeout:        time.Second * 2,
+		},
+	})
+	pipelineGenerator.ServerStrategy = resolver.StrategyFailover
+	pipelineGenerator.Attempts = 1
+
+	wg := &sync.WaitGroup{}
+	for _, name := range []string{"a.example.com.", "b.example.com."} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			answer, _, _, _, rcode, _, _ := pipelineGenerator.HandleQuestion([]dns.Question{{
+				Name:   name,
+				Qtype:  dns.TypeA,
+				Qclass: dns.ClassINET,
+			}}, true, false, false, nil)
+
+			assert.Equal(t, dns.RcodeSuccess, rcode)
+			if assert.Len(t, answer, 1) {
+				assert.Equal(t, name, answer[0].Header().Name)
+			}
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, int32(1), connCount.Load())
+}
+
+func TestPipelinedConnectionClosedAfterTimeout(t *testing.T) {
+	initTests()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer func() {
+		_ = listener.Close()
+	}()
+
+	connCount := &atomic.Int32{}
+	go func() {
+		// The first connection swallows all queries, later ones answer them
+		blackHole, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer func() {
+			_ = blackHole.Close()
+		}()
+		connCount.Add(1)
+		serveReversed(listener, 1, connCount)
+	}()
+
+	pipelineGenerator := resolver.New([]*resolver.ServerConfig{
+		{
+			Addr:           listener.Addr().String(),
+			Proto:          "tcp",
+			Pipeline:       true,
+			MaxConnections: 1,
+			Timeout:        time.Millisecond * 200,
+		},
+	})
+	pipelineGenerator.ServerStrategy = resolver.StrategyFailover
+	pipelineGenerator.Attempts = 1
+
+	_, _, _, _, rcode, _, _ := pipelineGenerator.HandleQuestion([]dns.Question{{
+		Name:   "a.example.com.",
+		Qtype:  dns.TypeA,
+		Qclass: dns.ClassINET,
+	}}, true, false, false, nil)
+	assert.Equal(t, dns.RcodeServerFailure, rcode)
+
+	assert.Eventually(t, func() bool {
+		_, _, _, _, rcode, _, _ := pipelineGenerator.HandleQuestion([]dns.Question{{
+			Name:   "b.example.com.",
+			Qtype:  dns.TypeA,
+			Qclass: dns.ClassINET,
+		}}, true, false, false, nil)
+		return rcode == dns.RcodeSuccess
+	}, time.Second*2, time.Millisecond*10)
+	assert.Equal(t, int32(2), connCount.Load())
+}
@@ -1,10 +1,13 @@
 package resolver
 
 import (
+	"context"
+	"errors"
 	"log"
 	"math/rand"
 	"time"
 
+	"github.com/Doridian/foxDNS/util"
 	"github.com/miekg/dns"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
@@ -17,6 +20,16 @@ type querySlotInfo struct {
 	lastUse      time.Time
 }
 
+func (s *querySlotInfo) isSecure() bool {
+	if s.server.httpClient != nil {
+		return true
+	}
+	if s.server.usesPipeline() {
+		return s.server.Proto == "tcp-tls"
+	}
+	return util.IsSecureProtocol(s.conn)
+}
+
 func (s *querySlotInfo) close() {
 	if s.conn == nil {
 		return
@@ -31,21 +44,40 @@ var (
 	}, []string{"server"})
 )
 
-func (g *Generator) acquireQuerySlot(currentTry int) (info *querySlotInfo, err error) {
-	var server *ServerConfig
+// serverOrder lists all servers in the order ServerStrategy prefers them for currentTry
+func (g *Generator) serverOrder(currentTry int) []*ServerConfig {
 	switch g.ServerStrategy {
 	case StrategyRoundRobin:
-		server = g.Servers[g.lastServerIdx]
-		nextServerIdx := g.lastServerIdx + 1
-		if nextServerIdx >= len(g.Servers) {
-			nextServerIdx = 0
-		}
-		g.lastServerIdx = nextServerIdx
+		return rotateServers(g.Servers, int((g.lastServerIdx.Add(1)-1)%uint64(len(g.Servers))))
 	case StrategyRandom:
-		server = g.Servers[rand.Int()%len(g.Servers)]
+		return randomServers(g.Servers)
 	case StrategyFailover:
-		server = g.Servers[(currentTry-1)%len(g.Servers)]
+		return rotateServers(g.Servers, currentTry-1)
+	case StrategyFastest:
+		return g.fastestServers(currentTry)
 	}
+	return g.Servers
+}
+
+func rotateServers(servers []*ServerConfig, start int) []*ServerConfig {
+	start %= len(servers)
+	rotated := make([]*ServerConfig, 0, len(servers))
+	rotated = append(rotated, servers[start:]...)
+	return append(rotated, servers[:start]...)
+}
+
+func randomServers(servers []*ServerConfig) []*ServerConfig {
+	shuffled := make([]*ServerConfig, len(servers))
+	copy(shuffled, servers)
+	rand.Shuffle(len(shuffled), func(i, j int) {
+		shuffled[i], shuffled[j] = shuffled[j], shuffled[i]
+	})
+	return shuffled
+}
+
+// acquireQuerySlot picks a server according to ServerStrategy, skipping those already claimed by other branches of race
+func (g *Generator) acquireQuerySlot(currentTry int, race *raceServers) (info *querySlotInfo, err error) {
+	server := race.pick(g.serverOrder(currentTry))
 
 	server.querySlotCond.L.Lock()
 
@@ -54,6 +86,9 @@ func (g *Generator) acquireQuerySlot(currentTry int) (info *querySlotInfo, err e
 		if firstElem != nil {
 			info = server.freeQuerySlots.Remove(firstElem).(*querySlotInfo)
 			server.querySlotCond.L.Unlock()
+			if info.conn == nil && server.usesFreshSocket() {
+				info.conn, err = server.client.Dial(server.Addr)
+			}
 			return
 		}
 
@@ -66,7 +101,10 @@ func (g *Generator) acquireQuerySlot(currentTry int) (info *querySlotInfo, err e
 				server:       server,
 				serverCookie: []byte{},
 			}
-			info.conn, err = server.client.Dial(server.Addr)
+			if server.httpClient == nil && !server.usesPipeline() {
+				// HTTPS and pipelined upstreams share their connections between query slots
+				info.conn, err = server.client.Dial(server.Addr)
+			}
 			return
 		}
 
@@ -86,9 +124,16 @@ func (g *Generator) returnQuerySlot(info *querySlotInfo, err error) {
 
 	if err == nil {
 		info.lastUse = g.CurrentTime()
+		// Never reuse the source port of a plain UDP socket for another query
+		if server.usesFreshSocket() && info.conn != nil {
+			info.close()
+			info.conn = nil
+		}
 		server.freeQuerySlots.PushFront(info)
 	} else {
-		log.Printf("Returning upstream connection to %s with error %v", info.server.Addr, err)
+		if !errors.Is(err, context.Canceled) {
+			log.Printf("Returning upstream connection to %s with error %v", info.server.Addr, err)
+		}
 		server.inFlightQueries--
 		openConnections.WithLabelValues(server.Addr).Set(float64(server.inFlightQueries))
 		if info.conn != nil {
@@ -131,5 +176,6 @@ func (g *Generator) cleanupServerQuerySlots(server *ServerConfig) {
 func (g *Generator) cleanupAllQuerySlots() {
 	for _, server := range g.Servers {
 		g.cleanupServerQuerySlots(server)
+		server.cleanupPipelineConns(g.MaxIdleTime)
 	}
 }
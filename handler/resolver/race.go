@@ -0,0 +1,109 @@
+package resolver
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	upstreamHedgedQueries = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "foxdns_resolver_upstream_hedged_queries_total",
+		Help: "The total number of additional upstream queries sent because the first ones were too slow",
+	})
+)
+
+type exchangeResult struct {
+	resp     *dns.Msg
+	upstream string
+	err      error
+}
+
+// raceServers keeps track of the servers picked by any branch of one race
+type raceServers struct {
+	lock    sync.Mutex
+	claimed map[*ServerConfig]bool
+}
+
+// pick claims the first server of order no other branch picked yet.
+// Once all are claimed, branches share servers again. A nil race always picks the first server.
+func (r *raceServers) pick(order []*ServerConfig) *ServerConfig {
+	if r == nil {
+		return order[0]
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for _, server := range order {
+		if !r.claimed[server] {
+			r.claimed[server] = true
+			return server
+		}
+	}
+	return order[0]
+}
+
+func isValidRaceResult(result exchangeResult) bool {
+	return result.err == nil && result.resp != nil && result.resp.Rcode != dns.RcodeServerFailure
+}
+
+// exchangeHedged queries RaceCount upstream servers in parallel and, if HedgeDelay is set,
+// one more once none of them answered in time. The first valid response wins and all other
+// in-flight queries are cancelled, which returns their query slots.
+func (g *Generator) exchangeHedged(q *dns.Question, ecs *dns.EDNS0_SUBNET) (*dns.Msg, string, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	raceCount := g.RaceCount
+	if raceCount < 1 {
+		raceCount = 1
+	}
+
+	// Buffered so that branches finishing after we returned don't block
+	results := make(chan exchangeResult, raceCount+1)
+	race := &raceServers{
+		claimed: make(map[*ServerConfig]bool),
+	}
+	branches := 0
+	startBranch := func() {
+		branches++
+		go func() {
+			resp, upstream, err := g.exchangeWithRetry(ctx, q, ecs, race)
+			results <- exchangeResult{resp: resp, upstream: upstream, err: err}
+		}()
+	}
+
+	for range raceCount {
+		startBranch()
+	}
+
+	var hedgeTimer <-chan time.Time
+	if g.HedgeDelay > 0 {
+		timer := time.NewTimer(g.HedgeDelay)
+		defer timer.Stop()
+		hedgeTimer = timer.C
+	}
+
+	var lastResult exchangeResult
+	for pending := branches; pending > 0; {
+		select {
+		case <-hedgeTimer:
+			hedgeTimer = nil
+			upstreamHedgedQueries.Inc()
+			startBranch()
+			pending++
+		case result := <-results:
+			pending--
+			if isValidRaceResult(result) {
+				return result.resp, result.upstream, nil
+			}
+			lastResult = result
+		}
+	}
+
+	return lastResult.resp, lastResult.upstream, lastResult.err
+}
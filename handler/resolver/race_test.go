@@ -0,0 +1,77 @@
+package resolver_test
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/Doridian/foxDNS/handler/resolver"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func newRaceGenerator(t *testing.T) *resolver.Generator {
+	initTests()
+
+	// Accepts queries but never answers them
+	silentConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	t.Cleanup(func() {
+		_ = silentConn.Close()
+	})
+
+	raceGenerator := resolver.New([]*resolver.ServerConfig{
+		{
+			Addr:    silentConn.LocalAddr().String(),
+			Proto:   "udp",
+			Timeout: time.Second * 5,
+		},
+		{
+			Addr:    "127.0.0.1:12053",
+			Proto:   "udp",
+			Timeout: time.Second * 5,
+		},
+	})
+	raceGenerator.ServerStrategy = resolver.StrategyFailover
+	raceGenerator.Attempts = 1
+	return raceGenerator
+}
+
+func queryRace(t *testing.T, raceGenerator *resolver.Generator) {
+	startTime := time.Now()
+	answer, _, _, _, rcode, _, _ := raceGenerator.HandleQuestion([]dns.Question{{
+		Name:   "example.com.",
+		Qtype:  dns.TypeA,
+		Qclass: dns.ClassINET,
+	}}, true, false, false, nil)
+
+	assert.Equal(t, dns.RcodeSuccess, rcode)
+	assert.Len(t, answer, 1)
+	assert.Less(t, time.Since(startTime), time.Second)
+}
+
+func TestRaceUpstreams(t *testing.T) {
+	raceGenerator := newRaceGenerator(t)
+	raceGenerator.RaceCount = 2
+	queryRace(t, raceGenerator)
+}
+
+func TestHedgeUpstreams(t *testing.T) {
+	raceGenerator := newRaceGenerator(t)
+	raceGenerator.HedgeDelay = time.Millisecond * 50
+	queryRace(t, raceGenerator)
+}
+
+func TestRaceUsesDistinctUpstreams(t *testing.T) {
+	raceGenerator := newRaceGenerator(t)
+	raceGenerator.RaceCount = 2
+
+	// Only one of both servers answers, so every race must have asked both
+	for _, strategy := range []resolver.ServerStrategy{resolver.StrategyRoundRobin, resolver.StrategyRandom, resolver.StrategyFastest} {
+		raceGenerator.ServerStrategy = strategy
+		for range 10 {
+			raceGenerator.FlushCache()
+			queryRace(t, raceGenerator)
+		}
+	}
+}
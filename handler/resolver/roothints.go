@@ -0,0 +1,32 @@
+package resolver
+
+// Addresses of the root name servers (a.root-servers.net through m.root-servers.net)
+// as published in https://www.internic.net/domain/named.root
+var defaultRootHints = []string{
+	"198.41.0.4:53",
+	"[2001:503:ba3e::2:30]:53",
+	"170.247.170.2:53",
+	"[2801:1b8:10::b]:53",
+	"192.33.4.12:53",
+	"[2001:500:2::c]:53",
+	"199.7.91.13:53",
+	"[2001:500:2d::d]:53",
+	"192.203.230.10:53",
+	"[2001:500:a8::e]:53",
+	"192.5.5.241:53",
+	"[2001:500:2f::f]:53",
+	"192.112.36.4:53",
+	"[2001:500:12::d0d]:53",
+	"198.97.190.53:53",
+	"[2001:500:1::53]:53",
+	"192.36.148.17:53",
+	"[2001:7fe::53]:53",
+	"192.58.128.30:53",
+	"[2001:503:c27::2:30]:53",
+	"193.0.14.129:53",
+	"[2001:7fd::1]:53",
+	"199.7.83.42:53",
+	"[2001:500:9f::42]:53",
+	"202.12.27.33:53",
+	"[2001:dc3::35]:53",
+}
@@ -0,0 +1,88 @@
+package resolver
+
+import (
+	"crypto/rand"
+	"errors"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	ErrQuestionMismatch     = errors.New("upstream response does not match the question")
+	ErrQuestionCaseMismatch = errors.New("upstream response does not match the case of the question")
+)
+
+var (
+	upstreamSpoofedResponses = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "foxdns_resolver_upstream_spoofed_responses_total",
+		Help: "The total number of upstream responses rejected as possibly spoofed",
+	}, []string{"server", "reason"})
+)
+
+// usesFreshSocket checks whether every query to this server should go out from a new random source port
+func (s *ServerConfig) usesFreshSocket() bool {
+	return s.Proto == "udp" || s.Proto == ""
+}
+
+// randomiseCase flips the case of the letters in name at random (DNS 0x20)
+func randomiseCase(name string) string {
+	bits := make([]byte, (len(name)+7)/8)
+	_, _ = rand.Read(bits)
+
+	randomised := []byte(name)
+	for i, c := range randomised {
+		if bits[i/8]&(1<<(i%8)) == 0 {
+			continue
+		}
+		if c >= 'a' && c <= 'z' {
+			randomised[i] = c - 'a' + 'A'
+		} else if c >= 'A' && c <= 'Z' {
+			randomised[i] = c - 'A' + 'a'
+		}
+	}
+	return string(randomised)
+}
+
+// checkResponseQuestion makes sure resp answers exactly the question of m.
+// With exactCase the name has to match including its case, as required for DNS 0x20.
+func checkResponseQuestion(server string, m *dns.Msg, resp *dns.Msg, exactCase bool) error {
+	if len(resp.Question) != 1 {
+		upstreamSpoofedResponses.WithLabelValues(server, "question").Inc()
+		return ErrQuestionMismatch
+	}
+
+	q := m.Question[0]
+	respQ := resp.Question[0]
+	if q.Qtype != respQ.Qtype || q.Qclass != respQ.Qclass || !equalName(q.Name, respQ.Name) {
+		upstreamSpoofedResponses.WithLabelValues(server, "question").Inc()
+		return ErrQuestionMismatch
+	}
+
+	if exactCase && q.Name != respQ.Name {
+		upstreamSpoofedResponses.WithLabelValues(server, "case").Inc()
+		return ErrQuestionCaseMismatch
+	}
+	return nil
+}
+
+// restoreQuestionCase undoes randomiseCase in resp, so the randomised name does not end up in the cache
+func restoreQuestionCase(resp *dns.Msg, randomised string, original string) {
+	if randomised == original {
+		return
+	}
+
+	for i := range resp.Question {
+		if resp.Question[i].Name == randomised {
+			resp.Question[i].Name = original
+		}
+	}
+	for _, section := range [][]dns.RR{resp.Answer, resp.Ns, resp.Extra} {
+		for _, rr := range section {
+			if rrHdr := rr.Header(); rrHdr.Name == randomised {
+				rrHdr.Name = original
+			}
+		}
+	}
+}
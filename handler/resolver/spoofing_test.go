@@ -0,0 +1,82 @@
+package resolver_test
+
+import (
+	"strings"
+	"testing"
+	"unicode"
+
+	"github.com/Doridian/foxDNS/handler/resolver"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// rewriteQuestionHandler answers like the simple zone, but rewrites the question section of the reply
+func rewriteQuestionHandler(rewrite func(name string) string) dns.HandlerFunc {
+	return func(wr dns.ResponseWriter, msg *dns.Msg) {
+		origName := msg.Question[0].Name
+		msg.Question[0].Name = dns.CanonicalName(origName)
+		simpleHandler.ServeDNS(&rewriteQuestionWriter{ResponseWriter: wr, name: rewrite(origName)}, msg)
+	}
+}
+
+type rewriteQuestionWriter struct {
+	dns.ResponseWriter
+	name string
+}
+
+func (w *rewriteQuestionWriter) WriteMsg(msg *dns.Msg) error {
+	msg.Question[0].Name = w.name
+	return w.ResponseWriter.WriteMsg(msg)
+}
+
+func queryCaseRandomised(t *testing.T, handler dns.Handler) ([]dns.RR, int) {
+	initTests()
+	dummyServer.SetHandler(handler)
+
+	caseGenerator := resolver.New([]*resolver.ServerConfig{
+		{
+			Addr:  "127.0.0.1:12053",
+			Proto: "udp",
+		},
+	})
+	caseGenerator.ServerStrategy = resolver.StrategyFailover
+	caseGenerator.QNameCaseRandomisation = true
+	caseGenerator.Attempts = 1
+
+	answer, _, _, _, rcode, _, _ := caseGenerator.HandleQuestion([]dns.Question{{
+		Name:   "example.com.",
+		Qtype:  dns.TypeA,
+		Qclass: dns.ClassINET,
+	}}, true, false, false, nil)
+	return answer, rcode
+}
+
+func TestQNameCaseRandomisation(t *testing.T) {
+	answer, rcode := queryCaseRandomised(t, rewriteQuestionHandler(func(name string) string {
+		return name
+	}))
+	assert.Equal(t, dns.RcodeSuccess, rcode)
+	if assert.Len(t, answer, 1) {
+		assert.Equal(t, "example.com.", answer[0].Header().Name)
+	}
+}
+
+func TestQNameCaseMismatch(t *testing.T) {
+	// Swapping the case of every letter never matches the randomised name
+	_, rcode := queryCaseRandomised(t, rewriteQuestionHandler(func(name string) string {
+		return strings.Map(func(r rune) rune {
+			if unicode.IsUpper(r) {
+				return unicode.ToLower(r)
+			}
+			return unicode.ToUpper(r)
+		}, name)
+	}))
+	assert.Equal(t, dns.RcodeServerFailure, rcode)
+}
+
+func TestQuestionMismatch(t *testing.T) {
+	_, rcode := queryCaseRandomised(t, rewriteQuestionHandler(func(string) string {
+		return "other.example.com."
+	}))
+	assert.Equal(t, dns.RcodeServerFailure, rcode)
+}
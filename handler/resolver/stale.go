@@ -0,0 +1,100 @@
+package resolver
+
+import (
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// TTL of stale answers as recommended by RFC 8767
+const staleAnswerTTL = 30
+
+type resolveResult struct {
+	matchType string
+	msg       *dns.Msg
+	upstream  string
+	err       error
+}
+
+// staleKeepPeriod is how long expired entries have to be kept around to be served stale
+func (g *Generator) staleKeepPeriod() time.Duration {
+	return max(g.CacheReturnStalePeriod, g.CacheMaxStalePeriod)
+}
+
+// getStaleFromCache returns an expired cache entry that is still within CacheMaxStalePeriod (RFC 8767),
+// for use when the upstream servers are slow or unreachable. Also returns the upstream server it came from.
+func (g *Generator) getStaleFromCache(key string, keyDomain string, checkingDisabled bool) (*dns.Msg, string) {
+	if g.CacheMaxStalePeriod <= 0 {
+		return nil, ""
+	}
+
+	entry, ok := g.cache.Peek(key)
+	if !ok {
+		entry, ok = g.cache.Peek(keyDomain)
+		if !ok {
+			return nil, ""
+		}
+	}
+
+	if entry.bogusMsg != nil && !checkingDisabled {
+		return nil, ""
+	}
+
+	if g.CurrentTime().Sub(entry.expiry) >= g.CacheMaxStalePeriod {
+		return nil, ""
+	}
+
+	msg := entry.msg.Copy()
+	for _, section := range [][]dns.RR{msg.Answer, msg.Ns, msg.Extra} {
+		for _, rr := range section {
+			rrHdr := rr.Header()
+			if rrHdr.Rrtype == dns.TypeOPT {
+				continue
+			}
+			rrHdr.Ttl = staleAnswerTTL
+		}
+	}
+
+	extra := make([]dns.RR, 0, len(msg.Extra)+1)
+	for _, rr := range msg.Extra {
+		if rr.Header().Rrtype != dns.TypeOPT {
+			extra = append(extra, rr)
+		}
+	}
+	msg.Extra = append(extra, &dns.OPT{
+		Hdr: dns.RR_Header{
+			Rrtype: dns.TypeOPT,
+		},
+		Option: []dns.EDNS0{
+			&dns.EDNS0_EDE{
+				InfoCode: dns.ExtendedErrorCodeStaleAnswer,
+			},
+		},
+	})
+
+	return msg, entry.upstream
+}
+
+func isUsableResult(msg *dns.Msg, err error) bool {
+	return err == nil && msg.Rcode != dns.RcodeServerFailure
+}
+
+// waitTimeout waits for wg, returning false if that took longer than timeout
+func waitTimeout(wg *sync.WaitGroup, timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-done:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
@@ -0,0 +1,86 @@
+package resolver_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func queryStale() ([]dns.RR, []dns.EDNS0, int) {
+	answer, _, _, edns0, rcode, _, _ := resolverGenerator.HandleQuestion([]dns.Question{{
+		Name:   "example.com.",
+		Qtype:  dns.TypeA,
+		Qclass: dns.ClassINET,
+	}}, true, true, false, nil)
+	return answer, edns0, rcode
+}
+
+func TestServeStaleOnFailure(t *testing.T) {
+	initTests()
+	resolverGenerator.CacheMaxStalePeriod = time.Minute
+	defer func() {
+		resolverGenerator.CacheMaxStalePeriod = 0
+	}()
+
+	answer, _, rcode := queryStale()
+	assert.Equal(t, dns.RcodeSuccess, rcode)
+	assert.Len(t, answer, 1)
+
+	fakedTime := time.Now().Add(10 * time.Second)
+	resolverGenerator.CurrentTime = func() time.Time {
+		return fakedTime
+	}
+	dummyServer.SetHandler(dns.HandlerFunc(servfailHandler))
+
+	answer, edns0, rcode := queryStale()
+	assert.Equal(t, dns.RcodeSuccess, rcode)
+	if assert.Len(t, answer, 1) {
+		assert.Equal(t, uint32(30), answer[0].Header().Ttl)
+	}
+	assertEDE(t, edns0, dns.ExtendedErrorCodeStaleAnswer)
+
+	// Past the max stale period the failure is passed on
+	fakedTime = fakedTime.Add(time.Minute)
+	_, _, rcode = queryStale()
+	assert.Equal(t, dns.RcodeServerFailure, rcode)
+}
+
+func TestServeStaleOnTimeout(t *testing.T) {
+	initTests()
+	resolverGenerator.CacheMaxStalePeriod = time.Minute
+	resolverGenerator.StaleAnswerClientTimeout = 50 * time.Millisecond
+	defer func() {
+		resolverGenerator.CacheMaxStalePeriod = 0
+		resolverGenerator.StaleAnswerClientTimeout = 0
+	}()
+
+	_, _, rcode := queryStale()
+	assert.Equal(t, dns.RcodeSuccess, rcode)
+
+	fakedTime := time.Now().Add(10 * time.Second)
+	resolverGenerator.CurrentTime = func() time.Time {
+		return fakedTime
+	}
+	dummyServer.SetHandler(dns.HandlerFunc(func(wr dns.ResponseWriter, msg *dns.Msg) {
+		time.Sleep(250 * time.Millisecond)
+		simpleHandler.ServeDNS(wr, msg)
+	}))
+
+	start := time.Now()
+	answer, edns0, rcode := queryStale()
+	assert.Less(t, time.Since(start), 200*time.Millisecond)
+	assert.Equal(t, dns.RcodeSuccess, rcode)
+	assert.Len(t, answer, 1)
+	assertEDE(t, edns0, dns.ExtendedErrorCodeStaleAnswer)
+
+	// The refresh carried on in the background and updated the cache
+	time.Sleep(400 * time.Millisecond)
+	answer, edns0, rcode = queryStale()
+	assert.Equal(t, dns.RcodeSuccess, rcode)
+	if assert.Len(t, answer, 1) {
+		assert.Equal(t, uint32(5), answer[0].Header().Ttl)
+	}
+	assert.Empty(t, edns0)
+}
@@ -19,8 +19,11 @@ var resolverGenerator *resolver.Generator
 var simpleHandler dns.Handler
 
 func loadSimpleZone(zone string) dns.Handler {
-	staticHandler := static.New(false, nil, nil)
-	err := staticHandler.LoadZone(bytes.NewReader([]byte(zone)), "example.com.db", "example.com.", 300, false)
+	staticHandler, err := static.New(false, nil, nil)
+	if err != nil {
+		panic(err)
+	}
+	err = staticHandler.LoadZone(bytes.NewReader([]byte(zone)), "example.com.db", "example.com.", 300, false)
 	if err != nil {
 		panic(err)
 	}
@@ -58,7 +61,7 @@ func initTests() {
 func queryResolver(q dns.Question) *dns.Msg {
 	initTests()
 
-	answer, ns, _, rcode, _ := resolverGenerator.HandleQuestion([]dns.Question{q}, true, true, nil)
+	answer, ns, _, _, rcode, _, _ := resolverGenerator.HandleQuestion([]dns.Question{q}, true, true, false, nil)
 
 	return &dns.Msg{
 		MsgHdr: dns.MsgHdr{
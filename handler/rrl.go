@@ -0,0 +1,266 @@
+package handler
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Doridian/foxDNS/util"
+	lru "github.com/hashicorp/golang-lru/v2"
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	rrlResponses = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "foxdns_rrl_responses_total",
+		Help: "The total number of authoritative responses over the response rate limit",
+	}, []string{"class", "action"})
+)
+
+const (
+	defaultRRLWindow     = 15 * time.Second
+	defaultRRLIPv4Prefix = 24
+	defaultRRLIPv6Prefix = 56
+	defaultRRLMaxEntries = 100000
+
+	rrlClassResponse = "response"
+	rrlClassNoData   = "nodata"
+	rrlClassNXDomain = "nxdomain"
+	rrlClassError    = "error"
+)
+
+// RRLConfig configures response rate limiting for authoritative answers, modelled after BIND's rate-limit
+type RRLConfig struct {
+	// Identical responses per second per client prefix, 0 disables RRL
+	ResponsesPerSecond float64 `yaml:"responses-per-second"`
+	// NXDOMAIN responses per second per client prefix and zone, defaults to responses-per-second
+	NXDomainsPerSecond float64 `yaml:"nxdomains-per-second"`
+	// Error responses per second per client prefix, defaults to responses-per-second
+	ErrorsPerSecond float64 `yaml:"errors-per-second"`
+
+	// Period over which rates are averaged, allowing bursts of rate * window responses
+	Window time.Duration `yaml:"window"`
+	// Answer every Nth limited response with an empty TC=1 reply instead of dropping it, 0 drops all
+	Slip int `yaml:"slip"`
+
+	IPv4Prefix int      `yaml:"ipv4-prefix"`
+	IPv6Prefix int      `yaml:"ipv6-prefix"`
+	Exempt     []string `yaml:"exempt"`
+	MaxEntries int      `yaml:"max-entries"`
+
+	// Only log and count responses that would be limited
+	LogOnly bool `yaml:"log-only"`
+}
+
+// ResponseRateLimiter tracks a token bucket per client prefix and response class
+type ResponseRateLimiter struct {
+	rates    map[string]float64
+	window   float64
+	slip     uint64
+	ipv4Mask net.IPMask
+	ipv6Mask net.IPMask
+	exempt   []*AddrMatcher
+	logOnly  bool
+
+	buckets    *lru.Cache[string, *util.TokenBucket]
+	bucketLock sync.Mutex
+}
+
+var activeRRL atomic.Pointer[ResponseRateLimiter]
+
+// SetResponseRateLimiter installs rrl for all authoritative handlers, nil disables RRL
+func SetResponseRateLimiter(rrl *ResponseRateLimiter) {
+	activeRRL.Store(rrl)
+}
+
+// SetRRLConfig configures response rate limiting of all authoritative handlers, nil disables it
+func SetRRLConfig(config *RRLConfig) error {
+	rrl, err := NewResponseRateLimiter(config)
+	if err != nil {
+		return err
+	}
+	SetResponseRateLimiter(rrl)
+	return nil
+}
+
+// NewResponseRateLimiter validates config and builds its limiter, nil or a rate of 0 returns a nil limiter
+func NewResponseRateLimiter(config *RRLConfig) (*ResponseRateLimiter, error) {
+	if config == nil || config.ResponsesPerSecond <= 0 {
+		return nil, nil
+	}
+
+	ipv4Prefix := config.IPv4Prefix
+	if ipv4Prefix <= 0 {
+		ipv4Prefix = defaultRRLIPv4Prefix
+	}
+	ipv6Prefix := config.IPv6Prefix
+	if ipv6Prefix <= 0 {
+		ipv6Prefix = defaultRRLIPv6Prefix
+	}
+	if ipv4Prefix > 32 || ipv6Prefix > 128 {
+		return nil, fmt.Errorf("invalid RRL prefix length")
+	}
+
+	window := config.Window
+	if window <= 0 {
+		window = defaultRRLWindow
+	}
+
+	nxdomainRate := config.NXDomainsPerSecond
+	if nxdomainRate <= 0 {
+		nxdomainRate = config.ResponsesPerSecond
+	}
+	errorRate := config.ErrorsPerSecond
+	if errorRate <= 0 {
+		errorRate = config.ResponsesPerSecond
+	}
+
+	maxEntries := config.MaxEntries
+	if maxEntries <= 0 {
+		maxEntries = defaultRRLMaxEntries
+	}
+	buckets, err := lru.New[string, *util.TokenBucket](maxEntries)
+	if err != nil {
+		return nil, err
+	}
+
+	rrl := &ResponseRateLimiter{
+		rates: map[string]float64{
+			rrlClassResponse: config.ResponsesPerSecond,
+			rrlClassNoData:   config.ResponsesPerSecond,
+			rrlClassNXDomain: nxdomainRate,
+			rrlClassError:    errorRate,
+		},
+		window:   window.Seconds(),
+		ipv4Mask: net.CIDRMask(ipv4Prefix, 32),
+		ipv6Mask: net.CIDRMask(ipv6Prefix, 128),
+		logOnly:  config.LogOnly,
+		buckets:  buckets,
+	}
+	if config.Slip > 0 {
+		rrl.slip = uint64(config.Slip)
+	}
+
+	for _, exempt := range config.Exempt {
+		matcher, err := ParseAddrMatcher(exempt)
+		if err != nil {
+			return nil, err
+		}
+		rrl.exempt = append(rrl.exempt, matcher)
+	}
+
+	return rrl, nil
+}
+
+// wildcardName returns the wildcard a signed answer was synthesized from, if any
+func wildcardName(answer []dns.RR) string {
+	for _, rr := range answer {
+		sig, ok := rr.(*dns.RRSIG)
+		if !ok {
+			continue
+		}
+		labels := dns.SplitDomainName(sig.Hdr.Name)
+		if int(sig.Labels) < len(labels) {
+			return dns.Fqdn("*." + strings.Join(labels[len(labels)-int(sig.Labels):], "."))
+		}
+	}
+	return ""
+}
+
+// classifyResponse groups similar responses, so limits can't be evaded by varying the query name
+func classifyResponse(q *dns.Question, reply *dns.Msg) (string, string) {
+	switch reply.Rcode {
+	case dns.RcodeSuccess:
+		if len(reply.Answer) == 0 {
+			return rrlClassNoData, q.Name
+		}
+		if wildcard := wildcardName(reply.Answer); wildcard != "" {
+			return rrlClassResponse, fmt.Sprintf("%s:%d", wildcard, q.Qtype)
+		}
+		return rrlClassResponse, fmt.Sprintf("%s:%d", q.Name, q.Qtype)
+	case dns.RcodeNameError:
+		// All NXDOMAINs of a zone share a bucket, random subdomains are the usual attack
+		for _, rr := range reply.Ns {
+			if rr.Header().Rrtype == dns.TypeSOA {
+				return rrlClassNXDomain, dns.CanonicalName(rr.Header().Name)
+			}
+		}
+		return rrlClassNXDomain, q.Name
+	default:
+		return rrlClassError, ""
+	}
+}
+
+func (r *ResponseRateLimiter) getBucket(key string, burst float64, now time.Time) *util.TokenBucket {
+	r.bucketLock.Lock()
+	defer r.bucketLock.Unlock()
+
+	bucket, ok := r.buckets.Get(key)
+	if !ok {
+		bucket = util.NewTokenBucket(burst, now)
+		r.buckets.Add(key, bucket)
+	}
+	return bucket
+}
+
+// limit returns false if reply must not be sent.
+// Slipped replies are stripped down to an empty truncated reply.
+func (r *ResponseRateLimiter) limit(wr util.Addressable, msg *dns.Msg, reply *dns.Msg, now time.Time) bool {
+	remoteAddr := wr.RemoteAddr()
+	for _, exempt := range r.exempt {
+		if exempt.Matches(remoteAddr) {
+			return true
+		}
+	}
+
+	class, name := classifyResponse(&msg.Question[0], reply)
+	rate := r.rates[class]
+	burst := max(rate*r.window, 1)
+	client := util.ClientPrefix(util.ExtractIP(remoteAddr), r.ipv4Mask, r.ipv6Mask)
+	key := fmt.Sprintf("%s|%s|%s", client, class, name)
+
+	allowed, limited := r.getBucket(key, burst, now).Take(now, rate, burst)
+	if allowed {
+		return true
+	}
+
+	if r.logOnly {
+		if limited == 1 {
+			log.Printf("RRL would limit %s responses for %s to %s", class, name, client)
+		}
+		rrlResponses.WithLabelValues(class, "log-only").Inc()
+		return true
+	}
+
+	if limited == 1 {
+		log.Printf("RRL limiting %s responses for %s to %s", class, name, client)
+	}
+
+	if r.slip > 0 && limited%r.slip == 0 {
+		rrlResponses.WithLabelValues(class, "slip").Inc()
+		reply.Answer = nil
+		reply.Ns = nil
+		reply.Extra = nil
+		reply.Truncated = true
+		return true
+	}
+
+	rrlResponses.WithLabelValues(class, "drop").Inc()
+	return false
+}
+
+// applyRRL returns false if reply must not be sent.
+// Only UDP is limited, as TCP can't be used for reflection.
+func applyRRL(wr util.Addressable, msg *dns.Msg, reply *dns.Msg) bool {
+	rrl := activeRRL.Load()
+	if rrl == nil || len(msg.Question) == 0 || util.IsLocalQuery(wr) || !util.IsUDPQuery(wr) {
+		return true
+	}
+	return rrl.limit(wr, msg, reply, time.Now())
+}
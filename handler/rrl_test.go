@@ -0,0 +1,153 @@
+package handler_test
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Doridian/foxDNS/handler"
+	"github.com/Doridian/foxDNS/util"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type zoneGenerator struct{}
+
+func (g *zoneGenerator) HandleQuestion(questions []dns.Question, _ bool, _ bool, _ bool, _ util.Addressable) ([]dns.RR, []dns.RR, []dns.RR, []dns.EDNS0, int, bool, string) {
+	if strings.HasPrefix(questions[0].Name, "www.") {
+		answer := []dns.RR{util.FillHeader(&dns.A{A: net.IPv4(192, 0, 2, 1)}, questions[0].Name, dns.TypeA, 60)}
+		return answer, nil, nil, nil, dns.RcodeSuccess, false, ""
+	}
+
+	soa := util.FillHeader(&dns.SOA{
+		Ns:     "ns.example.com.",
+		Mbox:   "hostmaster.example.com.",
+		Minttl: 60,
+	}, "example.com.", dns.TypeSOA, 60)
+	return nil, []dns.RR{soa}, nil, nil, dns.RcodeNameError, false, ""
+}
+
+func (g *zoneGenerator) GetName() string {
+	return "zone"
+}
+
+func (g *zoneGenerator) Refresh() error {
+	return nil
+}
+
+func (g *zoneGenerator) Start() error {
+	return nil
+}
+
+func (g *zoneGenerator) Stop() error {
+	return nil
+}
+
+func setRRL(t *testing.T, config *handler.RRLConfig) {
+	require.NoError(t, handler.SetRRLConfig(config))
+	t.Cleanup(func() {
+		_ = handler.SetRRLConfig(nil)
+	})
+}
+
+func queryRRL(hdl *handler.Handler, network string, name string, client net.IP) *dns.Msg {
+	util.RequireCookie = false
+
+	msg := &dns.Msg{}
+	msg.SetQuestion(name, dns.TypeA)
+
+	wr := &handler.TestResponseWriter{}
+	if network == "udp" {
+		wr.LocalAddrVal = &net.UDPAddr{IP: net.IPv4(192, 0, 2, 53), Port: 53}
+		wr.RemoteAddrVal = &net.UDPAddr{IP: client, Port: 5053}
+	} else {
+		wr.RemoteAddrVal = &net.TCPAddr{IP: client, Port: 5053}
+	}
+	hdl.ServeDNS(wr, msg)
+	return wr.LastMsg
+}
+
+func TestRRLLimitsIdenticalResponses(t *testing.T) {
+	setRRL(t, &handler.RRLConfig{
+		ResponsesPerSecond: 2,
+		Window:             time.Second,
+		Slip:               2,
+	})
+	hdl := handler.New(&zoneGenerator{}, true)
+	client := net.IPv4(198, 51, 100, 1)
+
+	for range 2 {
+		reply := queryRRL(hdl, "udp", "www.example.com.", client)
+		require.NotNil(t, reply)
+		assert.Len(t, reply.Answer, 1)
+	}
+
+	assert.Nil(t, queryRRL(hdl, "udp", "www.example.com.", client))
+	reply := queryRRL(hdl, "udp", "www.example.com.", client)
+	require.NotNil(t, reply)
+	assert.True(t, reply.Truncated)
+	assert.Empty(t, reply.Answer)
+
+	// Same /24, same bucket
+	assert.Nil(t, queryRRL(hdl, "udp", "www.example.com.", net.IPv4(198, 51, 100, 2)))
+
+	// Other answers, other clients and TCP are not affected
+	assert.NotNil(t, queryRRL(hdl, "udp", "www2.example.com.", client))
+	assert.NotNil(t, queryRRL(hdl, "udp", "www.example.com.", net.IPv4(203, 0, 113, 1)))
+	assert.NotNil(t, queryRRL(hdl, "tcp", "www.example.com.", client))
+
+	// Resolvers are not authoritative and never limited
+	resolverHdl := handler.New(&zoneGenerator{}, false)
+	assert.NotNil(t, queryRRL(resolverHdl, "udp", "www.example.com.", client))
+}
+
+func TestRRLGroupsNXDomainByZone(t *testing.T) {
+	setRRL(t, &handler.RRLConfig{
+		ResponsesPerSecond: 10,
+		NXDomainsPerSecond: 1,
+		Window:             time.Second,
+	})
+	hdl := handler.New(&zoneGenerator{}, true)
+	client := net.IPv4(198, 51, 100, 1)
+
+	reply := queryRRL(hdl, "udp", "a.example.com.", client)
+	require.NotNil(t, reply)
+	assert.Equal(t, dns.RcodeNameError, reply.Rcode)
+
+	assert.Nil(t, queryRRL(hdl, "udp", "b.example.com.", client))
+	assert.Nil(t, queryRRL(hdl, "udp", "c.example.com.", client))
+}
+
+func TestRRLLogOnly(t *testing.T) {
+	setRRL(t, &handler.RRLConfig{
+		ResponsesPerSecond: 1,
+		Window:             time.Second,
+		LogOnly:            true,
+	})
+	hdl := handler.New(&zoneGenerator{}, true)
+
+	for range 5 {
+		reply := queryRRL(hdl, "udp", "www.example.com.", net.IPv4(198, 51, 100, 1))
+		require.NotNil(t, reply)
+		assert.Len(t, reply.Answer, 1)
+		assert.False(t, reply.Truncated)
+	}
+}
+
+func TestRRLInvalidConfigKeepsActiveLimiter(t *testing.T) {
+	setRRL(t, &handler.RRLConfig{
+		ResponsesPerSecond: 1,
+		Window:             time.Second,
+	})
+	hdl := handler.New(&zoneGenerator{}, true)
+	client := net.IPv4(198, 51, 100, 1)
+
+	_, err := handler.NewResponseRateLimiter(&handler.RRLConfig{ResponsesPerSecond: 1, Exempt: []string{"bogus"}})
+	require.Error(t, err)
+	require.Error(t, handler.SetRRLConfig(&handler.RRLConfig{ResponsesPerSecond: 1, IPv4Prefix: 33}))
+
+	require.NotNil(t, queryRRL(hdl, "udp", "www.example.com.", client))
+	assert.Nil(t, queryRRL(hdl, "udp", "www.example.com.", client))
+}
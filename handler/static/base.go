@@ -40,7 +40,7 @@ type Generator struct {
 	kskPrivateKey        crypto.PrivateKey
 }
 
-func New(enableFSNotify bool, mux dns.Handler, dnssec *DNSSECConfig) *Generator {
+func New(enableFSNotify bool, mux dns.Handler, dnssec *DNSSECConfig) (*Generator, error) {
 	gen := &Generator{
 		configs:        make([]zoneConfig, 0),
 		records:        make(map[string]map[uint16][]dns.RR),
@@ -49,8 +49,11 @@ func New(enableFSNotify bool, mux dns.Handler, dnssec *DNSSECConfig) *Generator
 		enableFSNotify: enableFSNotify,
 		mux:            mux,
 	}
-	gen.loadDNSSEC(dnssec)
-	return gen
+	err := gen.loadDNSSEC(dnssec)
+	if err != nil {
+		return nil, err
+	}
+	return gen, nil
 }
 
 func (r *Generator) LoadZoneFile(file string, origin string, defaultTTL uint32, includeAllowed bool) error {
@@ -138,7 +141,7 @@ func (r *Generator) addRecord(rr dns.RR) {
 	nameRecs[hdr.Rrtype] = append([]dns.RR{rr}, typeRecs...)
 }
 
-func (r *Generator) findAuthorityRecords(q *dns.Question, rcodeNameError int) ([]dns.RR, []dns.RR, []dns.EDNS0, int, string) {
+func (r *Generator) findAuthorityRecords(q *dns.Question, rcodeNameError int) ([]dns.RR, []dns.RR, []dns.RR, []dns.EDNS0, int, string) {
 	for off, end := 0, false; !end; off, end = dns.NextLabel(q.Name, off) {
 		name := q.Name[off:]
 
@@ -149,25 +152,29 @@ func (r *Generator) findAuthorityRecords(q *dns.Question, rcodeNameError int) ([
 
 		typedRecs := nameRecs[dns.TypeSOA]
 		if len(typedRecs) > 0 {
-			return nil, typedRecs, nil, rcodeNameError, ""
+			return nil, typedRecs, nil, nil, rcodeNameError, ""
 		}
 
 		typedRecs = nameRecs[dns.TypeNS]
 		if len(typedRecs) > 0 {
-			return nil, typedRecs, nil, dns.RcodeSuccess, ""
+			return nil, typedRecs, nil, nil, dns.RcodeSuccess, ""
 		}
 	}
 
-	return nil, nil, nil, rcodeNameError, ""
+	return nil, nil, nil, nil, rcodeNameError, ""
 }
 
-func (r *Generator) HandleQuestion(questions []dns.Question, recurse bool, dnssec bool, wr util.Addressable) ([]dns.RR, []dns.RR, []dns.EDNS0, int, string) {
-	answer, ns, edns0, rcode, handlerName := r.handleQuestionLocal(questions, recurse, dnssec, wr)
+func (r *Generator) HandleQuestion(questions []dns.Question, recurse bool, dnssec bool, _ bool, wr util.Addressable) ([]dns.RR, []dns.RR, []dns.RR, []dns.EDNS0, int, bool, string) {
+	answer, ns, extra, edns0, rcode, handlerName := r.handleQuestionLocal(questions, recurse, dnssec, wr)
 
 	if recurse {
 		answer = r.resolveIfCNAME(questions, rcode, answer, wr)
 	}
 
+	if extra == nil {
+		extra = r.findAdditionalRecords(answer, ns, dnssec)
+	}
+
 	if dnssec {
 		signer, err := r.signResponse(&questions[0], answer)
 		if err != nil {
@@ -177,10 +184,10 @@ func (r *Generator) HandleQuestion(questions []dns.Question, recurse bool, dnsse
 		}
 	}
 
-	return answer, ns, edns0, rcode, handlerName
+	return answer, ns, extra, edns0, rcode, false, handlerName
 }
 
-func (r *Generator) handleQuestionLocal(questions []dns.Question, recurse bool, dnssec bool, wr util.Addressable) ([]dns.RR, []dns.RR, []dns.EDNS0, int, string) {
+func (r *Generator) handleQuestionLocal(questions []dns.Question, recurse bool, dnssec bool, wr util.Addressable) ([]dns.RR, []dns.RR, []dns.RR, []dns.EDNS0, int, string) {
 	q := &questions[0]
 
 	r.recordsLock.RLock()
@@ -188,8 +195,8 @@ func (r *Generator) handleQuestionLocal(questions []dns.Question, recurse bool,
 
 	subResolver := r.subResolvers[q.Name]
 	if subResolver != nil {
-		answer, ns, edns0, rcode, _ := subResolver.HandleQuestion(questions, recurse, false, wr)
-		return answer, ns, edns0, rcode, subResolver.GetName()
+		answer, ns, extra, edns0, rcode, _, _ := subResolver.HandleQuestion(questions, recurse, false, false, wr)
+		return answer, ns, extra, edns0, rcode, subResolver.GetName()
 	}
 
 	nameRecs := r.records[q.Name]
@@ -199,7 +206,7 @@ func (r *Generator) handleQuestionLocal(questions []dns.Question, recurse bool,
 
 	typedRecs := nameRecs[q.Qtype]
 	if len(typedRecs) > 0 {
-		return typedRecs, nil, nil, dns.RcodeSuccess, ""
+		return typedRecs, nil, nil, nil, dns.RcodeSuccess, ""
 	}
 
 	if q.Qtype == dns.TypeCNAME {
@@ -213,7 +220,7 @@ func (r *Generator) handleQuestionLocal(questions []dns.Question, recurse bool,
 
 	cname := typedRecs[0].(*dns.CNAME)
 
-	localResolvedRecs, _, _, _, _ := r.handleQuestionLocal([]dns.Question{
+	localResolvedRecs, _, _, _, _, _ := r.handleQuestionLocal([]dns.Question{
 		{
 			Name:   cname.Target,
 			Qtype:  q.Qtype,
@@ -225,7 +232,78 @@ func (r *Generator) handleQuestionLocal(questions []dns.Question, recurse bool,
 		typedRecs = append(typedRecs, localResolvedRecs...)
 	}
 
-	return typedRecs, nil, nil, dns.RcodeSuccess, ""
+	return typedRecs, nil, nil, nil, dns.RcodeSuccess, ""
+}
+
+func additionalTarget(rr dns.RR) string {
+	switch typedRR := rr.(type) {
+	case *dns.NS:
+		return typedRR.Ns
+	case *dns.MX:
+		return typedRR.Mx
+	case *dns.SRV:
+		return typedRR.Target
+	default:
+		return ""
+	}
+}
+
+// findAdditionalRecords returns in-zone A/AAAA records for NS, MX and SRV targets.
+// Those for answer records are signed if dnssec is set, glue below a delegation never is.
+func (r *Generator) findAdditionalRecords(answer []dns.RR, ns []dns.RR, dnssec bool) []dns.RR {
+	var extra []dns.RR
+	seenTargets := make(map[string]bool)
+
+	for _, rrset := range r.additionalRRsets(answer, seenTargets) {
+		extra = append(extra, rrset...)
+		if !dnssec {
+			continue
+		}
+
+		rrHdr := rrset[0].Header()
+		signer, err := r.signResponse(&dns.Question{Name: rrHdr.Name, Qtype: rrHdr.Rrtype, Qclass: rrHdr.Class}, rrset)
+		if err != nil {
+			log.Printf("Error signing record for %s: %v", rrHdr.Name, err)
+		} else if signer != nil {
+			extra = append(extra, signer)
+		}
+	}
+
+	for _, rrset := range r.additionalRRsets(ns, seenTargets) {
+		extra = append(extra, rrset...)
+	}
+
+	return extra
+}
+
+func (r *Generator) additionalRRsets(section []dns.RR, seenTargets map[string]bool) [][]dns.RR {
+	r.recordsLock.RLock()
+	defer r.recordsLock.RUnlock()
+
+	var rrsets [][]dns.RR
+	for _, rr := range section {
+		target := additionalTarget(rr)
+		if target == "" {
+			continue
+		}
+
+		target = dns.CanonicalName(target)
+		if seenTargets[target] {
+			continue
+		}
+		seenTargets[target] = true
+
+		nameRecs := r.records[target]
+		if nameRecs == nil {
+			continue
+		}
+		for _, rrtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+			if len(nameRecs[rrtype]) > 0 {
+				rrsets = append(rrsets, nameRecs[rrtype])
+			}
+		}
+	}
+	return rrsets
 }
 
 func (r *Generator) clearCache() {
@@ -301,6 +379,10 @@ func (r *Generator) Start() error {
 func (r *Generator) Stop() error {
 	defer r.clearCache()
 
+	if r.watcher == nil {
+		return nil
+	}
+
 	err := r.watcher.Close()
 	if err != nil {
 		return err
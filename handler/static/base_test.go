@@ -2,6 +2,8 @@ package static_test
 
 import (
 	"net"
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/Doridian/foxDNS/handler"
@@ -9,14 +11,17 @@ import (
 	"github.com/Doridian/foxDNS/util"
 	"github.com/miekg/dns"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
-func runStaticTest(handler handler.Generator, q *dns.Question) ([]dns.RR, []dns.RR, []dns.EDNS0, int, string) {
-	return handler.HandleQuestion([]dns.Question{*q}, true, true, nil)
+func runStaticTest(handler handler.Generator, q *dns.Question) ([]dns.RR, []dns.RR, []dns.RR, []dns.EDNS0, int, string) {
+	answer, ns, extra, edns0, rcode, _, handlerName := handler.HandleQuestion([]dns.Question{*q}, true, true, false, nil)
+	return answer, ns, extra, edns0, rcode, handlerName
 }
 
 func TestBasicZone(t *testing.T) {
-	handler := static.New(false, nil, nil)
+	handler, err := static.New(false, nil, nil)
+	assert.NoError(t, err)
 
 	recA := &dns.A{
 		A: net.IPv4(127, 0, 0, 1),
@@ -47,7 +52,7 @@ func TestBasicZone(t *testing.T) {
 	util.FillHeader(recCNAME, "cname.example.com.", dns.TypeCNAME, 60)
 	handler.AddRecord(recCNAME)
 
-	rr, _, _, rcode, _ := runStaticTest(handler, &dns.Question{
+	rr, _, _, _, rcode, _ := runStaticTest(handler, &dns.Question{
 		Name:   "example.com.",
 		Qtype:  dns.TypeA,
 		Qclass: dns.ClassINET,
@@ -56,7 +61,7 @@ func TestBasicZone(t *testing.T) {
 	assert.ElementsMatch(t, []dns.RR{recA}, rr)
 
 	// Correctly gives NXDOMAIN
-	rr, _, _, rcode, _ = runStaticTest(handler, &dns.Question{
+	rr, _, _, _, rcode, _ = runStaticTest(handler, &dns.Question{
 		Name:   "test.example.com.",
 		Qtype:  dns.TypeA,
 		Qclass: dns.ClassINET,
@@ -65,7 +70,7 @@ func TestBasicZone(t *testing.T) {
 	assert.ElementsMatch(t, []dns.RR{}, rr)
 
 	// Does not return types not asked for and no NXDOMAIN
-	rr, _, _, rcode, _ = runStaticTest(handler, &dns.Question{
+	rr, _, _, _, rcode, _ = runStaticTest(handler, &dns.Question{
 		Name:   "example.com.",
 		Qtype:  dns.TypeAAAA,
 		Qclass: dns.ClassINET,
@@ -74,7 +79,7 @@ func TestBasicZone(t *testing.T) {
 	assert.ElementsMatch(t, []dns.RR{}, rr)
 
 	// Only gives type asked for
-	rr, _, _, rcode, _ = runStaticTest(handler, &dns.Question{
+	rr, _, _, _, rcode, _ = runStaticTest(handler, &dns.Question{
 		Name:   "example.com.",
 		Qtype:  dns.TypeTXT,
 		Qclass: dns.ClassINET,
@@ -83,7 +88,7 @@ func TestBasicZone(t *testing.T) {
 	assert.ElementsMatch(t, []dns.RR{recTXT}, rr)
 
 	// Multiple records
-	rr, _, _, rcode, _ = runStaticTest(handler, &dns.Question{
+	rr, _, _, _, rcode, _ = runStaticTest(handler, &dns.Question{
 		Name:   "a2.example.com.",
 		Qtype:  dns.TypeA,
 		Qclass: dns.ClassINET,
@@ -92,7 +97,7 @@ func TestBasicZone(t *testing.T) {
 	assert.ElementsMatch(t, []dns.RR{recA2_1, recA2_2}, rr)
 
 	// Resolves local CNAMEs
-	rr, _, _, rcode, _ = runStaticTest(handler, &dns.Question{
+	rr, _, _, _, rcode, _ = runStaticTest(handler, &dns.Question{
 		Name:   "cname.example.com.",
 		Qtype:  dns.TypeA,
 		Qclass: dns.ClassINET,
@@ -100,3 +105,158 @@ func TestBasicZone(t *testing.T) {
 	assert.Equal(t, dns.RcodeSuccess, rcode)
 	assert.ElementsMatch(t, []dns.RR{recCNAME, recA}, rr)
 }
+
+func TestAdditionalRecords(t *testing.T) {
+	handler, err := static.New(false, nil, nil)
+	assert.NoError(t, err)
+
+	recSOA := &dns.SOA{
+		Ns:     "ns1.example.com.",
+		Mbox:   "hostmaster.example.com.",
+		Serial: 1,
+	}
+	util.FillHeader(recSOA, "example.com.", dns.TypeSOA, 60)
+	handler.AddRecord(recSOA)
+
+	recMX := &dns.MX{
+		Preference: 10,
+		Mx:         "mail.example.com.",
+	}
+	util.FillHeader(recMX, "example.com.", dns.TypeMX, 60)
+	handler.AddRecord(recMX)
+
+	recMailA := &dns.A{
+		A: net.IPv4(127, 0, 0, 25),
+	}
+	util.FillHeader(recMailA, "mail.example.com.", dns.TypeA, 60)
+	handler.AddRecord(recMailA)
+
+	recDelegationNS := &dns.NS{
+		Ns: "ns.sub.example.com.",
+	}
+	util.FillHeader(recDelegationNS, "sub.example.com.", dns.TypeNS, 60)
+	handler.AddRecord(recDelegationNS)
+
+	recGlueA := &dns.A{
+		A: net.IPv4(127, 0, 0, 53),
+	}
+	util.FillHeader(recGlueA, "ns.sub.example.com.", dns.TypeA, 60)
+	handler.AddRecord(recGlueA)
+
+	recGlueAAAA := &dns.AAAA{
+		AAAA: net.ParseIP("fe80::53"),
+	}
+	util.FillHeader(recGlueAAAA, "ns.sub.example.com.", dns.TypeAAAA, 60)
+	handler.AddRecord(recGlueAAAA)
+
+	// Address records for MX targets
+	rr, _, extra, _, rcode, _ := runStaticTest(handler, &dns.Question{
+		Name:   "example.com.",
+		Qtype:  dns.TypeMX,
+		Qclass: dns.ClassINET,
+	})
+	assert.Equal(t, dns.RcodeSuccess, rcode)
+	assert.ElementsMatch(t, []dns.RR{recMX}, rr)
+	assert.ElementsMatch(t, []dns.RR{recMailA}, extra)
+
+	// Glue records for delegations
+	rr, ns, extra, _, rcode, _ := runStaticTest(handler, &dns.Question{
+		Name:   "www.sub.example.com.",
+		Qtype:  dns.TypeA,
+		Qclass: dns.ClassINET,
+	})
+	assert.Equal(t, dns.RcodeSuccess, rcode)
+	assert.Empty(t, rr)
+	assert.ElementsMatch(t, []dns.RR{recDelegationNS}, ns)
+	assert.ElementsMatch(t, []dns.RR{recGlueA, recGlueAAAA}, extra)
+}
+
+func TestDNSSECKeyFileWithoutDNSKEY(t *testing.T) {
+	keyFile := filepath.Join(t.TempDir(), "zsk.key")
+	assert.NoError(t, os.WriteFile(keyFile, []byte("example.com. 60 IN A 127.0.0.1\n"), 0600))
+
+	_, err := static.New(false, nil, &static.DNSSECConfig{
+		Zone:          "example.com.",
+		PublicZSKFile: keyFile,
+	})
+	assert.Error(t, err)
+}
+
+// writeKey generates a key for example.com. and returns the paths of its public and private key files
+func writeKey(t *testing.T, flags uint16) (*dns.DNSKEY, string, string) {
+	key := &dns.DNSKEY{
+		Flags:     flags,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}
+	util.FillHeader(key, "example.com.", dns.TypeDNSKEY, 3600)
+	privateKey, err := key.Generate(256)
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	publicFile := filepath.Join(dir, "key.key")
+	privateFile := filepath.Join(dir, "key.private")
+	require.NoError(t, os.WriteFile(publicFile, []byte(key.String()+"\n"), 0600))
+	require.NoError(t, os.WriteFile(privateFile, []byte(key.PrivateKeyString(privateKey)), 0600))
+	return key, publicFile, privateFile
+}
+
+func TestSignedAdditionalRecords(t *testing.T) {
+	zsk, publicZSK, privateZSK := writeKey(t, dns.ZONE)
+	_, publicKSK, privateKSK := writeKey(t, dns.ZONE|dns.SEP)
+	handler, err := static.New(false, nil, &static.DNSSECConfig{
+		Zone:           "example.com.",
+		PublicZSKFile:  publicZSK,
+		PrivateZSKFile: privateZSK,
+		PublicKSKFile:  publicKSK,
+		PrivateKSKFile: privateKSK,
+	})
+	require.NoError(t, err)
+
+	recMX := &dns.MX{
+		Preference: 10,
+		Mx:         "mail.example.com.",
+	}
+	util.FillHeader(recMX, "example.com.", dns.TypeMX, 60)
+	handler.AddRecord(recMX)
+
+	recMailA := &dns.A{
+		A: net.IPv4(127, 0, 0, 25),
+	}
+	util.FillHeader(recMailA, "mail.example.com.", dns.TypeA, 60)
+	handler.AddRecord(recMailA)
+
+	recDelegationNS := &dns.NS{
+		Ns: "ns.sub.example.com.",
+	}
+	util.FillHeader(recDelegationNS, "sub.example.com.", dns.TypeNS, 60)
+	handler.AddRecord(recDelegationNS)
+
+	recGlueA := &dns.A{
+		A: net.IPv4(127, 0, 0, 53),
+	}
+	util.FillHeader(recGlueA, "ns.sub.example.com.", dns.TypeA, 60)
+	handler.AddRecord(recGlueA)
+
+	// Authoritative address records come with their signature
+	_, _, extra, _, rcode, _ := runStaticTest(handler, &dns.Question{
+		Name:   "example.com.",
+		Qtype:  dns.TypeMX,
+		Qclass: dns.ClassINET,
+	})
+	assert.Equal(t, dns.RcodeSuccess, rcode)
+	require.Len(t, extra, 2)
+	assert.Equal(t, recMailA, extra[0])
+	sig, ok := extra[1].(*dns.RRSIG)
+	require.True(t, ok)
+	assert.Equal(t, dns.TypeA, sig.TypeCovered)
+	assert.NoError(t, sig.Verify(zsk, []dns.RR{recMailA}))
+
+	// Glue is not authoritative, so it is never signed
+	_, _, extra, _, _, _ = runStaticTest(handler, &dns.Question{
+		Name:   "www.sub.example.com.",
+		Qtype:  dns.TypeA,
+		Qclass: dns.ClassINET,
+	})
+	assert.Equal(t, []dns.RR{recGlueA}, extra)
+}
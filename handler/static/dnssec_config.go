@@ -1,6 +1,7 @@
 package static
 
 import (
+	"fmt"
 	"os"
 
 	"github.com/miekg/dns"
@@ -16,9 +17,9 @@ type DNSSECConfig struct {
 	CacheSignatures bool   `yaml:"cache-signatures"`
 }
 
-func (r *Generator) loadDNSSEC(config *DNSSECConfig) {
+func (r *Generator) loadDNSSEC(config *DNSSECConfig) error {
 	if config == nil {
-		return
+		return nil
 	}
 
 	r.signatures = make(map[string]*dns.RRSIG)
@@ -29,47 +30,56 @@ func (r *Generator) loadDNSSEC(config *DNSSECConfig) {
 		// Load ZSK
 		fh, err := os.Open(config.PublicZSKFile)
 		if err != nil {
-			panic(err)
+			return err
 		}
 		pubkey, err := dns.ReadRR(fh, config.PublicZSKFile)
 		_ = fh.Close()
 		if err != nil {
-			panic(err)
+			return err
 		}
 
-		r.zskDNSKEY = pubkey.(*dns.DNSKEY)
+		var ok bool
+		r.zskDNSKEY, ok = pubkey.(*dns.DNSKEY)
+		if !ok {
+			return fmt.Errorf("%s does not contain a DNSKEY record", config.PublicZSKFile)
+		}
 
 		fh, err = os.Open(config.PrivateZSKFile)
 		if err != nil {
-			panic(err)
+			return err
 		}
 		r.zskPrivateKey, err = r.zskDNSKEY.ReadPrivateKey(fh, config.PrivateZSKFile)
 		_ = fh.Close()
 		if err != nil {
-			panic(err)
+			return err
 		}
 
 		// Load KSK
 		fh, err = os.Open(config.PublicKSKFile)
 		if err != nil {
-			panic(err)
+			return err
 		}
 		pubkey, err = dns.ReadRR(fh, config.PublicKSKFile)
 		_ = fh.Close()
 		if err != nil {
-			panic(err)
+			return err
 		}
 
-		r.kskDNSKEY = pubkey.(*dns.DNSKEY)
+		r.kskDNSKEY, ok = pubkey.(*dns.DNSKEY)
+		if !ok {
+			return fmt.Errorf("%s does not contain a DNSKEY record", config.PublicKSKFile)
+		}
 
 		fh, err = os.Open(config.PrivateKSKFile)
 		if err != nil {
-			panic(err)
+			return err
 		}
 		r.kskPrivateKey, err = r.kskDNSKEY.ReadPrivateKey(fh, config.PrivateKSKFile)
 		_ = fh.Close()
 		if err != nil {
-			panic(err)
+			return err
 		}
 	}
+
+	return nil
 }
@@ -0,0 +1,148 @@
+package handler
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+
+	"github.com/Doridian/foxDNS/util"
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	viewQueries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "foxdns_view_queries_total",
+		Help: "The total number of DNS queries per view",
+	}, []string{"view"})
+)
+
+// DefaultViewName is the name queries not matching any view are counted under
+const DefaultViewName = "default"
+
+// AddrMatcher matches an address against a subnet and, optionally, a port
+type AddrMatcher struct {
+	Subnet *net.IPNet
+	Port   int
+}
+
+// ParseAddrMatcher parses a CIDR, an IP address or an IP:port pair
+func ParseAddrMatcher(str string) (*AddrMatcher, error) {
+	matcher := &AddrMatcher{}
+
+	host, portStr, err := net.SplitHostPort(str)
+	if err == nil {
+		matcher.Port, err = strconv.Atoi(portStr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid port in %s: %w", str, err)
+		}
+		str = host
+	}
+
+	_, matcher.Subnet, err = net.ParseCIDR(str)
+	if err == nil {
+		return matcher, nil
+	}
+
+	ip := net.ParseIP(str)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid address or subnet: %s", str)
+	}
+	bits := 128
+	if ip.To4() != nil {
+		ip = ip.To4()
+		bits = 32
+	}
+	matcher.Subnet = &net.IPNet{
+		IP:   ip,
+		Mask: net.CIDRMask(bits, bits),
+	}
+	return matcher, nil
+}
+
+// Matches checks whether addr is in the subnet and, if one is set, uses the port
+func (m *AddrMatcher) Matches(addr net.Addr) bool {
+	if m.Port != 0 {
+		switch convAddr := addr.(type) {
+		case *net.UDPAddr:
+			if convAddr.Port != m.Port {
+				return false
+			}
+		case *net.TCPAddr:
+			if convAddr.Port != m.Port {
+				return false
+			}
+		default:
+			return false
+		}
+	}
+	return m.Subnet.Contains(util.ExtractIP(addr))
+}
+
+type view struct {
+	name      string
+	clients   []*AddrMatcher
+	listeners []*AddrMatcher
+	handler   dns.Handler
+}
+
+func matchesAny(matchers []*AddrMatcher, addr net.Addr) bool {
+	for _, matcher := range matchers {
+		if matcher.Matches(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+func (v *view) matches(wr dns.ResponseWriter) bool {
+	// No matchers means everything matches
+	return (len(v.clients) == 0 || matchesAny(v.clients, wr.RemoteAddr())) &&
+		(len(v.listeners) == 0 || matchesAny(v.listeners, wr.LocalAddr()))
+}
+
+// ViewMux passes queries to the handler of the first view matching the client and listener address.
+// Queries not matching any view go to the default handler, or get REFUSED without one.
+type ViewMux struct {
+	views          []*view
+	defaultHandler dns.Handler
+}
+
+// NewViewMux creates a ViewMux without views, defaultHandler may be nil
+func NewViewMux(defaultHandler dns.Handler) *ViewMux {
+	return &ViewMux{
+		defaultHandler: defaultHandler,
+	}
+}
+
+// AddView adds a view, views are tried in the order they were added.
+// Empty clients or listeners match every address.
+func (m *ViewMux) AddView(name string, clients []*AddrMatcher, listeners []*AddrMatcher, handler dns.Handler) {
+	m.views = append(m.views, &view{
+		name:      name,
+		clients:   clients,
+		listeners: listeners,
+		handler:   handler,
+	})
+}
+
+func (m *ViewMux) ServeDNS(wr dns.ResponseWriter, msg *dns.Msg) {
+	for _, v := range m.views {
+		if v.matches(wr) {
+			viewQueries.WithLabelValues(v.name).Inc()
+			v.handler.ServeDNS(wr, msg)
+			return
+		}
+	}
+
+	if m.defaultHandler != nil {
+		viewQueries.WithLabelValues(DefaultViewName).Inc()
+		m.defaultHandler.ServeDNS(wr, msg)
+		return
+	}
+
+	reply := &dns.Msg{}
+	reply.SetRcode(msg, dns.RcodeRefused)
+	_ = wr.WriteMsg(reply)
+}
@@ -0,0 +1,100 @@
+package handler_test
+
+import (
+	"net"
+	"testing"
+
+	"github.com/Doridian/foxDNS/handler"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type namedHandler struct {
+	name string
+}
+
+func (h *namedHandler) ServeDNS(wr dns.ResponseWriter, msg *dns.Msg) {
+	reply := &dns.Msg{}
+	reply.SetReply(msg)
+	reply.Answer = []dns.RR{&dns.TXT{
+		Hdr: dns.RR_Header{Name: msg.Question[0].Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 60},
+		Txt: []string{h.name},
+	}}
+	_ = wr.WriteMsg(reply)
+}
+
+func mustParseAddrMatchers(t *testing.T, strs ...string) []*handler.AddrMatcher {
+	matchers := make([]*handler.AddrMatcher, 0, len(strs))
+	for _, str := range strs {
+		matcher, err := handler.ParseAddrMatcher(str)
+		require.NoError(t, err)
+		matchers = append(matchers, matcher)
+	}
+	return matchers
+}
+
+func queryView(mux dns.Handler, remote net.IP, local net.IP, localPort int) *dns.Msg {
+	msg := &dns.Msg{}
+	msg.SetQuestion("example.com.", dns.TypeTXT)
+
+	wr := &handler.TestResponseWriter{
+		RemoteAddrVal: &net.UDPAddr{IP: remote, Port: 5053},
+		LocalAddrVal:  &net.UDPAddr{IP: local, Port: localPort},
+	}
+	mux.ServeDNS(wr, msg)
+	return wr.LastMsg
+}
+
+func viewAnswer(t *testing.T, reply *dns.Msg) string {
+	require.NotNil(t, reply)
+	require.Len(t, reply.Answer, 1)
+	return reply.Answer[0].(*dns.TXT).Txt[0]
+}
+
+func TestParseAddrMatcher(t *testing.T) {
+	matcher, err := handler.ParseAddrMatcher("192.0.2.0/24")
+	require.NoError(t, err)
+	assert.Equal(t, "192.0.2.0/24", matcher.Subnet.String())
+	assert.Equal(t, 0, matcher.Port)
+
+	matcher, err = handler.ParseAddrMatcher("2001:db8::1")
+	require.NoError(t, err)
+	assert.Equal(t, "2001:db8::1/128", matcher.Subnet.String())
+
+	matcher, err = handler.ParseAddrMatcher("[2001:db8::1]:5353")
+	require.NoError(t, err)
+	assert.Equal(t, "2001:db8::1/128", matcher.Subnet.String())
+	assert.Equal(t, 5353, matcher.Port)
+
+	_, err = handler.ParseAddrMatcher("not-an-ip")
+	assert.Error(t, err)
+	_, err = handler.ParseAddrMatcher("192.0.2.1:port")
+	assert.Error(t, err)
+}
+
+func TestViewMuxSelectsByClient(t *testing.T) {
+	mux := handler.NewViewMux(&namedHandler{name: "default"})
+	mux.AddView("guest", mustParseAddrMatchers(t, "10.99.0.0/16"), nil, &namedHandler{name: "guest"})
+	mux.AddView("lan", mustParseAddrMatchers(t, "10.0.0.0/8", "fd00::/8"), nil, &namedHandler{name: "lan"})
+
+	local := net.IPv4(10, 0, 0, 1)
+	assert.Equal(t, "guest", viewAnswer(t, queryView(mux, net.IPv4(10, 99, 1, 2), local, 53)))
+	assert.Equal(t, "lan", viewAnswer(t, queryView(mux, net.IPv4(10, 1, 1, 2), local, 53)))
+	assert.Equal(t, "lan", viewAnswer(t, queryView(mux, net.ParseIP("fd00::2"), net.ParseIP("fd00::1"), 53)))
+	assert.Equal(t, "default", viewAnswer(t, queryView(mux, net.IPv4(192, 0, 2, 1), local, 53)))
+}
+
+func TestViewMuxSelectsByListener(t *testing.T) {
+	mux := handler.NewViewMux(nil)
+	mux.AddView("internal", nil, mustParseAddrMatchers(t, "10.0.0.1:5353"), &namedHandler{name: "internal"})
+
+	client := net.IPv4(192, 0, 2, 1)
+	assert.Equal(t, "internal", viewAnswer(t, queryView(mux, client, net.IPv4(10, 0, 0, 1), 5353)))
+
+	// Without a default handler unmatched queries are refused
+	reply := queryView(mux, client, net.IPv4(10, 0, 0, 1), 53)
+	require.NotNil(t, reply)
+	assert.Equal(t, dns.RcodeRefused, reply.Rcode)
+	assert.Empty(t, reply.Answer)
+}
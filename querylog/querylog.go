@@ -0,0 +1,291 @@
+package querylog
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Doridian/foxDNS/util"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	recordsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "foxdns_querylog_records_total",
+		Help: "The total number of query log records, by whether they were written",
+	}, []string{"result"})
+)
+
+const (
+	defaultMaxBackups = 5
+	defaultBufferSize = 10000
+	megabyte          = 1024 * 1024
+)
+
+var (
+	anonymiseIPv4Mask = net.CIDRMask(24, 32)
+	anonymiseIPv6Mask = net.CIDRMask(48, 128)
+)
+
+var ErrNoFile = errors.New("query log needs a file")
+
+type Config struct {
+	File string `yaml:"file"`
+	// Rotate once the file would grow beyond this many MiB, 0 disables rotation
+	MaxSize int `yaml:"max-size"`
+	// Rotated files to keep as file.1, file.2, ...
+	MaxBackups int `yaml:"max-backups"`
+	// Fraction of queries to log, defaults to 1 (all of them), 0 logs none
+	SampleRate *float64 `yaml:"sample-rate"`
+	// Only log the client /24 (IPv4) or /48 (IPv6)
+	Anonymise bool `yaml:"anonymise"`
+	// Records to buffer while the disk is slow, further records are dropped
+	BufferSize int `yaml:"buffer-size"`
+}
+
+// Record is one line of the query log
+type Record struct {
+	Time     time.Time `json:"time"`
+	Client   string    `json:"client"`
+	Protocol string    `json:"protocol"`
+	Name     string    `json:"qname"`
+	Type     string    `json:"qtype"`
+	Rcode    string    `json:"rcode"`
+	Handler  string    `json:"handler"`
+	Cache    string    `json:"cache,omitempty"`
+	Upstream string    `json:"upstream,omitempty"`
+	Duration float64   `json:"duration_ms"`
+}
+
+// Logger writes records from its own goroutine, so a slow disk never blocks queries
+type Logger struct {
+	config     Config
+	sampleRate float64
+	records    chan []byte
+
+	lock sync.Mutex
+	file *os.File
+	size int64
+	stop chan struct{}
+	done chan struct{}
+}
+
+var activeLogger atomic.Pointer[Logger]
+
+func New(config *Config) (*Logger, error) {
+	if config.File == "" {
+		return nil, ErrNoFile
+	}
+	sampleRate := 1.0
+	if config.SampleRate != nil {
+		sampleRate = *config.SampleRate
+	}
+	if sampleRate < 0 || sampleRate > 1 {
+		return nil, fmt.Errorf("query log sample rate must be between 0 and 1")
+	}
+
+	bufferSize := config.BufferSize
+	if bufferSize <= 0 {
+		bufferSize = defaultBufferSize
+	}
+
+	l := &Logger{
+		config:     *config,
+		sampleRate: sampleRate,
+		records:    make(chan []byte, bufferSize),
+	}
+	if l.config.MaxBackups <= 0 {
+		l.config.MaxBackups = defaultMaxBackups
+	}
+	return l, nil
+}
+
+// SetLogger makes l receive all query log records, nil disables the query log
+func SetLogger(l *Logger) {
+	activeLogger.Store(l)
+}
+
+// Sampled returns the active logger if this query should be logged, nil otherwise
+func Sampled() *Logger {
+	l := activeLogger.Load()
+	if l == nil {
+		return nil
+	}
+	if l.sampleRate < 1 && rand.Float64() >= l.sampleRate {
+		recordsTotal.WithLabelValues("skipped").Inc()
+		return nil
+	}
+	return l
+}
+
+// ClientAddr formats addr for the log, anonymised if configured
+func (l *Logger) ClientAddr(addr net.Addr) string {
+	ip := util.ExtractIP(addr)
+	if l.config.Anonymise {
+		return util.ClientPrefix(ip, anonymiseIPv4Mask, anonymiseIPv6Mask)
+	}
+	return ip.String()
+}
+
+func (l *Logger) open() error {
+	fh, err := os.OpenFile(l.config.File, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o640)
+	if err != nil {
+		return err
+	}
+	stat, err := fh.Stat()
+	if err != nil {
+		_ = fh.Close()
+		return err
+	}
+
+	l.file = fh
+	l.size = stat.Size()
+	return nil
+}
+
+func (l *Logger) close() error {
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
+
+// rotate moves file to file.1, file.1 to file.2 and so on, dropping the oldest
+func (l *Logger) rotate() error {
+	err := l.close()
+	if err != nil {
+		return err
+	}
+
+	for i := l.config.MaxBackups - 1; i > 0; i-- {
+		_ = os.Rename(fmt.Sprintf("%s.%d", l.config.File, i), fmt.Sprintf("%s.%d", l.config.File, i+1))
+	}
+	err = os.Rename(l.config.File, l.config.File+".1")
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return l.open()
+}
+
+// Log queues record for writing, or drops it if the buffer is full
+func (l *Logger) Log(record *Record) {
+	line, err := json.Marshal(record)
+	if err != nil {
+		recordsTotal.WithLabelValues("error").Inc()
+		return
+	}
+	line = append(line, '\n')
+
+	select {
+	case l.records <- line:
+	default:
+		recordsTotal.WithLabelValues("dropped").Inc()
+	}
+}
+
+func (l *Logger) run(stop chan struct{}, done chan struct{}) {
+	defer close(done)
+
+	for {
+		select {
+		case line := <-l.records:
+			l.write(line)
+		case <-stop:
+			// Write what is still buffered before the file is closed
+			for {
+				select {
+				case line := <-l.records:
+					l.write(line)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (l *Logger) write(line []byte) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.file == nil {
+		recordsTotal.WithLabelValues("error").Inc()
+		return
+	}
+
+	if l.config.MaxSize > 0 && l.size > 0 && l.size+int64(len(line)) > int64(l.config.MaxSize)*megabyte {
+		err := l.rotate()
+		if err != nil {
+			log.Printf("Error rotating query log: %v", err)
+			if l.file == nil {
+				recordsTotal.WithLabelValues("error").Inc()
+				return
+			}
+		}
+	}
+
+	n, err := l.file.Write(line)
+	l.size += int64(n)
+	if err != nil {
+		recordsTotal.WithLabelValues("error").Inc()
+		return
+	}
+	recordsTotal.WithLabelValues("written").Inc()
+}
+
+func (l *Logger) Start() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.stop != nil {
+		return nil
+	}
+
+	err := l.open()
+	if err != nil {
+		return err
+	}
+	l.stop = make(chan struct{})
+	l.done = make(chan struct{})
+	go l.run(l.stop, l.done)
+	return nil
+}
+
+// Stop writes all buffered records and closes the file
+func (l *Logger) Stop() error {
+	l.lock.Lock()
+	stop, done := l.stop, l.done
+	l.stop, l.done = nil, nil
+	l.lock.Unlock()
+
+	if stop != nil {
+		close(stop)
+		<-done
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.close()
+}
+
+// Refresh reopens the file, for external log rotation
+func (l *Logger) Refresh() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	err := l.close()
+	if err != nil {
+		return err
+	}
+	return l.open()
+}
@@ -0,0 +1,164 @@
+package querylog_test
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Doridian/foxDNS/querylog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func readRecords(t *testing.T, file string) []*querylog.Record {
+	fh, err := os.Open(file)
+	require.NoError(t, err)
+	defer func() {
+		_ = fh.Close()
+	}()
+
+	records := make([]*querylog.Record, 0)
+	scanner := bufio.NewScanner(fh)
+	for scanner.Scan() {
+		record := &querylog.Record{}
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), record))
+		records = append(records, record)
+	}
+	require.NoError(t, scanner.Err())
+	return records
+}
+
+func startLogger(t *testing.T, config *querylog.Config) *querylog.Logger {
+	logger, err := querylog.New(config)
+	require.NoError(t, err)
+	require.NoError(t, logger.Start())
+	querylog.SetLogger(logger)
+	t.Cleanup(func() {
+		querylog.SetLogger(nil)
+		_ = logger.Stop()
+	})
+	return logger
+}
+
+func TestQueryLogWritesRecords(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "query.log")
+	startLogger(t, &querylog.Config{File: file})
+
+	logger := querylog.Sampled()
+	require.NotNil(t, logger)
+	logger.Log(&querylog.Record{
+		Client:   logger.ClientAddr(&net.UDPAddr{IP: net.IPv4(192, 0, 2, 1)}),
+		Name:     "example.com.",
+		Type:     "A",
+		Rcode:    "NOERROR",
+		Handler:  "resolver",
+		Cache:    "miss",
+		Upstream: "192.0.2.53:53",
+	})
+	// Buffered records are written before Stop returns
+	require.NoError(t, logger.Stop())
+
+	records := readRecords(t, file)
+	require.Len(t, records, 1)
+	assert.Equal(t, "192.0.2.1", records[0].Client)
+	assert.Equal(t, "example.com.", records[0].Name)
+	assert.Equal(t, "miss", records[0].Cache)
+	assert.Equal(t, "192.0.2.53:53", records[0].Upstream)
+}
+
+func TestQueryLogAnonymise(t *testing.T) {
+	logger := startLogger(t, &querylog.Config{
+		File:      filepath.Join(t.TempDir(), "query.log"),
+		Anonymise: true,
+	})
+
+	assert.Equal(t, "192.0.2.0", logger.ClientAddr(&net.UDPAddr{IP: net.IPv4(192, 0, 2, 123)}))
+	assert.Equal(t, "2001:db8:1::", logger.ClientAddr(&net.UDPAddr{IP: net.ParseIP("2001:db8:1:2:3::4")}))
+}
+
+func countSampled() int {
+	sampled := 0
+	for range 10000 {
+		if querylog.Sampled() != nil {
+			sampled++
+		}
+	}
+	return sampled
+}
+
+func TestQueryLogSampling(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "query.log")
+	startLogger(t, &querylog.Config{File: file})
+	assert.Equal(t, 10000, countSampled())
+
+	sampleRate := 0.1
+	startLogger(t, &querylog.Config{File: file, SampleRate: &sampleRate})
+	assert.InDelta(t, 1000, countSampled(), 300)
+
+	sampleRate = 0
+	startLogger(t, &querylog.Config{File: file, SampleRate: &sampleRate})
+	assert.Equal(t, 0, countSampled())
+
+	sampleRate = 2
+	_, err := querylog.New(&querylog.Config{File: file, SampleRate: &sampleRate})
+	assert.Error(t, err)
+}
+
+func TestQueryLogDropsWhenFull(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "query.log")
+	logger, err := querylog.New(&querylog.Config{File: file, BufferSize: 2})
+	require.NoError(t, err)
+
+	// Nothing writes records before Start, so only the first two fit into the buffer
+	for _, name := range []string{"a.example.com.", "b.example.com.", "c.example.com."} {
+		logger.Log(&querylog.Record{Name: name})
+	}
+	require.NoError(t, logger.Start())
+	require.NoError(t, logger.Stop())
+
+	records := readRecords(t, file)
+	require.Len(t, records, 2)
+	assert.Equal(t, "a.example.com.", records[0].Name)
+	assert.Equal(t, "b.example.com.", records[1].Name)
+}
+
+func TestQueryLogRotateAndReopen(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "query.log")
+	logger := startLogger(t, &querylog.Config{
+		File:       file,
+		MaxSize:    1,
+		MaxBackups: 2,
+	})
+
+	// Each record is a bit over 100KiB, so about 10 fit into a file
+	record := &querylog.Record{Name: strings.Repeat("a", 100*1024)}
+	for range 25 {
+		logger.Log(record)
+	}
+	require.NoError(t, logger.Stop())
+
+	_, err := os.Stat(file + ".1")
+	require.NoError(t, err)
+	_, err = os.Stat(file + ".2")
+	require.NoError(t, err)
+	_, err = os.Stat(file + ".3")
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	stat, err := os.Stat(file)
+	require.NoError(t, err)
+	assert.LessOrEqual(t, stat.Size(), int64(1024*1024))
+
+	// Reopening after the file was moved away starts a new one
+	require.NoError(t, logger.Start())
+	require.NoError(t, os.Rename(file, file+".moved"))
+	require.NoError(t, logger.Refresh())
+	logger.Log(&querylog.Record{Name: "example.com."})
+	require.NoError(t, logger.Stop())
+	records := readRecords(t, file)
+	require.Len(t, records, 1)
+	assert.Equal(t, "example.com.", records[0].Name)
+}
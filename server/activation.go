@@ -0,0 +1,52 @@
+package server
+
+import (
+	"crypto/tls"
+	"net"
+)
+
+// File descriptor names (systemd FileDescriptorName=) selecting the protocol of inherited stream sockets.
+// Any other name serves plain DNS.
+const (
+	InheritedNameTLS = "tls"
+	InheritedNameDoH = "doh"
+)
+
+// InheritedListener is a socket passed to us already bound, exactly one of Listener and PacketConn is set
+type InheritedListener struct {
+	Name       string
+	Listener   net.Listener
+	PacketConn net.PacketConn
+}
+
+// SetInheritedListeners makes the server serve the given sockets instead of binding its configured
+// listen addresses, so it can run without privileges and restart without closing them.
+// This only has an effect before Serve is called.
+func (s *Server) SetInheritedListeners(listeners []*InheritedListener) {
+	s.serverLock.Lock()
+	defer s.serverLock.Unlock()
+	if s.serving {
+		return
+	}
+	s.inherited = listeners
+}
+
+func (s *Server) serveInherited(listener *InheritedListener, doh *DoHConfig) {
+	if listener.PacketConn != nil {
+		go s.serve("udp", listener.PacketConn.LocalAddr().String(), nil, listener.PacketConn)
+		return
+	}
+
+	addr := listener.Listener.Addr().String()
+	switch listener.Name {
+	case InheritedNameTLS:
+		go s.serve("tcp-tls", addr, tls.NewListener(listener.Listener, s.tls.config), nil)
+	case InheritedNameDoH:
+		if doh == nil {
+			doh = &DoHConfig{}
+		}
+		go s.serveDoH(doh, addr, listener.Listener)
+	default:
+		go s.serve("tcp", addr, listener.Listener, nil)
+	}
+}
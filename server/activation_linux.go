@@ -0,0 +1,77 @@
+//go:build linux
+
+package server
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+const listenFDsStart = 3
+
+// SystemdListeners returns the sockets passed via systemd socket activation (LISTEN_FDS), if any
+func SystemdListeners() ([]*InheritedListener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count <= 0 {
+		return nil, nil
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+	// The sockets are ours now, child processes must not pick them up
+	_ = os.Unsetenv("LISTEN_PID")
+	_ = os.Unsetenv("LISTEN_FDS")
+	_ = os.Unsetenv("LISTEN_FDNAMES")
+
+	listeners := make([]*InheritedListener, 0, count)
+	for i := range count {
+		fd := listenFDsStart + i
+		syscall.CloseOnExec(fd)
+
+		name := ""
+		if i < len(names) {
+			name = names[i]
+		}
+
+		listener, err := inheritedFromFD(fd, name)
+		if err != nil {
+			return nil, err
+		}
+		listeners = append(listeners, listener)
+	}
+	return listeners, nil
+}
+
+func inheritedFromFD(fd int, name string) (*InheritedListener, error) {
+	sotype, err := syscall.GetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_TYPE)
+	if err != nil {
+		return nil, fmt.Errorf("inherited fd %d (%s) is not a socket: %w", fd, name, err)
+	}
+
+	// net.File* duplicate the descriptor, so the original can be closed either way
+	file := os.NewFile(uintptr(fd), name)
+	defer func() {
+		_ = file.Close()
+	}()
+
+	listener := &InheritedListener{Name: name}
+	switch sotype {
+	case syscall.SOCK_STREAM:
+		listener.Listener, err = net.FileListener(file)
+	case syscall.SOCK_DGRAM:
+		listener.PacketConn, err = net.FilePacketConn(file)
+	default:
+		err = fmt.Errorf("unsupported socket type %d", sotype)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error using inherited fd %d (%s): %w", fd, name, err)
+	}
+	return listener, nil
+}
@@ -0,0 +1,7 @@
+//go:build !linux
+
+package server
+
+func SystemdListeners() ([]*InheritedListener, error) {
+	return nil, nil
+}
@@ -0,0 +1,58 @@
+package server_test
+
+import (
+	"net"
+	"testing"
+
+	"github.com/Doridian/foxDNS/server"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInheritedListeners(t *testing.T) {
+	packetConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	// Configured listen addresses must not be bound
+	srv := server.NewServer([]string{"127.0.0.1:-1"}, false)
+	srv.SetHandler(&countingHandler{})
+	srv.SetInheritedListeners([]*server.InheritedListener{
+		{Name: "dns", PacketConn: packetConn},
+		{Name: "dns", Listener: listener},
+	})
+
+	served := make(chan struct{})
+	go func() {
+		srv.Serve()
+		close(served)
+	}()
+	srv.WaitReady()
+
+	msg := &dns.Msg{}
+	msg.SetQuestion("example.com.", dns.TypeA)
+
+	for network, addr := range map[string]string{
+		"udp": packetConn.LocalAddr().String(),
+		"tcp": listener.Addr().String(),
+	} {
+		client := &dns.Client{Net: network}
+		reply, _, err := client.Exchange(msg, addr)
+		require.NoError(t, err, network)
+		assert.Equal(t, dns.RcodeSuccess, reply.Rcode, network)
+	}
+
+	srv.Shutdown()
+	<-served
+}
+
+func TestSystemdListenersIgnoresOtherPID(t *testing.T) {
+	t.Setenv("LISTEN_PID", "1")
+	t.Setenv("LISTEN_FDS", "2")
+
+	listeners, err := server.SystemdListeners()
+	require.NoError(t, err)
+	assert.Empty(t, listeners)
+}
@@ -2,6 +2,8 @@ package server
 
 import (
 	"log"
+	gonet "net"
+	"net/http"
 	"sync"
 
 	"github.com/Doridian/foxDNS/util"
@@ -9,9 +11,14 @@ import (
 )
 
 type Server struct {
-	listen []string
+	listen    []string
+	tlsListen []string
+	tls       *tlsHolder
+	doh       *DoHConfig
+	inherited []*InheritedListener
 
 	handler     dns.Handler
+	rateLimiter *RateLimiter
 	handlerLock sync.RWMutex
 
 	serveWait      sync.WaitGroup
@@ -19,22 +26,34 @@ type Server struct {
 	privDropWait   sync.WaitGroup
 	enablePrivDrop bool
 
-	serverLock sync.Mutex
-	servers    map[*dns.Server]bool
+	serverLock  sync.Mutex
+	servers     map[*dns.Server]bool
+	httpServers map[*http.Server]bool
+	serving     bool
 }
 
 func NewServer(listen []string, enablePrivDrop bool) *Server {
-	return &Server{
+	s := &Server{
 		listen:         listen,
+		tls:            newTLSHolder(),
 		servers:        make(map[*dns.Server]bool),
+		httpServers:    make(map[*http.Server]bool),
 		enablePrivDrop: enablePrivDrop,
 	}
+	// Held until Serve has started all listeners, so WaitReady can be called before Serve
+	s.privDropWait.Add(1)
+	return s
 }
 
 func (s *Server) ServeDNS(wr dns.ResponseWriter, msg *dns.Msg) {
 	s.handlerLock.RLock()
 	handler := s.handler
+	limiter := s.rateLimiter
 	s.handlerLock.RUnlock()
+
+	if !s.applyRateLimit(limiter, wr, msg) {
+		return
+	}
 	handler.ServeDNS(wr, msg)
 }
 
@@ -50,16 +69,22 @@ func (s *Server) WaitReady() {
 }
 
 func (s *Server) Serve() {
-	s.privDropWait.Add(1)
-
-	for _, listen := range s.listen {
-		s.initWait.Add(1)
-		s.serveWait.Add(1)
-		go s.serve("tcp", listen)
+	s.serverLock.Lock()
+	s.serving = true
+	tlsListen := s.tlsListen
+	doh := s.doh
+	inherited := s.inherited
+	s.serverLock.Unlock()
 
-		s.initWait.Add(1)
-		s.serveWait.Add(1)
-		go s.serve("udp", listen)
+	if len(inherited) > 0 {
+		log.Printf("Using %d inherited sockets instead of configured listen addresses", len(inherited))
+		for _, listener := range inherited {
+			s.initWait.Add(1)
+			s.serveWait.Add(1)
+			s.serveInherited(listener, doh)
+		}
+	} else {
+		s.listenAll(tlsListen, doh)
 	}
 
 	s.initWait.Wait()
@@ -73,6 +98,32 @@ func (s *Server) Serve() {
 	s.serveWait.Wait()
 }
 
+func (s *Server) listenAll(tlsListen []string, doh *DoHConfig) {
+	for _, listen := range s.listen {
+		s.initWait.Add(1)
+		s.serveWait.Add(1)
+		go s.serve("tcp", listen, nil, nil)
+
+		s.initWait.Add(1)
+		s.serveWait.Add(1)
+		go s.serve("udp", listen, nil, nil)
+	}
+
+	for _, listen := range tlsListen {
+		s.initWait.Add(1)
+		s.serveWait.Add(1)
+		go s.serve("tcp-tls", listen, nil, nil)
+	}
+
+	if doh != nil {
+		for _, listen := range doh.Listen {
+			s.initWait.Add(1)
+			s.serveWait.Add(1)
+			go s.serveDoH(doh, listen, nil)
+		}
+	}
+}
+
 const QRBit = 1 << 15
 
 func msgAcceptFunc(dh dns.Header) dns.MsgAcceptAction {
@@ -92,7 +143,8 @@ func msgAcceptFunc(dh dns.Header) dns.MsgAcceptAction {
 	return dns.MsgAccept
 }
 
-func (s *Server) serve(net string, addr string) {
+// serve binds addr, unless an already bound listener or packetConn is given
+func (s *Server) serve(net string, addr string, listener gonet.Listener, packetConn gonet.PacketConn) {
 	defer s.serveWait.Done()
 	initWaitSync := sync.Mutex{}
 	initWaitSet := false
@@ -112,11 +164,14 @@ func (s *Server) serve(net string, addr string) {
 	dnsServer := &dns.Server{
 		Addr:          addr,
 		Net:           net,
+		Listener:      listener,
+		PacketConn:    packetConn,
 		Handler:       s,
 		UDPSize:       int(util.UDPSize),
 		ReadTimeout:   util.DefaultTimeout,
 		WriteTimeout:  util.DefaultTimeout,
 		MsgAcceptFunc: msgAcceptFunc,
+		TLSConfig:     s.tls.config,
 		NotifyStartedFunc: func() {
 			log.Printf("Listening on %s net %s", addr, net)
 			initWaitDone()
@@ -133,7 +188,12 @@ func (s *Server) serve(net string, addr string) {
 		s.serverLock.Unlock()
 	}()
 
-	err := dnsServer.ListenAndServe()
+	var err error
+	if listener != nil || packetConn != nil {
+		err = dnsServer.ActivateAndServe()
+	} else {
+		err = dnsServer.ListenAndServe()
+	}
 	if err != nil {
 		log.Printf("Error listening on %s net %s: %v", addr, net, err)
 	}
@@ -145,5 +205,9 @@ func (s *Server) Shutdown() {
 		_ = dnsServer.Shutdown()
 	}
 	s.servers = make(map[*dns.Server]bool)
+	for httpServer := range s.httpServers {
+		_ = httpServer.Close()
+	}
+	s.httpServers = make(map[*http.Server]bool)
 	s.serverLock.Unlock()
 }
@@ -0,0 +1,264 @@
+package server
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/Doridian/foxDNS/util"
+	"github.com/miekg/dns"
+)
+
+const DoHContentType = "application/dns-message"
+const DoHDefaultPath = "/dns-query"
+
+type DoHConfig struct {
+	Listen []string `yaml:"listen"`
+	Path   string   `yaml:"path"`
+	// Serve plain HTTP instead of HTTPS, for use behind a TLS terminating reverse proxy
+	Insecure bool `yaml:"insecure"`
+}
+
+// SetDoHConfig configures the DNS-over-HTTPS listeners.
+// HTTPS listeners use the certificate configured via SetTLSConfig.
+// This only has an effect before Serve is called.
+func (s *Server) SetDoHConfig(config *DoHConfig) {
+	s.serverLock.Lock()
+	defer s.serverLock.Unlock()
+	if s.serving {
+		return
+	}
+	s.doh = config
+}
+
+type dohResponseWriter struct {
+	localAddr  net.Addr
+	remoteAddr net.Addr
+	reply      *dns.Msg
+}
+
+var _ = dns.ResponseWriter(&dohResponseWriter{})
+
+func (w *dohResponseWriter) LocalAddr() net.Addr {
+	return w.localAddr
+}
+
+func (w *dohResponseWriter) RemoteAddr() net.Addr {
+	return w.remoteAddr
+}
+
+func (w *dohResponseWriter) WriteMsg(reply *dns.Msg) error {
+	if w.reply != nil {
+		return errors.New("cannot write multiple messages to DoH response")
+	}
+	w.reply = reply
+	return nil
+}
+
+func (w *dohResponseWriter) Write([]byte) (int, error) {
+	return 0, errors.New("unimplemented")
+}
+
+func (w *dohResponseWriter) Close() error {
+	return nil
+}
+
+func (w *dohResponseWriter) TsigStatus() error {
+	return nil
+}
+
+func (w *dohResponseWriter) TsigTimersOnly(bool) {
+	// no-op
+}
+
+func (w *dohResponseWriter) Hijack() {
+	// no-op
+}
+
+func parseWireHeader(data []byte) (dns.Header, bool) {
+	if len(data) < 12 {
+		return dns.Header{}, false
+	}
+	return dns.Header{
+		Id:      binary.BigEndian.Uint16(data[0:]),
+		Bits:    binary.BigEndian.Uint16(data[2:]),
+		Qdcount: binary.BigEndian.Uint16(data[4:]),
+		Ancount: binary.BigEndian.Uint16(data[6:]),
+		Nscount: binary.BigEndian.Uint16(data[8:]),
+		Arcount: binary.BigEndian.Uint16(data[10:]),
+	}, true
+}
+
+func dohRemoteAddr(r *http.Request) net.Addr {
+	addrPort, err := net.ResolveTCPAddr("tcp", r.RemoteAddr)
+	if err != nil {
+		return &net.TCPAddr{IP: net.IPv4zero}
+	}
+	return addrPort
+}
+
+func dohLocalAddr(r *http.Request) net.Addr {
+	localAddr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	if !ok {
+		return &net.TCPAddr{IP: net.IPv4zero}
+	}
+	return localAddr
+}
+
+func dohMaxAge(reply *dns.Msg) (uint32, bool) {
+	records := reply.Answer
+	if len(records) == 0 {
+		records = reply.Ns
+	}
+
+	found := false
+	var maxAge uint32
+	for _, rr := range records {
+		ttl := rr.Header().Ttl
+		if soa, ok := rr.(*dns.SOA); ok && soa.Minttl < ttl {
+			ttl = soa.Minttl
+		}
+		if !found || ttl < maxAge {
+			maxAge = ttl
+			found = true
+		}
+	}
+	return maxAge, found
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var data []byte
+	var err error
+
+	switch r.Method {
+	case http.MethodGet:
+		data, err = base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+	case http.MethodPost:
+		if r.Header.Get("Content-Type") != DoHContentType {
+			http.Error(w, "unsupported content type", http.StatusUnsupportedMediaType)
+			return
+		}
+		data, err = io.ReadAll(io.LimitReader(r.Body, dns.MaxMsgSize))
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		http.Error(w, "invalid DNS message", http.StatusBadRequest)
+		return
+	}
+
+	header, ok := parseWireHeader(data)
+	if !ok {
+		http.Error(w, "invalid DNS message", http.StatusBadRequest)
+		return
+	}
+
+	msg := new(dns.Msg)
+	err = msg.Unpack(data)
+	if err != nil {
+		http.Error(w, "invalid DNS message", http.StatusBadRequest)
+		return
+	}
+
+	wr := &dohResponseWriter{
+		localAddr:  dohLocalAddr(r),
+		remoteAddr: dohRemoteAddr(r),
+	}
+
+	switch msgAcceptFunc(header) {
+	case dns.MsgAccept:
+		s.ServeDNS(wr, msg)
+	case dns.MsgReject:
+		reply := new(dns.Msg)
+		reply.SetRcodeFormatError(msg)
+		wr.reply = reply
+	case dns.MsgRejectNotImplemented:
+		reply := new(dns.Msg)
+		reply.SetRcode(msg, dns.RcodeNotImplemented)
+		wr.reply = reply
+	default:
+		http.Error(w, "invalid DNS message", http.StatusBadRequest)
+		return
+	}
+
+	if wr.reply == nil {
+		http.Error(w, "no reply", http.StatusInternalServerError)
+		return
+	}
+
+	replyData, err := wr.reply.Pack()
+	if err != nil {
+		log.Printf("Error packing DoH reply: %v", err)
+		http.Error(w, "error packing reply", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", DoHContentType)
+	if maxAge, ok := dohMaxAge(wr.reply); ok {
+		w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", maxAge))
+	}
+	_, _ = w.Write(replyData)
+}
+
+func (s *Server) serveDoH(config *DoHConfig, addr string, listener net.Listener) {
+	defer s.serveWait.Done()
+	initWaitDone := sync.OnceFunc(s.initWait.Done)
+	defer initWaitDone()
+
+	path := config.Path
+	if path == "" {
+		path = DoHDefaultPath
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(path, s)
+
+	httpServer := &http.Server{
+		Addr:         addr,
+		Handler:      mux,
+		ReadTimeout:  util.DefaultTimeout,
+		WriteTimeout: util.DefaultTimeout,
+	}
+
+	if listener == nil {
+		var err error
+		listener, err = net.Listen("tcp", addr)
+		if err != nil {
+			log.Printf("Error listening on %s net https: %v", addr, err)
+			return
+		}
+	}
+
+	if !config.Insecure {
+		listener = tls.NewListener(listener, s.tls.configWithProtos([]string{"h2", "http/1.1"}))
+	}
+
+	s.serverLock.Lock()
+	s.httpServers[httpServer] = true
+	s.serverLock.Unlock()
+
+	defer func() {
+		s.serverLock.Lock()
+		delete(s.httpServers, httpServer)
+		s.serverLock.Unlock()
+	}()
+
+	log.Printf("Listening on %s net https", addr)
+	initWaitDone()
+	s.privDropWait.Wait()
+	log.Printf("Handling requests on %s net https", addr)
+
+	err := httpServer.Serve(listener)
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Printf("Error serving on %s net https: %v", addr, err)
+	}
+}
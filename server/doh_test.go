@@ -0,0 +1,113 @@
+package server_test
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/Doridian/foxDNS/server"
+	"github.com/Doridian/foxDNS/util"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testDoHURL = "http://127.0.0.1:12154/dns-query"
+
+// zoneHandler answers www.example.com. and returns NXDOMAIN for everything else
+type zoneHandler struct{}
+
+func (h *zoneHandler) ServeDNS(wr dns.ResponseWriter, msg *dns.Msg) {
+	reply := &dns.Msg{}
+	if msg.Question[0].Name == "www.example.com." {
+		reply.SetReply(msg)
+		reply.Answer = []dns.RR{util.FillHeader(&dns.A{A: net.IPv4(192, 0, 2, 1)}, "www.example.com.", dns.TypeA, 300)}
+	} else {
+		reply.SetRcode(msg, dns.RcodeNameError)
+		reply.Ns = []dns.RR{util.FillHeader(&dns.SOA{
+			Ns:     "ns.example.com.",
+			Mbox:   "hostmaster.example.com.",
+			Minttl: 60,
+		}, "example.com.", dns.TypeSOA, 3600)}
+	}
+	_ = wr.WriteMsg(reply)
+}
+
+func startDoHServer(t *testing.T) {
+	srv := server.NewServer(nil, false)
+	srv.SetHandler(&zoneHandler{})
+	srv.SetDoHConfig(&server.DoHConfig{
+		Listen:   []string{"127.0.0.1:12154"},
+		Insecure: true,
+	})
+	go srv.Serve()
+	srv.WaitReady()
+	t.Cleanup(srv.Shutdown)
+}
+
+func packQuery(t *testing.T, name string) []byte {
+	msg := &dns.Msg{}
+	msg.SetQuestion(name, dns.TypeA)
+	data, err := msg.Pack()
+	require.NoError(t, err)
+	return data
+}
+
+func readDoHReply(t *testing.T, resp *http.Response) *dns.Msg {
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, server.DoHContentType, resp.Header.Get("Content-Type"))
+
+	data, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	reply := &dns.Msg{}
+	require.NoError(t, reply.Unpack(data))
+	return reply
+}
+
+func TestDoHGetAndPost(t *testing.T) {
+	startDoHServer(t)
+
+	resp, err := http.Get(testDoHURL + "?dns=" + base64.RawURLEncoding.EncodeToString(packQuery(t, "www.example.com.")))
+	require.NoError(t, err)
+	assert.Equal(t, "max-age=300", resp.Header.Get("Cache-Control"))
+	reply := readDoHReply(t, resp)
+	assert.Equal(t, dns.RcodeSuccess, reply.Rcode)
+	assert.Len(t, reply.Answer, 1)
+
+	// Negative answers may be cached for the SOA minimum TTL (RFC 2308)
+	resp, err = http.Post(testDoHURL, server.DoHContentType, bytes.NewReader(packQuery(t, "nx.example.com.")))
+	require.NoError(t, err)
+	assert.Equal(t, "max-age=60", resp.Header.Get("Cache-Control"))
+	reply = readDoHReply(t, resp)
+	assert.Equal(t, dns.RcodeNameError, reply.Rcode)
+}
+
+func TestDoHInvalidRequests(t *testing.T) {
+	startDoHServer(t)
+
+	for _, query := range []string{"?dns=!!!", "?dns=AAAA", ""} {
+		resp, err := http.Get(testDoHURL + query)
+		require.NoError(t, err)
+		_ = resp.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode, query)
+	}
+
+	resp, err := http.Post(testDoHURL, "text/plain", bytes.NewReader(packQuery(t, "www.example.com.")))
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	assert.Equal(t, http.StatusUnsupportedMediaType, resp.StatusCode)
+
+	req, err := http.NewRequest(http.MethodPut, testDoHURL, nil)
+	require.NoError(t, err)
+	resp, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+	assert.Equal(t, "GET, POST", resp.Header.Get("Allow"))
+}
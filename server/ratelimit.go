@@ -0,0 +1,214 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/Doridian/foxDNS/handler"
+	"github.com/Doridian/foxDNS/util"
+	lru "github.com/hashicorp/golang-lru/v2"
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	rateLimitedQueries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "foxdns_ratelimit_queries_total",
+		Help: "The total number of DNS queries over the client rate limit",
+	}, []string{"action"})
+
+	rateLimitedClients = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "foxdns_ratelimit_limited_clients_total",
+		Help: "The total number of times a client prefix went over the rate limit",
+	})
+)
+
+const (
+	defaultRateLimitIPv4Prefix = 32
+	defaultRateLimitIPv6Prefix = 64
+	defaultRateLimitMaxClients = 100000
+)
+
+type RateLimitConfig struct {
+	// Queries per second allowed per client prefix, 0 disables rate limiting
+	Rate  float64 `yaml:"rate"`
+	Burst int     `yaml:"burst"`
+
+	IPv4Prefix int `yaml:"ipv4-prefix"`
+	IPv6Prefix int `yaml:"ipv6-prefix"`
+
+	// Answer every Nth limited UDP query with TC=1 instead of dropping it, so real clients retry over TCP
+	Slip int `yaml:"slip"`
+
+	// Clients (CIDRs, IPs or IP:port, like ACLs and views) that are never limited
+	Exempt []string `yaml:"exempt"`
+
+	// Number of client prefixes to track, the least recently seen ones are forgotten
+	MaxClients int `yaml:"max-clients"`
+}
+
+// RateLimiter tracks a token bucket per client prefix
+type RateLimiter struct {
+	rate       float64
+	burst      float64
+	ipv4Mask   net.IPMask
+	ipv6Mask   net.IPMask
+	slip       uint64
+	exempt     []*handler.AddrMatcher
+	buckets    *lru.Cache[string, *util.TokenBucket]
+	bucketLock sync.Mutex
+}
+
+type rateLimitAction int
+
+const (
+	rateLimitAllow rateLimitAction = iota
+	rateLimitDrop
+	rateLimitSlip
+)
+
+// NewRateLimiter validates config and builds its limiter, nil or a rate of 0 returns a nil limiter
+func NewRateLimiter(config *RateLimitConfig) (*RateLimiter, error) {
+	if config == nil || config.Rate <= 0 {
+		return nil, nil
+	}
+
+	ipv4Prefix := config.IPv4Prefix
+	if ipv4Prefix <= 0 {
+		ipv4Prefix = defaultRateLimitIPv4Prefix
+	}
+	ipv6Prefix := config.IPv6Prefix
+	if ipv6Prefix <= 0 {
+		ipv6Prefix = defaultRateLimitIPv6Prefix
+	}
+	if ipv4Prefix > 32 || ipv6Prefix > 128 {
+		return nil, fmt.Errorf("invalid rate limit prefix length")
+	}
+
+	burst := float64(config.Burst)
+	if burst < config.Rate {
+		burst = config.Rate
+	}
+	if burst < 1 {
+		burst = 1
+	}
+
+	maxClients := config.MaxClients
+	if maxClients <= 0 {
+		maxClients = defaultRateLimitMaxClients
+	}
+	buckets, err := lru.New[string, *util.TokenBucket](maxClients)
+	if err != nil {
+		return nil, err
+	}
+
+	limiter := &RateLimiter{
+		rate:     config.Rate,
+		burst:    burst,
+		ipv4Mask: net.CIDRMask(ipv4Prefix, 32),
+		ipv6Mask: net.CIDRMask(ipv6Prefix, 128),
+		buckets:  buckets,
+	}
+	if config.Slip > 0 {
+		limiter.slip = uint64(config.Slip)
+	}
+
+	for _, exempt := range config.Exempt {
+		matcher, err := handler.ParseAddrMatcher(exempt)
+		if err != nil {
+			return nil, err
+		}
+		limiter.exempt = append(limiter.exempt, matcher)
+	}
+
+	return limiter, nil
+}
+
+func (r *RateLimiter) getBucket(key string, now time.Time) *util.TokenBucket {
+	r.bucketLock.Lock()
+	defer r.bucketLock.Unlock()
+
+	bucket, ok := r.buckets.Get(key)
+	if !ok {
+		bucket = util.NewTokenBucket(r.burst, now)
+		r.buckets.Add(key, bucket)
+	}
+	return bucket
+}
+
+func (r *RateLimiter) check(wr dns.ResponseWriter, now time.Time) rateLimitAction {
+	for _, exempt := range r.exempt {
+		if exempt.Matches(wr.RemoteAddr()) {
+			return rateLimitAllow
+		}
+	}
+
+	// Stream transports get their own bucket, so clients told to retry over TCP can do so
+	udp := util.IsUDPQuery(wr)
+	key := util.ClientPrefix(util.ExtractIP(wr.RemoteAddr()), r.ipv4Mask, r.ipv6Mask)
+	if !udp {
+		key = "stream|" + key
+	}
+
+	allowed, limited := r.getBucket(key, now).Take(now, r.rate, r.burst)
+	if allowed {
+		return rateLimitAllow
+	}
+
+	if limited == 1 {
+		rateLimitedClients.Inc()
+	}
+
+	if r.slip > 0 && limited%r.slip == 0 && udp {
+		return rateLimitSlip
+	}
+	return rateLimitDrop
+}
+
+// SetRateLimiter installs limiter for all following queries, nil disables rate limiting.
+// Queries over the limit never reach the handler.
+func (s *Server) SetRateLimiter(limiter *RateLimiter) {
+	s.handlerLock.Lock()
+	defer s.handlerLock.Unlock()
+	s.rateLimiter = limiter
+}
+
+// SetRateLimitConfig configures per-client rate limiting, nil or a rate of 0 disables it
+func (s *Server) SetRateLimitConfig(config *RateLimitConfig) error {
+	limiter, err := NewRateLimiter(config)
+	if err != nil {
+		return err
+	}
+	s.SetRateLimiter(limiter)
+	return nil
+}
+
+// applyRateLimit returns false if the query was handled because the client is over its limit
+func (s *Server) applyRateLimit(limiter *RateLimiter, wr dns.ResponseWriter, msg *dns.Msg) bool {
+	if limiter == nil {
+		return true
+	}
+
+	switch limiter.check(wr, time.Now()) {
+	case rateLimitAllow:
+		return true
+	case rateLimitSlip:
+		rateLimitedQueries.WithLabelValues("slip").Inc()
+		reply := &dns.Msg{}
+		reply.SetReply(msg)
+		reply.Truncated = true
+		_ = wr.WriteMsg(reply)
+	default:
+		rateLimitedQueries.WithLabelValues("drop").Inc()
+		// Stream transports have verified source addresses, so they get told instead of timing out
+		if !util.IsUDPQuery(wr) {
+			reply := &dns.Msg{}
+			reply.SetRcode(msg, dns.RcodeRefused)
+			_ = wr.WriteMsg(reply)
+		}
+	}
+	return false
+}
@@ -0,0 +1,132 @@
+package server_test
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+
+	"github.com/Doridian/foxDNS/handler"
+	"github.com/Doridian/foxDNS/server"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type countingHandler struct {
+	queries atomic.Int64
+}
+
+func (h *countingHandler) ServeDNS(wr dns.ResponseWriter, msg *dns.Msg) {
+	h.queries.Add(1)
+	reply := &dns.Msg{}
+	reply.SetReply(msg)
+	_ = wr.WriteMsg(reply)
+}
+
+func newRateLimitedServer(t *testing.T, config *server.RateLimitConfig) (*server.Server, *countingHandler) {
+	srv := server.NewServer(nil, false)
+	hdl := &countingHandler{}
+	srv.SetHandler(hdl)
+	require.NoError(t, srv.SetRateLimitConfig(config))
+	return srv, hdl
+}
+
+func queryFrom(srv *server.Server, network string, ip net.IP) *handler.TestResponseWriter {
+	msg := &dns.Msg{}
+	msg.SetQuestion("example.com.", dns.TypeA)
+
+	wr := &handler.TestResponseWriter{}
+	if network == "udp" {
+		wr.LocalAddrVal = &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53}
+		wr.RemoteAddrVal = &net.UDPAddr{IP: ip, Port: 5053}
+	} else {
+		wr.LocalAddrVal = &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53}
+		wr.RemoteAddrVal = &net.TCPAddr{IP: ip, Port: 5053}
+	}
+	srv.ServeDNS(wr, msg)
+	return wr
+}
+
+func TestRateLimitBurstAndSlip(t *testing.T) {
+	srv, hdl := newRateLimitedServer(t, &server.RateLimitConfig{
+		Rate:  1,
+		Burst: 3,
+		Slip:  2,
+	})
+
+	client := net.IPv4(192, 0, 2, 1)
+	for range 3 {
+		wr := queryFrom(srv, "udp", client)
+		require.NotNil(t, wr.LastMsg)
+		assert.False(t, wr.LastMsg.Truncated)
+	}
+	assert.Equal(t, int64(3), hdl.queries.Load())
+
+	// First excess query is dropped, the second one slips through truncated
+	wr := queryFrom(srv, "udp", client)
+	assert.Nil(t, wr.LastMsg)
+	wr = queryFrom(srv, "udp", client)
+	require.NotNil(t, wr.LastMsg)
+	assert.True(t, wr.LastMsg.Truncated)
+
+	// TCP has its own bucket, so the truncated query can be retried
+	for range 3 {
+		wr = queryFrom(srv, "tcp", client)
+		require.NotNil(t, wr.LastMsg)
+		assert.Equal(t, dns.RcodeSuccess, wr.LastMsg.Rcode)
+	}
+	assert.Equal(t, int64(6), hdl.queries.Load())
+
+	// Once that is exhausted too, TCP is told it is refused
+	wr = queryFrom(srv, "tcp", client)
+	require.NotNil(t, wr.LastMsg)
+	assert.Equal(t, dns.RcodeRefused, wr.LastMsg.Rcode)
+
+	// Other clients have their own bucket
+	wr = queryFrom(srv, "udp", net.IPv4(192, 0, 2, 2))
+	require.NotNil(t, wr.LastMsg)
+	assert.Equal(t, int64(7), hdl.queries.Load())
+}
+
+func TestRateLimitPrefixAndExempt(t *testing.T) {
+	srv, hdl := newRateLimitedServer(t, &server.RateLimitConfig{
+		Rate:       1,
+		Burst:      1,
+		IPv6Prefix: 64,
+		Exempt:     []string{"2001:db8:ffff::/48", "[2001:db8:2::1]:5053", "[2001:db8:3::1]:53"},
+	})
+
+	wr := queryFrom(srv, "udp", net.ParseIP("2001:db8:1:1::1"))
+	require.NotNil(t, wr.LastMsg)
+	// Same /64, same bucket
+	wr = queryFrom(srv, "udp", net.ParseIP("2001:db8:1:1::2"))
+	assert.Nil(t, wr.LastMsg)
+	assert.Equal(t, int64(1), hdl.queries.Load())
+
+	for range 5 {
+		wr = queryFrom(srv, "udp", net.ParseIP("2001:db8:ffff::1"))
+		require.NotNil(t, wr.LastMsg)
+	}
+	assert.Equal(t, int64(6), hdl.queries.Load())
+
+	// Exemptions with a port use the same syntax as ACLs and views
+	for range 5 {
+		wr = queryFrom(srv, "udp", net.ParseIP("2001:db8:2::1"))
+		require.NotNil(t, wr.LastMsg)
+	}
+	queryFrom(srv, "udp", net.ParseIP("2001:db8:3::1"))
+	wr = queryFrom(srv, "udp", net.ParseIP("2001:db8:3::1"))
+	assert.Nil(t, wr.LastMsg)
+	assert.Equal(t, int64(12), hdl.queries.Load())
+
+	// Disabling drops all limits
+	require.NoError(t, srv.SetRateLimitConfig(nil))
+	wr = queryFrom(srv, "udp", net.ParseIP("2001:db8:1:1::2"))
+	require.NotNil(t, wr.LastMsg)
+}
+
+func TestRateLimitInvalidConfig(t *testing.T) {
+	srv := server.NewServer(nil, false)
+	assert.Error(t, srv.SetRateLimitConfig(&server.RateLimitConfig{Rate: 1, Exempt: []string{"bogus"}}))
+	assert.Error(t, srv.SetRateLimitConfig(&server.RateLimitConfig{Rate: 1, IPv4Prefix: 33}))
+}
@@ -0,0 +1,164 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+)
+
+type TLSConfig struct {
+	Listen       []string `yaml:"listen"`
+	CertFile     string   `yaml:"cert"`
+	KeyFile      string   `yaml:"key"`
+	ClientCAFile string   `yaml:"client-ca"`
+}
+
+type tlsState struct {
+	certificate *tls.Certificate
+	clientCAs   *x509.CertPool
+}
+
+type tlsHolder struct {
+	stateLock sync.RWMutex
+	state     *tlsState
+	config    *tls.Config
+}
+
+var ErrNoTLSCertificate = errors.New("no TLS certificate loaded")
+
+func newTLSHolder() *tlsHolder {
+	holder := &tlsHolder{}
+	holder.config = &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		GetCertificate:     holder.getCertificate,
+		GetConfigForClient: holder.getConfigForClient,
+	}
+	return holder
+}
+
+func loadTLSState(config *TLSConfig) (*tlsState, error) {
+	cert, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	state := &tlsState{
+		certificate: &cert,
+	}
+
+	if config.ClientCAFile != "" {
+		caData, err := os.ReadFile(config.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		state.clientCAs = x509.NewCertPool()
+		if !state.clientCAs.AppendCertsFromPEM(caData) {
+			return nil, fmt.Errorf("no certificates found in client CA file %s", config.ClientCAFile)
+		}
+	}
+
+	return state, nil
+}
+
+func (h *tlsHolder) getState() *tlsState {
+	h.stateLock.RLock()
+	defer h.stateLock.RUnlock()
+	return h.state
+}
+
+func (h *tlsHolder) setState(state *tlsState) {
+	h.stateLock.Lock()
+	defer h.stateLock.Unlock()
+	h.state = state
+}
+
+func (h *tlsHolder) getCertificate(_ *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	state := h.getState()
+	if state == nil {
+		return nil, ErrNoTLSCertificate
+	}
+	return state.certificate, nil
+}
+
+func (h *tlsHolder) getConfigForClient(_ *tls.ClientHelloInfo) (*tls.Config, error) {
+	state := h.getState()
+	if state == nil {
+		return nil, ErrNoTLSCertificate
+	}
+
+	config := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{*state.certificate},
+	}
+	if state.clientCAs != nil {
+		config.ClientCAs = state.clientCAs
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+func (h *tlsHolder) configWithProtos(protos []string) *tls.Config {
+	config := h.config.Clone()
+	config.NextProtos = protos
+	config.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		clientConfig, err := h.getConfigForClient(hello)
+		if err != nil {
+			return nil, err
+		}
+		clientConfig.NextProtos = protos
+		return clientConfig, nil
+	}
+	return config
+}
+
+// LoadedTLSConfig is a TLS configuration with its certificates read, ready to be applied
+type LoadedTLSConfig struct {
+	listen []string
+	state  *tlsState
+}
+
+// LoadTLSConfig reads the certificate, key and client CA without applying them.
+// Returns nil if no certificate is configured.
+func LoadTLSConfig(config *TLSConfig) (*LoadedTLSConfig, error) {
+	if config == nil || config.CertFile == "" {
+		return nil, nil
+	}
+
+	state, err := loadTLSState(config)
+	if err != nil {
+		return nil, err
+	}
+	return &LoadedTLSConfig{
+		listen: config.Listen,
+		state:  state,
+	}, nil
+}
+
+// ApplyTLSConfig swaps in the certificate, key and client CA used by all TLS listeners.
+// Listen addresses are only read once, when Serve is called.
+func (s *Server) ApplyTLSConfig(loaded *LoadedTLSConfig) {
+	if loaded == nil {
+		return
+	}
+
+	s.tls.setState(loaded.state)
+
+	s.serverLock.Lock()
+	if !s.serving {
+		s.tlsListen = loaded.listen
+	}
+	s.serverLock.Unlock()
+}
+
+// SetTLSConfig (re)loads and applies the certificate, key and client CA used by all TLS listeners
+func (s *Server) SetTLSConfig(config *TLSConfig) error {
+	loaded, err := LoadTLSConfig(config)
+	if err != nil {
+		return err
+	}
+	s.ApplyTLSConfig(loaded)
+	return nil
+}
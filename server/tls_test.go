@@ -0,0 +1,98 @@
+package server_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Doridian/foxDNS/server"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testTLSAddr = "127.0.0.1:12153"
+
+// writeTestCertificate writes a self-signed certificate for 127.0.0.1 named commonName
+func writeTestCertificate(t *testing.T, commonName string) (*x509.Certificate, *server.TLSConfig) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		DNSNames:     []string{commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	config := &server.TLSConfig{
+		CertFile: filepath.Join(dir, "cert.pem"),
+		KeyFile:  filepath.Join(dir, "key.pem"),
+	}
+	require.NoError(t, os.WriteFile(config.CertFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	require.NoError(t, os.WriteFile(config.KeyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600))
+	return cert, config
+}
+
+func queryTLS(t *testing.T, cert *x509.Certificate) *dns.Msg {
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+	client := &dns.Client{
+		Net: "tcp-tls",
+		TLSConfig: &tls.Config{
+			RootCAs:    roots,
+			ServerName: cert.Subject.CommonName,
+		},
+	}
+
+	msg := &dns.Msg{}
+	msg.SetQuestion("example.com.", dns.TypeA)
+	reply, _, err := client.Exchange(msg, testTLSAddr)
+	require.NoError(t, err)
+	return reply
+}
+
+func TestTLSListenerCertificateReload(t *testing.T) {
+	firstCert, firstConfig := writeTestCertificate(t, "first.example.com")
+	secondCert, secondConfig := writeTestCertificate(t, "second.example.com")
+
+	srv := server.NewServer(nil, false)
+	srv.SetHandler(&countingHandler{})
+	firstConfig.Listen = []string{testTLSAddr}
+	require.NoError(t, srv.SetTLSConfig(firstConfig))
+	go srv.Serve()
+	srv.WaitReady()
+	defer srv.Shutdown()
+
+	reply := queryTLS(t, firstCert)
+	assert.Equal(t, dns.RcodeSuccess, reply.Rcode)
+
+	// Broken certificates are rejected and the old one stays in use
+	require.Error(t, srv.SetTLSConfig(&server.TLSConfig{CertFile: secondConfig.CertFile, KeyFile: firstConfig.KeyFile}))
+	reply = queryTLS(t, firstCert)
+	assert.Equal(t, dns.RcodeSuccess, reply.Rcode)
+
+	// New handshakes use the reloaded certificate, without restarting the listener
+	require.NoError(t, srv.SetTLSConfig(secondConfig))
+	reply = queryTLS(t, secondCert)
+	assert.Equal(t, dns.RcodeSuccess, reply.Rcode)
+}
@@ -31,3 +31,8 @@ func LocalAddrFromAddr(parent net.Addr) *NetworkLocalAddr {
 		parent: parent,
 	}
 }
+
+// ResolutionRecorder is implemented by Addressables that want to know how a resolver answered the query
+type ResolutionRecorder interface {
+	RecordResolution(cacheResult string, upstream string)
+}
@@ -0,0 +1,45 @@
+package util
+
+import (
+	"github.com/miekg/dns"
+)
+
+// ClientSubnetAddressable is implemented by Addressables of queries that carried an EDNS Client Subnet option (RFC 7871)
+type ClientSubnetAddressable interface {
+	Addressable
+	ClientSubnet() *dns.EDNS0_SUBNET
+}
+
+type ClientSubnetWriter struct {
+	dns.ResponseWriter
+	Subnet *dns.EDNS0_SUBNET
+}
+
+func (w *ClientSubnetWriter) ClientSubnet() *dns.EDNS0_SUBNET {
+	return w.Subnet
+}
+
+// FindClientSubnet returns the EDNS Client Subnet option of msg, if any
+func FindClientSubnet(msg *dns.Msg) *dns.EDNS0_SUBNET {
+	edns0 := msg.IsEdns0()
+	if edns0 == nil {
+		return nil
+	}
+
+	for _, opt := range edns0.Option {
+		subnetOpt, ok := opt.(*dns.EDNS0_SUBNET)
+		if ok {
+			return subnetOpt
+		}
+	}
+	return nil
+}
+
+// GetClientSubnet returns the EDNS Client Subnet option the client sent along with the query, if any
+func GetClientSubnet(wr Addressable) *dns.EDNS0_SUBNET {
+	subnetWr, ok := wr.(ClientSubnetAddressable)
+	if !ok {
+		return nil
+	}
+	return subnetWr.ClientSubnet()
+}
@@ -2,6 +2,7 @@ package util
 
 import (
 	"net"
+	"strings"
 
 	"github.com/miekg/dns"
 )
@@ -42,3 +43,7 @@ func IsBadQuery(q *dns.Question) bool {
 func IsLocalQuery(wr Addressable) bool {
 	return wr.LocalAddr().Network() == NetworkLocal
 }
+
+func IsUDPQuery(wr Addressable) bool {
+	return strings.HasPrefix(wr.LocalAddr().Network(), "udp")
+}
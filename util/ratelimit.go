@@ -0,0 +1,51 @@
+package util
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// ClientPrefix masks ip with the mask matching its address family, for grouping clients by network
+func ClientPrefix(ip net.IP, ipv4Mask net.IPMask, ipv6Mask net.IPMask) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(ipv4Mask).String()
+	}
+	return ip.Mask(ipv6Mask).String()
+}
+
+// TokenBucket allows bursts of events up to a fixed size, refilled at a fixed rate
+type TokenBucket struct {
+	lock    sync.Mutex
+	tokens  float64
+	last    time.Time
+	limited uint64
+}
+
+func NewTokenBucket(burst float64, now time.Time) *TokenBucket {
+	return &TokenBucket{
+		tokens: burst,
+		last:   now,
+	}
+}
+
+// Take takes a token if one is available.
+// Otherwise it returns false along with how many takes in a row failed, including this one.
+func (b *TokenBucket) Take(now time.Time, rate float64, burst float64) (bool, uint64) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if now.After(b.last) {
+		b.tokens = min(burst, b.tokens+now.Sub(b.last).Seconds()*rate)
+		b.last = now
+	}
+
+	if b.tokens >= 1 {
+		b.tokens--
+		b.limited = 0
+		return true, 0
+	}
+
+	b.limited++
+	return false, b.limited
+}